@@ -2,11 +2,18 @@ package action
 
 import (
 	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
 	"io"
+	"io/ioutil"
+	"mime/multipart"
 	"net"
 	"net/url"
-
-	"fmt"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
 
 	"errors"
 
@@ -20,111 +27,499 @@ import (
 const (
 	GetScore  = 1
 	PostScore = 20
+
+	// GetWithRetryで再試行するまでの待ち時間。回数に比例して伸びる
+	RetryWait = 100 * time.Millisecond
+
+	// ステータスが想定外だったときにログに出すbodyの最大バイト数
+	MaxBodySnippetSize = 256
 )
 
 type Checker interface {
 	Check(body io.Reader, l *fails.Logger) bool
 	CheckStatus(status int, l *fails.Logger) bool
+	CheckHeader(header http.Header, l *fails.Logger) bool
 }
 
 type CheckFunc func(body io.Reader, l *fails.Logger) bool
 
+type HeaderCheckFunc func(header http.Header, l *fails.Logger) bool
+
 type StatusChecker struct {
-	ExpectedStatus int
-	CheckFunc      CheckFunc
+	ExpectedStatus  int
+	HeaderCheckFunc HeaderCheckFunc // nilならヘッダはチェックしない
+	CheckFunc       CheckFunc
 }
 
 func (sc StatusChecker) Check(body io.Reader, l *fails.Logger) bool {
 	return sc.CheckFunc(body, l)
 }
 
+func (sc StatusChecker) CheckHeader(header http.Header, l *fails.Logger) bool {
+	if sc.HeaderCheckFunc == nil {
+		return true
+	}
+	return sc.HeaderCheckFunc(header, l)
+}
+
+// レスポンスヘッダもチェックしたいときに使う。例: action.OK(f).WithHeader(hf)
+func (sc StatusChecker) WithHeader(f HeaderCheckFunc) StatusChecker {
+	sc.HeaderCheckFunc = f
+	return sc
+}
+
 func (sc StatusChecker) CheckStatus(status int, l *fails.Logger) bool {
 	if status != sc.ExpectedStatus {
-		l.Add(fmt.Sprintf("ステータスが%dではありません: %d", sc.ExpectedStatus, status), nil)
+		l.Add(fails.Msg(fails.MsgUnexpectedStatus, sc.ExpectedStatus, status), nil)
 		return false
 	}
 	return true
 }
 
-func OK(f CheckFunc) StatusChecker {
+// ステータスがexpectedであることを確認してからfを呼ぶ
+func Status(expected int, f CheckFunc) StatusChecker {
 	return StatusChecker{
-		ExpectedStatus: 200,
+		ExpectedStatus: expected,
 		CheckFunc:      f,
 	}
 }
 
+func OK(f CheckFunc) StatusChecker {
+	return Status(200, f)
+}
+
 func BadRequest(f CheckFunc) StatusChecker {
-	return StatusChecker{
-		ExpectedStatus: 400,
-		CheckFunc:      f,
-	}
+	return Status(400, f)
 }
 
-func request(s *session.Session, method, path string, body io.Reader, headers map[string]string, c Checker) bool {
+func request(s *session.Session, method, path string, body io.Reader, headers map[string]string, c Checker) (bool, time.Duration) {
 	l := &fails.Logger{Prefix: "[" + method + " " + path + "] "}
 
+	req, ok := newRequest(s, method, path, body, headers, l)
+	if !ok {
+		return false, 0
+	}
+
+	return do(s, req, l, c)
+}
+
+func newRequest(s *session.Session, method, path string, body io.Reader, headers map[string]string, l *fails.Logger) (*http.Request, bool) {
 	u, err := url.Parse(path)
 	if err != nil {
-		l.Critical("予期せぬエラー（主催者に連絡してください）",
+		l.Critical(fails.Msg(fails.MsgUnexpectedError),
 			errors.New("URLのパースに失敗しました: "+path+", error: "+err.Error()))
-		return false
+		return nil, false
 	}
 	u.Scheme = s.Scheme
 	u.Host = s.Host
 
 	req, err := http.NewRequest(method, u.String(), body)
 	if err != nil {
-		l.Critical("予期せぬ失敗です (主催者に連絡してください)", err)
-		return false
+		l.Critical(fails.Msg(fails.MsgUnexpectedError), err)
+		return nil, false
 	}
 
 	req.Header.Set("User-Agent", s.UserAgent)
+	if body != nil {
+		// bodyを送るリクエストはほとんどJSONなので、指定がなければJSONとする
+		req.Header.Set("Content-Type", "application/json")
+	}
 	if headers != nil {
 		for key, val := range headers {
 			req.Header.Set(key, val)
 		}
 	}
 
+	return req, true
+}
+
+// 自前で組み立てたリクエストを送る。URLにホストが無ければセッションのものを使う
+func Do(s *session.Session, req *http.Request, c Checker) bool {
+	l := &fails.Logger{Prefix: "[" + req.Method + " " + req.URL.RequestURI() + "] "}
+
+	if req.URL.Host == "" {
+		req.URL.Scheme = s.Scheme
+		req.URL.Host = s.Host
+	}
+	if req.Header.Get("User-Agent") == "" {
+		req.Header.Set("User-Agent", s.UserAgent)
+	}
+
+	ok, _ := do(s, req, l, c)
+	return ok
+}
+
+// リクエストを送ってからレスポンスのbodyを読み終わるまでの時間も返す
+func do(s *session.Session, req *http.Request, l *fails.Logger, c Checker) (bool, time.Duration) {
+	start := time.Now()
 	res, err := s.Client.Do(req)
+	return checkResponse(s, req, res, err, l, c, start)
+}
 
+func checkResponse(s *session.Session, req *http.Request, res *http.Response, err error, l *fails.Logger, c Checker, start time.Time) (bool, time.Duration) {
 	if err != nil {
 		if err, ok := err.(net.Error); ok && err.Timeout() {
-			l.Add("リクエストがタイムアウトしました", err)
-			return false
+			if isTLSHandshakeTimeout(err) {
+				l.Minor(fails.Msg(fails.MsgTLSHandshakeTimeout), err)
+			} else {
+				l.Minor(fails.Msg(fails.MsgRequestTimeout), err)
+			}
+			return false, time.Since(start)
 		}
-		l.Add("リクエストが失敗しました", err)
-		return false
+		msg, connErr := requestErrorMessage(err)
+		if connErr {
+			// 繋がらない、TLSが話せないといった失敗はサーバーの設定の問題で、やり直しても変わらないので失格にする
+			l.Critical(msg, err)
+		} else {
+			// 接続が途中で切られたなどは負荷をかけている間には起こりうるので、1回では失格にしない
+			l.Add(msg, err)
+		}
+		return false, time.Since(start)
 	}
 	defer res.Body.Close()
 
-	ok := c.CheckStatus(res.StatusCode, l)
+	if s.OnResponse != nil {
+		s.OnResponse(res)
+	}
+
+	sl := l
+	if res.StatusCode >= 400 {
+		// エラーのときはbodyの先頭をログに残す。checkにはbody全体を渡す
+		snippet := make([]byte, MaxBodySnippetSize)
+		n, _ := io.ReadFull(res.Body, snippet)
+		res.Body = ioutil.NopCloser(io.MultiReader(bytes.NewReader(snippet[:n]), res.Body))
+		sl = &fails.Logger{Prefix: l.Prefix, Detail: "body: " + string(snippet[:n])}
+	}
+
+	ok := c.CheckStatus(res.StatusCode, sl)
 	if !ok {
-		return false
+		return false, time.Since(start)
+	}
+
+	ok = c.CheckHeader(res.Header, l)
+	if !ok {
+		return false, time.Since(start)
 	}
 
-	return c.Check(res.Body, l)
+	if req.Method == "HEAD" {
+		// HEADにはbodyが無いのでnilを渡す
+		return c.Check(nil, l), time.Since(start)
+	}
+	var body io.Reader = res.Body
+	var lr *limitedReader
+	if s.MaxBodySize > 0 {
+		// 巨大なbodyを全部読み込もうとしてメモリを使い果たさないようにする
+		lr = &limitedReader{r: res.Body, n: s.MaxBodySize}
+		body = lr
+	}
+	ok = c.Check(body, l)
+	// checkで読まれなかった分も最後まで読んでから計測を終える
+	io.Copy(ioutil.Discard, body)
+	if lr != nil && lr.exceeded {
+		l.Add(fails.Msg(fails.MsgBodyTooLarge, s.MaxBodySize), nil)
+		return false, time.Since(start)
+	}
+	return ok, time.Since(start)
+}
+
+// TLSや接続の失敗は、参加者がHTTPSの設定などを調べやすいように、ただの失敗と区別して記録する
+// 接続そのものの失敗ならconnErrをtrueにする
+func requestErrorMessage(err error) (msg string, connErr bool) {
+	var recordHeaderErr tls.RecordHeaderError
+	var unknownAuthorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var certificateInvalidErr x509.CertificateInvalidError
+	switch {
+	case errors.As(err, &recordHeaderErr), strings.Contains(err.Error(), "server gave HTTP response to HTTPS client"):
+		// TLSではない応答が返ってきた。HTTPSのポートで平文のHTTPを返しているなど
+		// 応答がHTTPに見えるときは、bench/httpがRecordHeaderErrorをただのエラーに置き換えている
+		return fails.Msg(fails.MsgTLSNotTLS), true
+	case errors.As(err, &unknownAuthorityErr), errors.As(err, &hostnameErr), errors.As(err, &certificateInvalidErr):
+		return fails.Msg(fails.MsgTLSCertificate), true
+	case strings.Contains(err.Error(), "tls: "):
+		return fails.Msg(fails.MsgTLSHandshakeFailed), true
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return fails.Msg(fails.MsgConnectionRefused), true
+	}
+	return fails.Msg(fails.MsgRequestFailed), false
+}
+
+// 接続が切れた、タイムアウトしたなど、やり直せば成功するかもしれない失敗か
+// Client.Doのエラーは*url.Errorに包まれていて、それ自体がnet.Errorなので中身を見る
+func isRetryableError(err error) bool {
+	if ue, ok := err.(*url.Error); ok {
+		err = ue.Err
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// bench/httpのTLSハンドシェイクのタイムアウトのエラーは外から型で区別できないので、メッセージで見る
+func isTLSHandshakeTimeout(err error) bool {
+	return strings.Contains(err.Error(), "TLS handshake timeout")
+}
+
+// io.LimitReaderと同じだが、nバイトを超える続きがあったかどうかを覚えておく
+type limitedReader struct {
+	r        io.Reader
+	n        int64
+	exceeded bool
+}
+
+func (lr *limitedReader) Read(p []byte) (int, error) {
+	if lr.n <= 0 {
+		// 上限まで読んだので、まだ続きがあるかだけ確かめる
+		var b [1]byte
+		if n, _ := lr.r.Read(b[:]); n > 0 {
+			lr.exceeded = true
+		}
+		return 0, io.EOF
+	}
+	if int64(len(p)) > lr.n {
+		p = p[:lr.n]
+	}
+	n, err := lr.r.Read(p)
+	lr.n -= int64(n)
+	return n, err
 }
 
 func Get(s *session.Session, path string, c Checker) bool {
-	ok := request(s, "GET", path, nil, nil, c)
+	ok, _ := GetTimed(s, path, c)
+	return ok
+}
+
+// Getと同じだが、リクエストにかかった時間も返す
+func GetTimed(s *session.Session, path string, c Checker) (bool, time.Duration) {
+	ok, d := request(s, "GET", path, nil, nil, c)
 	if ok {
 		score.Increment(GetScore)
 	}
-	return ok
+	return ok, d
+}
+
+// ネットワークエラーやタイムアウトで失敗したときにattempts回まで再試行するGET
+// ステータスコードやcheckの失敗、リダイレクトの拒否のように何度やっても同じになる失敗では再試行しない。failsに記録されるのは最後の失敗だけ
+func GetWithRetry(s *session.Session, path string, attempts int, c Checker) bool {
+	l := &fails.Logger{Prefix: "[GET " + path + "] "}
+
+	for i := 1; ; i++ {
+		req, ok := newRequest(s, "GET", path, nil, nil, l)
+		if !ok {
+			return false
+		}
+
+		start := time.Now()
+		res, err := s.Client.Do(req)
+		if err != nil && i < attempts && isRetryableError(err) {
+			time.Sleep(time.Duration(i) * RetryWait)
+			continue
+		}
+
+		ok, _ = checkResponse(s, req, res, err, l, c, start)
+		if ok {
+			score.Increment(GetScore)
+		}
+		return ok
+	}
 }
 
 func Post(s *session.Session, path string, body []byte, headers map[string]string, c Checker) bool {
-	ok := request(s, "POST", path, bytes.NewBuffer(body), headers, c)
+	ok, _ := PostTimed(s, path, body, headers, c)
+	return ok
+}
+
+// Postと同じだが、リクエストにかかった時間も返す
+func PostTimed(s *session.Session, path string, body []byte, headers map[string]string, c Checker) (bool, time.Duration) {
+	ok, d := request(s, "POST", path, bytes.NewBuffer(body), headers, c)
+	if ok {
+		score.Increment(PostScore)
+	}
+	return ok, d
+}
+
+// bodyをメモリに読み込まずに、読みながらそのままPOSTする。大きなデータを送るときに使う
+// lengthはContent-Lengthになる。長さがわからなければ負の値を渡すとchunkedで送る
+func PostReader(s *session.Session, path string, body io.Reader, length int64, headers map[string]string, c Checker) bool {
+	l := &fails.Logger{Prefix: "[POST " + path + "] "}
+
+	req, ok := newRequest(s, "POST", path, body, headers, l)
+	if !ok {
+		return false
+	}
+	if length < 0 {
+		length = -1
+	}
+	req.ContentLength = length
+
+	ok, _ = do(s, req, l, c)
+	if ok {
+		score.Increment(PostScore)
+	}
+	return ok
+}
+
+// vをJSONにしてPOSTする。Content-Typeはapplication/jsonになる
+func PostJSON(s *session.Session, path string, v interface{}, headers map[string]string, c Checker) bool {
+	body, err := json.Marshal(v)
+	if err != nil {
+		l := &fails.Logger{Prefix: "[POST " + path + "] "}
+		l.Add(fails.Msg(fails.MsgRequestJSONEncode), err)
+		return false
+	}
+	return Post(s, path, body, headers, c)
+}
+
+// fieldsとfilesをmultipart/form-dataにしてPOSTする。filesのキーはフォームの名前で、ファイル名にもそのまま使う
+// bodyは一度メモリに組み立ててから送る
+func PostMultipart(s *session.Session, path string, fields map[string]string, files map[string]io.Reader, headers map[string]string, c Checker) bool {
+	l := &fails.Logger{Prefix: "[POST " + path + "] "}
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	err := writeMultipart(mw, fields, files)
+	if err != nil {
+		l.Add(fails.Msg(fails.MsgRequestMultipartEncode), err)
+		return false
+	}
+
+	h := make(map[string]string, len(headers)+1)
+	for k, v := range headers {
+		h[k] = v
+	}
+	h["Content-Type"] = mw.FormDataContentType()
+	return Post(s, path, body.Bytes(), h, c)
+}
+
+// 送る順番が毎回変わらないように、名前順に書く
+func writeMultipart(mw *multipart.Writer, fields map[string]string, files map[string]io.Reader) error {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		err := mw.WriteField(name, fields[name])
+		if err != nil {
+			return err
+		}
+	}
+
+	names = names[:0]
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fw, err := mw.CreateFormFile(name, name)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(fw, files[name])
+		if err != nil {
+			return err
+		}
+	}
+
+	return mw.Close()
+}
+
+// pathをGETし、200でJSONが返ってくることを確認してからvにデコードする
+// 失敗したときはfailsに記録した上で、その理由をエラーで返す
+func GetJSON(s *session.Session, path string, v interface{}) error {
+	c := &jsonChecker{v: v}
+	if !Get(s, path, c) {
+		return c.error()
+	}
+	return nil
+}
+
+// inをJSONにしてPOSTし、200でJSONが返ってくることを確認してからoutにデコードする
+// 失敗したときはfailsに記録した上で、その理由をエラーで返す
+func PostJSONDecode(s *session.Session, path string, in, out interface{}) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		l := &fails.Logger{Prefix: "[POST " + path + "] "}
+		l.Add(fails.Msg(fails.MsgRequestJSONEncode), err)
+		return err
+	}
+	c := &jsonChecker{v: out}
+	if !Post(s, path, body, nil, c) {
+		return c.error()
+	}
+	return nil
+}
+
+// GetJSONとPostJSONDecodeで使う。どこで失敗したかをerrに覚えておく
+type jsonChecker struct {
+	v   interface{}
+	err error
+}
+
+func (c *jsonChecker) CheckStatus(status int, l *fails.Logger) bool {
+	if !OK(nil).CheckStatus(status, l) {
+		c.err = errors.New(fails.Msg(fails.MsgUnexpectedStatus, http.StatusOK, status))
+		return false
+	}
+	return true
+}
+
+func (c *jsonChecker) CheckHeader(header http.Header, l *fails.Logger) bool {
+	if !CheckContentType("application/json")(header, l) {
+		c.err = errors.New(fails.Msg(fails.MsgUnexpectedContentType, "application/json", header.Get("Content-Type")))
+		return false
+	}
+	return true
+}
+
+func (c *jsonChecker) Check(body io.Reader, l *fails.Logger) bool {
+	if err := json.NewDecoder(body).Decode(c.v); err != nil {
+		l.Add(fails.Msg(fails.MsgResponseJSONDecode), err)
+		c.err = err
+		return false
+	}
+	return true
+}
+
+// checkより前で失敗したときは、理由はfailsにだけ記録されている
+func (c *jsonChecker) error() error {
+	if c.err != nil {
+		return c.err
+	}
+	return errors.New(fails.Msg(fails.MsgRequestFailed))
+}
+
+func Put(s *session.Session, path string, body []byte, headers map[string]string, c Checker) bool {
+	ok, _ := request(s, "PUT", path, bytes.NewBuffer(body), headers, c)
+	if ok {
+		score.Increment(PostScore)
+	}
+	return ok
+}
+
+func Delete(s *session.Session, path string, headers map[string]string, c Checker) bool {
+	ok, _ := request(s, "DELETE", path, nil, headers, c)
 	if ok {
 		score.Increment(PostScore)
 	}
 	return ok
 }
 
+// CheckerのCheckにはbodyとしてnilが渡される
+func Head(s *session.Session, path string, c Checker) bool {
+	ok, _ := request(s, "HEAD", path, nil, nil, c)
+	if ok {
+		score.Increment(GetScore)
+	}
+	return ok
+}
+
 func SSE(s *session.Session, path string) (*sse.EventSource, bool) {
 	u, err := url.Parse(path)
 	if err != nil {
-		fails.Critical("予期せぬエラー（主催者に連絡してください）",
+		fails.Critical(fails.Msg(fails.MsgUnexpectedError),
 			errors.New("URLのパースに失敗しました: "+path+", error: "+err.Error()))
 		return nil, false
 	}
@@ -0,0 +1,752 @@
+package action
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/isucon/isucon6-final/bench/fails"
+	"github.com/isucon/isucon6-final/bench/http"
+	"github.com/isucon/isucon6-final/bench/http/httptest"
+	"github.com/isucon/isucon6-final/bench/session"
+)
+
+func TestPostSendsBody(t *testing.T) {
+	var (
+		body          []byte
+		contentType   string
+		contentLength int64
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ = ioutil.ReadAll(r.Body)
+		contentType = r.Header.Get("Content-Type")
+		contentLength = r.ContentLength
+	}))
+	defer ts.Close()
+
+	s := session.New(ts.URL)
+	defer s.Bye()
+
+	posted := []byte(`{"room_id":1}`)
+	ok := Post(s, "/", posted, nil, OK(func(body io.Reader, l *fails.Logger) bool {
+		return true
+	}))
+	if !ok {
+		t.Fatalf("Post failed")
+	}
+	if string(body) != string(posted) {
+		t.Errorf("want %s, got %s", posted, body)
+	}
+	if contentLength != int64(len(posted)) {
+		t.Errorf("want %d, got %d", len(posted), contentLength)
+	}
+	if contentType != "application/json" {
+		t.Errorf("want %s, got %s", "application/json", contentType)
+	}
+
+	ok = Post(s, "/", posted, map[string]string{"Content-Type": "text/plain"}, OK(func(body io.Reader, l *fails.Logger) bool {
+		return true
+	}))
+	if !ok {
+		t.Fatalf("Post failed")
+	}
+	if contentType != "text/plain" {
+		t.Errorf("want %s, got %s", "text/plain", contentType)
+	}
+}
+
+func TestCheckHeader(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Custom", "isucon")
+	}))
+	defer ts.Close()
+
+	s := session.New(ts.URL)
+	defer s.Bye()
+
+	got := ""
+	ok := Get(s, "/", OK(func(body io.Reader, l *fails.Logger) bool {
+		return true
+	}).WithHeader(func(header http.Header, l *fails.Logger) bool {
+		got = header.Get("X-Custom")
+		return true
+	}))
+	if !ok {
+		t.Fatalf("Get failed")
+	}
+	if got != "isucon" {
+		t.Errorf("want %s, got %s", "isucon", got)
+	}
+
+	bodyChecked := false
+	ok = Get(s, "/", OK(func(body io.Reader, l *fails.Logger) bool {
+		bodyChecked = true
+		return true
+	}).WithHeader(func(header http.Header, l *fails.Logger) bool {
+		return false
+	}))
+	if ok || bodyChecked {
+		t.Errorf("the body should not be checked when the header check fails")
+	}
+}
+
+func TestMethods(t *testing.T) {
+	var (
+		method string
+		body   []byte
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method = r.Method
+		body, _ = ioutil.ReadAll(r.Body)
+		w.Write([]byte("ok"))
+	}))
+	defer ts.Close()
+
+	s := session.New(ts.URL)
+	defer s.Bye()
+
+	var got []byte
+	checker := OK(func(body io.Reader, l *fails.Logger) bool {
+		got = nil
+		if body != nil {
+			got, _ = ioutil.ReadAll(body)
+		}
+		return true
+	})
+
+	if !Put(s, "/", []byte("put"), nil, checker) {
+		t.Errorf("Put failed")
+	}
+	if method != "PUT" || string(body) != "put" || string(got) != "ok" {
+		t.Errorf("PUT: got method %s, body %s, response %s", method, body, got)
+	}
+
+	if !Delete(s, "/", nil, checker) {
+		t.Errorf("Delete failed")
+	}
+	if method != "DELETE" || string(got) != "ok" {
+		t.Errorf("DELETE: got method %s, response %s", method, got)
+	}
+
+	if !Head(s, "/", checker) {
+		t.Errorf("Head failed")
+	}
+	if method != "HEAD" || got != nil {
+		t.Errorf("HEAD: got method %s, response %s", method, got)
+	}
+}
+
+func TestDo(t *testing.T) {
+	var referer, userAgent string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		referer = r.Header.Get("Referer")
+		userAgent = r.Header.Get("User-Agent")
+	}))
+	defer ts.Close()
+
+	s := session.New(ts.URL)
+	defer s.Bye()
+
+	req, err := http.NewRequest("GET", "/rooms/1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Referer", "/")
+
+	ok := Do(s, req, OK(func(body io.Reader, l *fails.Logger) bool {
+		return true
+	}))
+	if !ok {
+		t.Fatalf("Do failed")
+	}
+	if referer != "/" {
+		t.Errorf("want %s, got %s", "/", referer)
+	}
+	if userAgent != s.UserAgent {
+		t.Errorf("want %s, got %s", s.UserAgent, userAgent)
+	}
+}
+
+func TestGetTimed(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("header"))
+		w.(http.Flusher).Flush()
+		time.Sleep(200 * time.Millisecond)
+		w.Write([]byte("body"))
+	}))
+	defer ts.Close()
+
+	s := session.New(ts.URL)
+	defer s.Bye()
+
+	// bodyを読まないcheckでも、bodyを読み終わるまでの時間になる
+	ok, d := GetTimed(s, "/", OK(func(body io.Reader, l *fails.Logger) bool {
+		return true
+	}))
+	if !ok {
+		t.Fatalf("GetTimed failed")
+	}
+	if d < 200*time.Millisecond {
+		t.Errorf("want at least %s, got %s", 200*time.Millisecond, d)
+	}
+}
+
+func TestGetTimeout(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(500 * time.Millisecond)
+	}))
+	defer ts.Close()
+
+	s := session.NewWithTimeout(ts.URL, 100*time.Millisecond)
+	defer s.Bye()
+
+	n := len(fails.Get())
+	ok := Get(s, "/", OK(func(body io.Reader, l *fails.Logger) bool {
+		return true
+	}))
+	if ok {
+		t.Fatalf("Get should time out")
+	}
+	msgs := fails.Get()
+	if len(msgs) != n+1 {
+		t.Fatalf("want %d messages, got %d", n+1, len(msgs))
+	}
+	if msg := msgs[n]; !strings.Contains(msg, "タイムアウト") {
+		t.Errorf("want a timeout message, got %q", msg)
+	}
+
+	s.SetTimeout(time.Second)
+	ok = Get(s, "/", OK(func(body io.Reader, l *fails.Logger) bool {
+		return true
+	}))
+	if !ok {
+		t.Errorf("Get failed after SetTimeout")
+	}
+}
+
+func TestGetTimeoutEnglish(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(500 * time.Millisecond)
+	}))
+	defer ts.Close()
+
+	err := fails.SetLocale(fails.LocaleEn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fails.SetLocale(fails.LocaleJa)
+
+	s := session.NewWithTimeout(ts.URL, 100*time.Millisecond)
+	defer s.Bye()
+
+	n := len(fails.Get())
+	ok := Get(s, "/", OK(func(body io.Reader, l *fails.Logger) bool {
+		return true
+	}))
+	if ok {
+		t.Fatalf("Get should time out")
+	}
+	msgs := fails.Get()
+	if len(msgs) != n+1 {
+		t.Fatalf("want %d messages, got %d", n+1, len(msgs))
+	}
+	if want := "[GET /] Request timed out"; msgs[n] != want {
+		t.Errorf("want %q, got %q", want, msgs[n])
+	}
+}
+
+func TestPostJSON(t *testing.T) {
+	type room struct {
+		Name        string `json:"name"`
+		CanvasWidth int    `json:"canvas_width"`
+	}
+
+	var (
+		got         room
+		contentType string
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contentType = r.Header.Get("Content-Type")
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer ts.Close()
+
+	s := session.New(ts.URL)
+	defer s.Bye()
+
+	want := room{Name: "椅子", CanvasWidth: 1024}
+	ok := PostJSON(s, "/", want, nil, OK(func(body io.Reader, l *fails.Logger) bool {
+		return true
+	}))
+	if !ok {
+		t.Fatalf("PostJSON failed")
+	}
+	if got != want {
+		t.Errorf("want %v, got %v", want, got)
+	}
+	if contentType != "application/json" {
+		t.Errorf("want %q, got %q", "application/json", contentType)
+	}
+
+	n := len(fails.Get())
+	ok = PostJSON(s, "/", make(chan int), nil, OK(func(body io.Reader, l *fails.Logger) bool {
+		return true
+	}))
+	if ok {
+		t.Errorf("PostJSON should fail for a value that cannot be marshaled")
+	}
+	if len(fails.Get()) != n+1 {
+		t.Errorf("want %d messages, got %d", n+1, len(fails.Get()))
+	}
+}
+
+func TestOnResponse(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "abc"})
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("created"))
+	}))
+	defer ts.Close()
+
+	s := session.New(ts.URL)
+	defer s.Bye()
+
+	var (
+		status string
+		cookie string
+	)
+	s.OnResponse = func(res *http.Response) {
+		status = res.Status
+		cookie = res.Header.Get("Set-Cookie")
+	}
+
+	var body []byte
+	ok := Get(s, "/", StatusChecker{
+		ExpectedStatus: http.StatusCreated,
+		CheckFunc: func(r io.Reader, l *fails.Logger) bool {
+			body, _ = ioutil.ReadAll(r)
+			return true
+		},
+	})
+	if !ok {
+		t.Fatalf("Get failed")
+	}
+	if status != "201 Created" {
+		t.Errorf("want %q, got %q", "201 Created", status)
+	}
+	if !strings.HasPrefix(cookie, "session=abc") {
+		t.Errorf("want %q, got %q", "session=abc", cookie)
+	}
+	// hookの後でもbodyはcheckで読める
+	if string(body) != "created" {
+		t.Errorf("want %q, got %q", "created", body)
+	}
+}
+
+func TestGetWithRetry(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		count int
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		count++
+		n := count
+		mu.Unlock()
+		if n == 1 {
+			// 1回目は何も返さずに接続を切る
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer ts.Close()
+
+	s := session.New(ts.URL)
+	defer s.Bye()
+
+	n := len(fails.Get())
+	ok := GetWithRetry(s, "/", 3, OK(func(body io.Reader, l *fails.Logger) bool {
+		return true
+	}))
+	if !ok {
+		t.Fatalf("GetWithRetry failed")
+	}
+	mu.Lock()
+	if count != 2 {
+		t.Errorf("want %d requests, got %d", 2, count)
+	}
+	mu.Unlock()
+	if len(fails.Get()) != n {
+		t.Errorf("want no messages, got %v", fails.Get()[n:])
+	}
+
+	// checkの失敗では再試行しない
+	mu.Lock()
+	count = 1
+	mu.Unlock()
+	ok = GetWithRetry(s, "/", 3, OK(func(body io.Reader, l *fails.Logger) bool {
+		l.Add("bad body", nil)
+		return false
+	}))
+	if ok {
+		t.Errorf("GetWithRetry should fail")
+	}
+	mu.Lock()
+	if count != 2 {
+		t.Errorf("want %d requests, got %d", 2, count)
+	}
+	mu.Unlock()
+	if len(fails.Get()) != n+1 {
+		t.Errorf("want %d messages, got %d", n+1, len(fails.Get()))
+	}
+
+	// リダイレクトの拒否は何度やっても同じなので再試行しない
+	redirects := 0
+	rs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		redirects++
+		mu.Unlock()
+		http.Redirect(w, r, "/other", http.StatusFound)
+	}))
+	defer rs.Close()
+	s = session.New(rs.URL)
+	defer s.Bye()
+	ok = GetWithRetry(s, "/", 3, OK(func(body io.Reader, l *fails.Logger) bool {
+		return true
+	}))
+	if ok {
+		t.Errorf("GetWithRetry should fail")
+	}
+	mu.Lock()
+	if redirects != 1 {
+		t.Errorf("want %d requests, got %d", 1, redirects)
+	}
+	mu.Unlock()
+}
+
+func TestStatusFailureMessage(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("database is down"))
+	}))
+	defer ts.Close()
+
+	s := session.New(ts.URL)
+	defer s.Bye()
+
+	stderr := os.Stderr
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Stderr = w
+
+	n := len(fails.Get())
+	ok := Get(s, "/", Status(http.StatusOK, func(body io.Reader, l *fails.Logger) bool {
+		return true
+	}))
+
+	os.Stderr = stderr
+	w.Close()
+	out, _ := ioutil.ReadAll(r)
+
+	if ok {
+		t.Fatalf("Get should fail")
+	}
+	msgs := fails.Get()
+	if len(msgs) != n+1 {
+		t.Fatalf("want %d messages, got %d", n+1, len(msgs))
+	}
+	if !strings.Contains(msgs[n], "200") || !strings.Contains(msgs[n], "500") {
+		t.Errorf("want the status codes in %q", msgs[n])
+	}
+	// bodyは標準エラー出力にだけ出る
+	if strings.Contains(msgs[n], "database is down") {
+		t.Errorf("want no body in %q", msgs[n])
+	}
+	if !strings.Contains(string(out), "body: database is down") {
+		t.Errorf("want the body in %q", out)
+	}
+}
+
+func TestMaxBodySize(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.Repeat("a", 2048)))
+	}))
+	defer ts.Close()
+
+	s := session.New(ts.URL)
+	defer s.Bye()
+
+	if s.MaxBodySize != session.DefaultMaxBodySize {
+		t.Errorf("want %d, got %d", session.DefaultMaxBodySize, s.MaxBodySize)
+	}
+
+	var read int
+	readAll := OK(func(body io.Reader, l *fails.Logger) bool {
+		b, err := ioutil.ReadAll(body)
+		read = len(b)
+		return err == nil
+	})
+	ignoreBody := OK(func(body io.Reader, l *fails.Logger) bool {
+		return true
+	})
+
+	s.MaxBodySize = 2048
+	if !Get(s, "/", readAll) {
+		t.Errorf("want true for a body of exactly MaxBodySize, got false")
+	}
+
+	s.MaxBodySize = 1024
+	n := len(fails.Get())
+	if Get(s, "/", readAll) {
+		t.Errorf("want false for an oversized body, got true")
+	}
+	if read != 1024 {
+		t.Errorf("want %d, got %d", 1024, read)
+	}
+	msgs := fails.Get()
+	if len(msgs) != n+1 || !strings.Contains(msgs[len(msgs)-1], "大きすぎます") {
+		t.Errorf("want a message about the body size, got %q", msgs[n:])
+	}
+
+	// checkがbodyを読まなくても上限を超えていれば失敗にする
+	if Get(s, "/", ignoreBody) {
+		t.Errorf("want false for an oversized body, got true")
+	}
+
+	s.MaxBodySize = 0
+	if !Get(s, "/", readAll) || read != 2048 {
+		t.Errorf("want the whole body without a limit, got %d bytes", read)
+	}
+}
+
+func TestGetJSONAndPostJSONDecode(t *testing.T) {
+	type room struct {
+		ID      int64  `json:"id"`
+		Name    string `json:"name"`
+		Strokes []struct {
+			ID int64 `json:"id"`
+		} `json:"strokes"`
+	}
+	type response struct {
+		Room *room `json:"room"`
+	}
+
+	var posted map[string]string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/rooms/1", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json;charset=utf-8")
+		w.Write([]byte(`{"room":{"id":1,"name":"ひたすら椅子を描く部屋","strokes":[{"id":10},{"id":11}]}}`))
+	})
+	mux.HandleFunc("/api/rooms", func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&posted)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"room":{"id":2,"name":"` + posted["name"] + `"}}`))
+	})
+	mux.HandleFunc("/html", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(`{}`))
+	})
+	mux.HandleFunc("/broken", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"room":`))
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	s := session.New(ts.URL)
+	defer s.Bye()
+
+	var res response
+	if err := GetJSON(s, "/api/rooms/1", &res); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if res.Room == nil || res.Room.ID != 1 || res.Room.Name != "ひたすら椅子を描く部屋" || len(res.Room.Strokes) != 2 || res.Room.Strokes[1].ID != 11 {
+		t.Errorf("unexpected room: %+v", res.Room)
+	}
+
+	res = response{}
+	if err := PostJSONDecode(s, "/api/rooms", map[string]string{"name": "room"}, &res); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if posted["name"] != "room" {
+		t.Errorf("want %q, got %q", "room", posted["name"])
+	}
+	if res.Room == nil || res.Room.ID != 2 || res.Room.Name != "room" {
+		t.Errorf("unexpected room: %+v", res.Room)
+	}
+
+	n := len(fails.Get())
+	for path, want := range map[string]string{
+		"/notfound": "404",
+		"/html":     "text/html",
+		"/broken":   "EOF",
+	} {
+		err := GetJSON(s, path, &res)
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: want an error containing %q, got %v", path, want, err)
+		}
+	}
+	if len(fails.Get()) != n+3 {
+		t.Errorf("want %d messages, got %d", n+3, len(fails.Get()))
+	}
+}
+
+func TestPostReader(t *testing.T) {
+	var (
+		received         int64
+		contentLength    int64
+		transferEncoding []string
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received, _ = io.Copy(ioutil.Discard, r.Body)
+		contentLength = r.ContentLength
+		transferEncoding = r.TransferEncoding
+	}))
+	defer ts.Close()
+
+	s := session.New(ts.URL)
+	defer s.Bye()
+
+	const size = 1024 * 1024
+	upload := func(length int64) bool {
+		pr, pw := io.Pipe()
+		go func() {
+			chunk := bytes.Repeat([]byte("a"), 4096)
+			for i := 0; i < size/len(chunk); i++ {
+				pw.Write(chunk)
+			}
+			pw.Close()
+		}()
+		return PostReader(s, "/", pr, length, nil, OK(func(body io.Reader, l *fails.Logger) bool {
+			return true
+		}))
+	}
+
+	if !upload(size) {
+		t.Fatalf("PostReader failed")
+	}
+	if received != size || contentLength != size {
+		t.Errorf("want %d, got %d (Content-Length: %d)", size, received, contentLength)
+	}
+
+	// 長さがわからなければchunkedで送る
+	if !upload(-1) {
+		t.Fatalf("PostReader failed")
+	}
+	if received != size {
+		t.Errorf("want %d, got %d", size, received)
+	}
+	if len(transferEncoding) != 1 || transferEncoding[0] != "chunked" {
+		t.Errorf("want chunked, got %q", transferEncoding)
+	}
+}
+
+func TestConnectionErrorMessages(t *testing.T) {
+	lastMessage := func(s *session.Session) string {
+		n := len(fails.Get())
+		ok := Get(s, "/", OK(func(body io.Reader, l *fails.Logger) bool {
+			return true
+		}))
+		if ok {
+			t.Fatalf("Get should fail")
+		}
+		msgs := fails.Get()
+		if len(msgs) != n+1 {
+			t.Fatalf("want %d messages, got %d", n+1, len(msgs))
+		}
+		// 接続の失敗はcriticalになる
+		criticals := fails.GetByLevel()[fails.LevelCritical]
+		if len(criticals) == 0 || criticals[len(criticals)-1] != msgs[n] {
+			t.Errorf("want %q to be critical", msgs[n])
+		}
+		return msgs[n]
+	}
+
+	// 証明書を検証する設定で自己署名の証明書のサーバーに繋ぐ
+	tlsServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer tlsServer.Close()
+	s := session.New(tlsServer.URL)
+	defer s.Bye()
+	s.Transport.TLSClientConfig.InsecureSkipVerify = false
+	if msg, want := lastMessage(s), fails.Msg(fails.MsgTLSCertificate); !strings.Contains(msg, want) {
+		t.Errorf("want %q, got %q", want, msg)
+	}
+
+	// HTTPSのつもりで平文のHTTPのサーバーに繋ぐ
+	plainServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer plainServer.Close()
+	s = session.New(strings.Replace(plainServer.URL, "http://", "https://", 1))
+	defer s.Bye()
+	if msg, want := lastMessage(s), fails.Msg(fails.MsgTLSNotTLS); !strings.Contains(msg, want) {
+		t.Errorf("want %q, got %q", want, msg)
+	}
+
+	// 誰もlistenしていないポートに繋ぐ
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	s = session.New("http://" + addr)
+	defer s.Bye()
+	if msg, want := lastMessage(s), fails.Msg(fails.MsgConnectionRefused); !strings.Contains(msg, want) {
+		t.Errorf("want %q, got %q", want, msg)
+	}
+}
+
+func TestPostMultipart(t *testing.T) {
+	var (
+		title, filename string
+		file            []byte
+		parseErr        error
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		parseErr = r.ParseMultipartForm(1024 * 1024)
+		if parseErr != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		title = r.FormValue("title")
+		f, h, err := r.FormFile("svg")
+		if err != nil {
+			parseErr = err
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		defer f.Close()
+		filename = h.Filename
+		file, _ = ioutil.ReadAll(f)
+	}))
+	defer ts.Close()
+
+	s := session.New(ts.URL)
+	defer s.Bye()
+
+	svg := `<svg xmlns="http://www.w3.org/2000/svg"></svg>`
+	ok := PostMultipart(s, "/import", map[string]string{"title": "isu"}, map[string]io.Reader{"svg": strings.NewReader(svg)}, nil, OK(func(body io.Reader, l *fails.Logger) bool {
+		return true
+	}))
+	if !ok {
+		t.Fatalf("PostMultipart failed: %v", parseErr)
+	}
+	if title != "isu" {
+		t.Errorf("want %q, got %q", "isu", title)
+	}
+	if filename != "svg" || string(file) != svg {
+		t.Errorf("want %q, got %q (filename: %q)", svg, file, filename)
+	}
+}
@@ -0,0 +1,86 @@
+package action
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"mime"
+
+	"github.com/isucon/isucon6-final/bench/fails"
+	"github.com/isucon/isucon6-final/bench/http"
+)
+
+// よくあるチェックを組み合わせて使うためのもの
+// 例: action.OK(action.CheckAll(action.CheckBodyContains("<svg"), f)).WithHeader(action.CheckContentType("image/svg+xml"))
+// ステータスコードはStatusやOKで指定する
+
+// bodyにsubstrが含まれていることを確認する
+func CheckBodyContains(substr string) CheckFunc {
+	return func(body io.Reader, l *fails.Logger) bool {
+		if body == nil {
+			l.Add(fails.Msg(fails.MsgNoBody), nil)
+			return false
+		}
+		b, err := ioutil.ReadAll(body)
+		if err != nil {
+			l.Add(fails.Msg(fails.MsgBodyUnreadable), err)
+			return false
+		}
+		if !bytes.Contains(b, []byte(substr)) {
+			l.Add(fails.Msg(fails.MsgBodyMissingString, substr), nil)
+			return false
+		}
+		return true
+	}
+}
+
+// Content-Typeがctであることを確認する。charsetなどのパラメータは無視する
+func CheckContentType(ct string) HeaderCheckFunc {
+	return func(header http.Header, l *fails.Logger) bool {
+		v := header.Get("Content-Type")
+		mediaType, _, err := mime.ParseMediaType(v)
+		if err != nil || mediaType != ct {
+			l.Add(fails.Msg(fails.MsgUnexpectedContentType, ct, v), nil)
+			return false
+		}
+		return true
+	}
+}
+
+// fsを順番に呼び、最初に失敗したところでやめる
+// bodyは一度読み込んでから、それぞれに先頭から渡す
+func CheckAll(fs ...CheckFunc) CheckFunc {
+	return func(body io.Reader, l *fails.Logger) bool {
+		var b []byte
+		if body != nil {
+			var err error
+			b, err = ioutil.ReadAll(body)
+			if err != nil {
+				l.Add(fails.Msg(fails.MsgBodyUnreadable), err)
+				return false
+			}
+		}
+		for _, f := range fs {
+			var r io.Reader
+			if body != nil {
+				r = bytes.NewReader(b)
+			}
+			if !f(r, l) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// fsを順番に呼び、最初に失敗したところでやめる
+func CheckAllHeaders(fs ...HeaderCheckFunc) HeaderCheckFunc {
+	return func(header http.Header, l *fails.Logger) bool {
+		for _, f := range fs {
+			if !f(header, l) {
+				return false
+			}
+		}
+		return true
+	}
+}
@@ -0,0 +1,122 @@
+package action
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/isucon/isucon6-final/bench/fails"
+	"github.com/isucon/isucon6-final/bench/http"
+	"github.com/isucon/isucon6-final/bench/http/httptest"
+	"github.com/isucon/isucon6-final/bench/session"
+)
+
+func TestCheckBodyContains(t *testing.T) {
+	l := &fails.Logger{}
+	f := CheckBodyContains("<svg")
+
+	if !f(strings.NewReader(`<?xml version="1.0"?><svg></svg>`), l) {
+		t.Errorf("want true, got false")
+	}
+	if f(strings.NewReader(`<html></html>`), l) {
+		t.Errorf("want false, got true")
+	}
+	if f(nil, l) {
+		t.Errorf("want false for no body, got true")
+	}
+}
+
+func TestCheckContentType(t *testing.T) {
+	l := &fails.Logger{}
+	f := CheckContentType("image/svg+xml")
+
+	for _, c := range []struct {
+		contentType string
+		want        bool
+	}{
+		{"image/svg+xml", true},
+		{"image/svg+xml; charset=utf-8", true},
+		{"text/html", false},
+		{"", false},
+	} {
+		h := http.Header{}
+		if c.contentType != "" {
+			h.Set("Content-Type", c.contentType)
+		}
+		if got := f(h, l); got != c.want {
+			t.Errorf("%q: want %v, got %v", c.contentType, c.want, got)
+		}
+	}
+}
+
+func TestCheckAll(t *testing.T) {
+	l := &fails.Logger{}
+
+	called := []string{}
+	record := func(name string, ok bool) CheckFunc {
+		return func(body io.Reader, l *fails.Logger) bool {
+			called = append(called, name)
+			return ok
+		}
+	}
+
+	// 全てのチェックにbodyが先頭から渡される
+	f := CheckAll(CheckBodyContains("foo"), CheckBodyContains("bar"), record("a", true))
+	if !f(strings.NewReader("foobar"), l) {
+		t.Errorf("want true, got false")
+	}
+
+	// 最初に失敗したところでやめる
+	called = []string{}
+	f = CheckAll(record("a", true), record("b", false), record("c", true))
+	if f(strings.NewReader(""), l) {
+		t.Errorf("want false, got true")
+	}
+	if want := "a,b"; strings.Join(called, ",") != want {
+		t.Errorf("want %q, got %q", want, strings.Join(called, ","))
+	}
+
+	if !CheckAll()(strings.NewReader(""), l) {
+		t.Errorf("want true for no checks, got false")
+	}
+}
+
+func TestCheckAllHeaders(t *testing.T) {
+	l := &fails.Logger{}
+	h := http.Header{}
+	h.Set("Content-Type", "image/svg+xml")
+
+	if !CheckAllHeaders(CheckContentType("image/svg+xml"))(h, l) {
+		t.Errorf("want true, got false")
+	}
+	if CheckAllHeaders(CheckContentType("text/html"), CheckContentType("image/svg+xml"))(h, l) {
+		t.Errorf("want false, got true")
+	}
+}
+
+func TestCheckComposition(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/svg+xml")
+		fmt.Fprint(w, `<svg><polyline id="1"></polyline></svg>`)
+	}))
+	defer ts.Close()
+
+	s := session.New(ts.URL)
+	defer s.Bye()
+
+	c := OK(CheckAll(CheckBodyContains("<svg"), CheckBodyContains(`id="1"`))).WithHeader(CheckContentType("image/svg+xml"))
+	if !Get(s, "/", c) {
+		t.Errorf("want true, got false")
+	}
+
+	c = OK(CheckBodyContains("<svg")).WithHeader(CheckContentType("text/html"))
+	if Get(s, "/", c) {
+		t.Errorf("want false, got true")
+	}
+
+	c = Status(http.StatusNotFound, CheckBodyContains("<svg"))
+	if Get(s, "/", c) {
+		t.Errorf("want false, got true")
+	}
+}
@@ -13,6 +13,7 @@ import (
 	"time"
 
 	"github.com/isucon/isucon6-final/bench/fails"
+	"github.com/isucon/isucon6-final/bench/logger"
 	"github.com/isucon/isucon6-final/bench/scenario"
 	"github.com/isucon/isucon6-final/bench/score"
 	"github.com/isucon/isucon6-final/portal/job"
@@ -23,6 +24,11 @@ var InitialCheckOnly bool
 var MatsuriNum = 10
 var LoadIndexPageNum = 10
 var DrawOnRandomRoomNum = 2
+var HumanLog bool
+var ForceHTTP1 bool
+var Locale string
+
+var benchLog = logger.New("bench")
 
 func init() {
 	rand.Seed(time.Now().UnixNano())
@@ -35,9 +41,22 @@ func main() {
 	flag.StringVar(&urls, "urls", "", "ベンチマーク対象のURL（scheme, host, portまで。カンマ区切りで複数可。例： https://xxx.xxx.xxx.xxx,https://xxx.xxx.xxx.xxx:1443）")
 	flag.IntVar(&BenchmarkTimeout, "timeout", 60, "ソフトタイムアウト")
 	flag.BoolVar(&InitialCheckOnly, "initialcheck", false, "初期チェックだけ行う")
+	flag.BoolVar(&HumanLog, "human", false, "標準エラー出力のログをJSONではなく人間向けのテキストにする")
+	flag.StringVar(&Locale, "locale", fails.LocaleJa, "失敗メッセージの言語（ja または en）")
+
+	flag.BoolVar(&ForceHTTP1, "http1", false, "HTTP/2に対応したサーバーにもHTTP/1.1でリクエストする（比較用）")
 
 	flag.Parse()
 
+	logger.SetJSON(!HumanLog)
+	// 同じ失敗は "msg (x回数)" にまとめて送り、ポータルで多いものから表示できるようにする
+	fails.SetDedup(true)
+	scenario.ForceHTTP1 = ForceHTTP1
+	if err := fails.SetLocale(Locale); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
 	origins, err := makeOrigins(urls)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, err.Error())
@@ -118,7 +137,7 @@ L:
 				if ok {
 					time.Sleep(500 * time.Millisecond)
 				} else {
-					fmt.Fprintln(os.Stderr, "LoadIndexPage failed. waiting for 1s.")
+					benchLog.Warn("LoadIndexPage failed. waiting for 1s.", nil)
 					time.Sleep(1000 * time.Millisecond)
 				}
 				loadIndexPageCh <- struct{}{}
@@ -138,10 +157,24 @@ L:
 }
 
 func output() {
+	var strokes *job.StrokeBreakdown
+	if sb := scenario.GetScoreBreakdown(); sb.Watchers > 0 {
+		strokes = &job.StrokeBreakdown{
+			Posted:   sb.Posted,
+			OnTime:   sb.OnTime,
+			Late:     sb.Late,
+			Wrong:    sb.Wrong,
+			Unknown:  sb.Unknown,
+			Missing:  sb.Missing,
+			Watchers: sb.Watchers,
+		}
+	}
+
 	b, _ := json.Marshal(job.Output{
 		Pass:     !fails.GetIsCritical(),
 		Score:    score.Get(),
 		Messages: fails.GetUnique(),
+		Strokes:  strokes,
 	})
 
 	fmt.Println(string(b))
@@ -70,9 +70,16 @@ func (cli *CLI) Run(args []string) int {
 }
 
 type portal struct {
-	host string
+	host   string
+	secret string
 }
 
+// portalと共有する秘密の値を持つ環境変数と、それを送るヘッダ
+const (
+	benchNodeSecretEnv    = "ISU6F_BENCH_NODE_SECRET"
+	benchNodeSecretHeader = "X-Isu6FPortal-Bench-Secret"
+)
+
 func (ptl *portal) newJobURL() string {
 	return fmt.Sprintf("http://%s/mBGWHqBVEjUSKpBF/job/new", ptl.host)
 }
@@ -98,6 +105,19 @@ func (ptl *portal) waitJob() *job.Job {
 	return nil
 }
 
+// ポータルがジョブを渡せなかった理由
+// benchのfailsには積まない。failsは1回のベンチマークの中で集めてOutputとしてポータルに送るもので、
+// ワーカーは別のプロセスな上に、ここではまだジョブを受け取れていないので結果を送る先がない。
+// 運営がワーカーのログから原因を追えるように、codeをそのまま残す
+type portalError struct {
+	status int
+	res    job.Error
+}
+
+func (e *portalError) Error() string {
+	return fmt.Sprintf("portal error (status=%d, code=%s): %s", e.status, e.res.Code, e.res.Message)
+}
+
 func (ptl *portal) fetchJob() (*job.Job, error) {
 	u := ptl.newJobURL()
 	vals := url.Values{}
@@ -108,6 +128,7 @@ func (ptl *portal) fetchJob() (*job.Job, error) {
 		return nil, err
 	}
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set(benchNodeSecretHeader, ptl.secret)
 
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
@@ -123,6 +144,13 @@ func (ptl *portal) fetchJob() (*job.Job, error) {
 	case http.StatusNoContent:
 		return nil, nil
 	default:
+		// ポータル側の問題はエラーの理由がJSONで返ってくる
+		if strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+			var e job.Error
+			if err := json.NewDecoder(resp.Body).Decode(&e); err == nil && e.Code != "" {
+				return nil, &portalError{status: resp.StatusCode, res: e}
+			}
+		}
 		dump, _ := httputil.DumpResponse(resp, true)
 		return nil, fmt.Errorf("response invalid: %s", string(dump))
 	}
@@ -138,6 +166,7 @@ func (ptl *portal) postResult(res *job.Result) error {
 		return err
 	}
 	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(benchNodeSecretHeader, ptl.secret)
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return err
@@ -147,7 +176,7 @@ func (ptl *portal) postResult(res *job.Result) error {
 }
 
 func (cli *CLI) start(portalHost, benchPath string) int {
-	ptl := &portal{host: portalHost}
+	ptl := &portal{host: portalHost, secret: os.Getenv(benchNodeSecretEnv)}
 	for !sigReceived {
 		j := ptl.waitJob()
 		if sigReceived {
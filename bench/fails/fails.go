@@ -1,27 +1,71 @@
 package fails
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"sort"
 	"sync"
+
+	"github.com/isucon/isucon6-final/bench/logger"
+)
+
+// 失敗の重さ。Addで追加したものはLevelNormalになる
+type Level int
+
+const (
+	LevelMinor Level = iota
+	LevelNormal
+	LevelCritical
 )
 
 var mu sync.RWMutex
 var msgs []string
+var levels []Level // msgsと同じ順番で、それぞれのLevelを持つ
 var isCritical bool
 
+// dedupが有効な間は同じメッセージをmsgsに1回だけ積み、回数をcountsで数える
+var dedup bool
+var counts = map[string]int{}
+
+// 有効にすると同じメッセージは最初の1件にまとめられ、Getで "msg (x回数)" として返る
+func SetDedup(b bool) {
+	mu.Lock()
+	dedup = b
+	mu.Unlock()
+}
+
 func Get() []string {
 	mu.RLock()
-	allMsgs := msgs[:]
+	allMsgs := make([]string, len(msgs))
+	for i, m := range msgs {
+		allMsgs[i] = format(m)
+	}
 	mu.RUnlock()
 	return allMsgs
 }
 
-func GetUnique() []string {
+// Levelごとに分けて返す。それぞれの中は追加された順になる
+func GetByLevel() map[Level][]string {
 	mu.RLock()
-	allMsgs := msgs[:]
+	ret := make(map[Level][]string)
+	for i, m := range msgs {
+		ret[levels[i]] = append(ret[levels[i]], format(m))
+	}
 	mu.RUnlock()
+	return ret
+}
+
+// muをロックしてから呼ぶこと
+func format(m string) string {
+	if c := counts[m]; c > 1 {
+		return fmt.Sprintf("%s (x%d)", m, c)
+	}
+	return m
+}
+
+func GetUnique() []string {
+	allMsgs := Get()
 
 	sort.Strings(allMsgs)
 	var tmp string
@@ -38,31 +82,88 @@ func GetUnique() []string {
 }
 
 func Add(msg string, err error) {
+	add(LevelNormal, msg, err)
+}
+
+// タイムアウト1回など、それだけでは問題にしない失敗に使う
+func AddMinor(msg string, err error) {
+	add(LevelMinor, msg, err)
+}
+
+func add(level Level, msg string, err error) {
 	mu.Lock()
-	msgs = append(msgs, msg)
+	if !dedup || counts[msg] == 0 {
+		msgs = append(msgs, msg)
+		levels = append(levels, level)
+	}
+	if dedup {
+		counts[msg]++
+	}
+	if level == LevelCritical {
+		isCritical = true
+	}
 	mu.Unlock()
 
+	if logger.IsJSON() {
+		f := logger.Fields{}
+		if err != nil {
+			f["error"] = err
+		}
+		log.Log(logLevel(level), msg, f)
+		return
+	}
+
 	if err != nil {
 		msg += " error: " + err.Error()
 	}
 	fmt.Fprintln(os.Stderr, msg)
 }
 
+var log = logger.New("fails")
+
+func logLevel(level Level) string {
+	switch level {
+	case LevelMinor:
+		return "warn"
+	case LevelCritical:
+		return "critical"
+	default:
+		return "error"
+	}
+}
+
 func Critical(msg string, err error) {
-	Add(msg+" (critical)", err)
-	isCritical = true
+	add(LevelCritical, msg+" (critical)", err)
 }
 
 func GetIsCritical() bool {
+	mu.RLock()
+	defer mu.RUnlock()
 	return isCritical
 }
 
 type Logger struct {
 	Prefix string
+	// 空でなければエラーと一緒に標準エラー出力に出す。レスポンスbodyの一部など
+	Detail string
 }
 
 func (l *Logger) Add(msg string, err error) {
-	Add(l.Prefix+msg, err)
+	Add(l.Prefix+msg, l.withDetail(err))
+}
+
+func (l *Logger) Minor(msg string, err error) {
+	AddMinor(l.Prefix+msg, l.withDetail(err))
+}
+
+func (l *Logger) withDetail(err error) error {
+	if l.Detail == "" {
+		return err
+	}
+	if err == nil {
+		return errors.New(l.Detail)
+	}
+	return errors.New(err.Error() + ", " + l.Detail)
 }
 
 func (l *Logger) Critical(msg string, err error) {
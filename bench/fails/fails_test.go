@@ -0,0 +1,106 @@
+package fails
+
+import (
+	"reflect"
+	"testing"
+)
+
+func reset() {
+	mu.Lock()
+	msgs = nil
+	levels = nil
+	isCritical = false
+	counts = map[string]int{}
+	dedup = false
+	mu.Unlock()
+}
+
+func TestDedup(t *testing.T) {
+	reset()
+	defer reset()
+
+	SetDedup(true)
+	Add("リクエストがタイムアウトしました", nil)
+	Add("ステータスが200ではありません: 500", nil)
+	for i := 0; i < 1422; i++ {
+		Add("リクエストがタイムアウトしました", nil)
+	}
+
+	want := []string{
+		"リクエストがタイムアウトしました (x1423)",
+		"ステータスが200ではありません: 500",
+	}
+	if got := Get(); !reflect.DeepEqual(got, want) {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestNoDedupByDefault(t *testing.T) {
+	reset()
+	defer reset()
+
+	Add("リクエストがタイムアウトしました", nil)
+	Add("リクエストがタイムアウトしました", nil)
+
+	want := []string{
+		"リクエストがタイムアウトしました",
+		"リクエストがタイムアウトしました",
+	}
+	if got := Get(); !reflect.DeepEqual(got, want) {
+		t.Errorf("want %q, got %q", want, got)
+	}
+	if got := GetUnique(); !reflect.DeepEqual(got, want[:1]) {
+		t.Errorf("want %q, got %q", want[:1], got)
+	}
+}
+
+func TestGetByLevel(t *testing.T) {
+	reset()
+	defer reset()
+
+	SetDedup(true)
+	AddMinor("リクエストがタイムアウトしました", nil)
+	Add("ステータスが200ではありません: 500", nil)
+	AddMinor("リクエストがタイムアウトしました", nil)
+	if GetIsCritical() {
+		t.Errorf("want not critical")
+	}
+	Critical("Content-Typeが正しくありません", nil)
+	if !GetIsCritical() {
+		t.Errorf("want critical")
+	}
+
+	want := map[Level][]string{
+		LevelMinor:    {"リクエストがタイムアウトしました (x2)"},
+		LevelNormal:   {"ステータスが200ではありません: 500"},
+		LevelCritical: {"Content-Typeが正しくありません (critical)"},
+	}
+	if got := GetByLevel(); !reflect.DeepEqual(got, want) {
+		t.Errorf("want %v, got %v", want, got)
+	}
+}
+
+func TestSetLocale(t *testing.T) {
+	defer SetLocale(LocaleJa)
+
+	if got, want := Msg(MsgUnexpectedStatus, 200, 500), "ステータスが200ではありません: 500"; got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+
+	err := SetLocale(LocaleEn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := Msg(MsgUnexpectedStatus, 200, 500), "Status is not 200: 500"; got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+
+	// 知らない言語にはしない
+	err = SetLocale("fr")
+	if err == nil {
+		t.Errorf("want an error, got nil")
+	}
+	if got, want := Msg(MsgRequestTimeout), "Request timed out"; got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
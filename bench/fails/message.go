@@ -0,0 +1,106 @@
+package fails
+
+import (
+	"fmt"
+	"sync"
+)
+
+// actionなどで共通して使う失敗メッセージ。SetLocaleで言語を切り替えられる
+type Message int
+
+const (
+	MsgRequestTimeout Message = iota
+	MsgRequestFailed
+	MsgUnexpectedStatus
+	MsgBodyTooLarge
+	MsgNoBody
+	MsgBodyUnreadable
+	MsgBodyMissingString
+	MsgUnexpectedContentType
+	MsgRequestJSONEncode
+	MsgRequestMultipartEncode
+	MsgResponseJSONDecode
+	MsgUnexpectedError
+	MsgTLSHandshakeTimeout
+	MsgTLSNotTLS
+	MsgTLSCertificate
+	MsgTLSHandshakeFailed
+	MsgConnectionRefused
+)
+
+const (
+	LocaleJa = "ja"
+	LocaleEn = "en"
+)
+
+// 引数はfmt.Sprintfにそのまま渡すので、言語間で順番をそろえておくこと
+var catalog = map[string]map[Message]string{
+	LocaleJa: {
+		MsgRequestTimeout:         "リクエストがタイムアウトしました",
+		MsgRequestFailed:          "リクエストが失敗しました",
+		MsgUnexpectedStatus:       "ステータスが%dではありません: %d",
+		MsgBodyTooLarge:           "レスポンスが大きすぎます（%dバイトを超えています）",
+		MsgNoBody:                 "レスポンスにbodyがありません",
+		MsgBodyUnreadable:         "レスポンスが読み込めませんでした",
+		MsgBodyMissingString:      "レスポンスに%qが含まれていません",
+		MsgUnexpectedContentType:  "Content-Typeが%sではありません: %s",
+		MsgRequestJSONEncode:      "リクエストボディをJSONに変換できませんでした",
+		MsgRequestMultipartEncode: "リクエストボディをmultipart/form-dataに変換できませんでした",
+		MsgResponseJSONDecode:     "レスポンスのJSONがデコードできませんでした",
+		MsgUnexpectedError:        "予期せぬエラー（主催者に連絡してください）",
+		MsgTLSHandshakeTimeout:    "TLSハンドシェイクがタイムアウトしました",
+		MsgTLSNotTLS:              "TLSで接続できませんでした（HTTPSのポートでTLSが有効になっているか確認してください）",
+		MsgTLSCertificate:         "サーバー証明書が正しくありません",
+		MsgTLSHandshakeFailed:     "TLSハンドシェイクに失敗しました（TLSの設定を確認してください）",
+		MsgConnectionRefused:      "接続が拒否されました（サーバーが起動しているか確認してください）",
+	},
+	LocaleEn: {
+		MsgRequestTimeout:         "Request timed out",
+		MsgRequestFailed:          "Request failed",
+		MsgUnexpectedStatus:       "Status is not %d: %d",
+		MsgBodyTooLarge:           "Response is too large (more than %d bytes)",
+		MsgNoBody:                 "Response has no body",
+		MsgBodyUnreadable:         "Could not read the response",
+		MsgBodyMissingString:      "Response does not contain %q",
+		MsgUnexpectedContentType:  "Content-Type is not %s: %s",
+		MsgRequestJSONEncode:      "Could not encode the request body as JSON",
+		MsgRequestMultipartEncode: "Could not encode the request body as multipart/form-data",
+		MsgResponseJSONDecode:     "Could not decode the response JSON",
+		MsgUnexpectedError:        "Unexpected error (please contact the organizers)",
+		MsgTLSHandshakeTimeout:    "TLS handshake timed out",
+		MsgTLSNotTLS:              "Could not connect with TLS (check that TLS is enabled on the HTTPS port)",
+		MsgTLSCertificate:         "Invalid server certificate",
+		MsgTLSHandshakeFailed:     "TLS handshake failed (check the TLS configuration)",
+		MsgConnectionRefused:      "Connection refused (check that the server is running)",
+	},
+}
+
+var muLocale sync.RWMutex
+var locale = LocaleJa
+
+// メッセージの言語を切り替える。デフォルトは日本語
+func SetLocale(l string) error {
+	if _, ok := catalog[l]; !ok {
+		return fmt.Errorf("unsupported locale: %q", l)
+	}
+	muLocale.Lock()
+	locale = l
+	muLocale.Unlock()
+	return nil
+}
+
+// 現在の言語でメッセージを組み立てる
+func Msg(m Message, args ...interface{}) string {
+	muLocale.RLock()
+	l := locale
+	muLocale.RUnlock()
+
+	format, ok := catalog[l][m]
+	if !ok {
+		format = catalog[LocaleJa][m]
+	}
+	if len(args) == 0 {
+		return format
+	}
+	return fmt.Sprintf(format, args...)
+}
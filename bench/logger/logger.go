@@ -0,0 +1,117 @@
+package logger
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ログに付ける値。room_idやstroke_idなど
+type Fields map[string]interface{}
+
+var mu sync.Mutex
+var out io.Writer = os.Stderr
+var isJSON bool
+
+// 出力先を変える。デフォルトは標準エラー出力
+func SetOutput(w io.Writer) {
+	mu.Lock()
+	out = w
+	mu.Unlock()
+}
+
+// 有効にすると1行に1つのJSONオブジェクトを書き出す。無効なら人間向けのテキストになる（デフォルト）
+func SetJSON(b bool) {
+	mu.Lock()
+	isJSON = b
+	mu.Unlock()
+}
+
+func IsJSON() bool {
+	mu.Lock()
+	defer mu.Unlock()
+	return isJSON
+}
+
+type Logger struct {
+	Component string // watcher, sessionなど。どこから出たログかを表す
+}
+
+func New(component string) *Logger {
+	return &Logger{Component: component}
+}
+
+func (l *Logger) Info(msg string, f Fields) {
+	l.Log("info", msg, f)
+}
+
+func (l *Logger) Warn(msg string, f Fields) {
+	l.Log("warn", msg, f)
+}
+
+func (l *Logger) Error(msg string, f Fields) {
+	l.Log("error", msg, f)
+}
+
+func (l *Logger) Log(level, msg string, f Fields) {
+	now := time.Now()
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if !isJSON {
+		fmt.Fprintln(out, l.text(msg, f))
+		return
+	}
+
+	b, err := json.Marshal(l.entry(now, level, msg, f, false))
+	if err != nil {
+		// JSONにできない値が混ざっていたら文字列にしてしまう
+		b, _ = json.Marshal(l.entry(now, level, msg, f, true))
+	}
+	out.Write(append(b, '\n'))
+}
+
+// fieldsにtimeなどと同じkeyがあっても、こちらで決めた値で上書きする
+func (l *Logger) entry(now time.Time, level, msg string, f Fields, stringify bool) map[string]interface{} {
+	m := make(map[string]interface{}, len(f)+4)
+	for k, v := range f {
+		if err, ok := v.(error); ok {
+			// errorはそのままだと{}になってしまう
+			v = err.Error()
+		} else if stringify {
+			v = fmt.Sprint(v)
+		}
+		m[k] = v
+	}
+	m["time"] = now.Format(time.RFC3339Nano)
+	m["level"] = level
+	m["component"] = l.Component
+	m["msg"] = msg
+	return m
+}
+
+// "[component] msg key=value ..." の形にする。keyはソートする
+func (l *Logger) text(msg string, f Fields) string {
+	keys := make([]string, 0, len(f))
+	for k := range f {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, 0, len(keys)+1)
+	if l.Component != "" {
+		parts = append(parts, "["+l.Component+"] "+msg)
+	} else {
+		parts = append(parts, msg)
+	}
+	for _, k := range keys {
+		parts = append(parts, fmt.Sprintf("%s=%v", k, f[k]))
+	}
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,69 @@
+package logger
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestJSON(t *testing.T) {
+	var buf bytes.Buffer
+	SetOutput(&buf)
+	SetJSON(true)
+	defer func() {
+		SetOutput(os.Stderr)
+		SetJSON(false)
+	}()
+
+	l := New("watcher")
+	l.Info("入室しました", Fields{"room_id": 1})
+	l.Warn("strokeが遅れています", Fields{"room_id": 1, "stroke_id": 2, "error": errors.New("timeout")})
+	l.Error("JSONにできない値", Fields{"ch": make(chan int)})
+	l.Info("fieldsなし", nil)
+
+	want := []map[string]interface{}{
+		{"level": "info", "component": "watcher", "msg": "入室しました", "room_id": float64(1)},
+		{"level": "warn", "component": "watcher", "msg": "strokeが遅れています", "room_id": float64(1), "stroke_id": float64(2), "error": "timeout"},
+		{"level": "error", "component": "watcher", "msg": "JSONにできない値"},
+		{"level": "info", "component": "watcher", "msg": "fieldsなし"},
+	}
+
+	sc := bufio.NewScanner(&buf)
+	i := 0
+	for ; sc.Scan(); i++ {
+		var got map[string]interface{}
+		if err := json.Unmarshal(sc.Bytes(), &got); err != nil {
+			t.Fatalf("line %d is not valid JSON: %s: %q", i+1, err, sc.Text())
+		}
+		if i >= len(want) {
+			continue
+		}
+		if _, ok := got["time"].(string); !ok {
+			t.Errorf("line %d: want time, got %v", i+1, got)
+		}
+		for k, v := range want[i] {
+			if got[k] != v {
+				t.Errorf("line %d: want %s=%v, got %v", i+1, k, v, got[k])
+			}
+		}
+	}
+	if i != len(want) {
+		t.Errorf("want %d lines, got %d", len(want), i)
+	}
+}
+
+func TestText(t *testing.T) {
+	var buf bytes.Buffer
+	SetOutput(&buf)
+	defer SetOutput(os.Stderr)
+
+	New("session").Warn("リダイレクトがループしています", Fields{"url": "/a", "host": "example.com"})
+
+	want := "[session] リダイレクトがループしています host=example.com url=/a\n"
+	if buf.String() != want {
+		t.Errorf("want %q, got %q", want, buf.String())
+	}
+}
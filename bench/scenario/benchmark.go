@@ -14,7 +14,7 @@ import (
 
 // トップページと画像に負荷をかける
 func LoadIndexPage(origins []string) bool {
-	s := session.New(randomOrigin(origins))
+	s := newSession(randomOrigin(origins))
 	defer s.Bye()
 
 	for i := 0; i < 3; i++ {
@@ -56,7 +56,7 @@ func LoadIndexPageWithSession(s *session.Session) bool {
 
 // /api/rooms にリクエストして、その中の一つの部屋を開いてstrokeをPOST
 func DrawOnRandomRoom(origins []string) {
-	s := session.New(randomOrigin(origins))
+	s := newSession(randomOrigin(origins))
 	defer s.Bye()
 
 	var rooms []Room
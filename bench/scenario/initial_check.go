@@ -20,8 +20,8 @@ import (
 
 // 部屋を作って線を描くとトップページに出てくる & 線がSVGに反映される
 func StrokeReflectedToTop(origins []string) {
-	s1 := session.New(randomOrigin(origins))
-	s2 := session.New(randomOrigin(origins))
+	s1 := newSession(randomOrigin(origins))
+	s2 := newSession(randomOrigin(origins))
 	defer s1.Bye()
 	defer s2.Bye()
 
@@ -128,8 +128,8 @@ func StrokeReflectedToTop(origins []string) {
 
 // 線の描かれてない部屋はトップページに並ばない
 func RoomWithoutStrokeNotShownAtTop(origins []string) {
-	s1 := session.New(randomOrigin(origins))
-	s2 := session.New(randomOrigin(origins))
+	s1 := newSession(randomOrigin(origins))
+	s2 := newSession(randomOrigin(origins))
 	defer s1.Bye()
 	defer s2.Bye()
 
@@ -163,8 +163,8 @@ func RoomWithoutStrokeNotShownAtTop(origins []string) {
 
 // ページ内のCSRFトークンが毎回変わっている
 func CSRFTokenRefreshed(origins []string) {
-	s1 := session.New(randomOrigin(origins))
-	s2 := session.New(randomOrigin(origins))
+	s1 := newSession(randomOrigin(origins))
+	s2 := newSession(randomOrigin(origins))
 	defer s1.Bye()
 	defer s2.Bye()
 
@@ -185,8 +185,8 @@ func CSRFTokenRefreshed(origins []string) {
 
 // 他人の作った部屋に最初の線を描けない
 func CantDrawFirstStrokeOnSomeoneElsesRoom(origins []string) {
-	s1 := session.New(randomOrigin(origins))
-	s2 := session.New(randomOrigin(origins))
+	s1 := newSession(randomOrigin(origins))
+	s2 := newSession(randomOrigin(origins))
 	defer s1.Bye()
 	defer s2.Bye()
 
@@ -234,7 +234,7 @@ func CantDrawFirstStrokeOnSomeoneElsesRoom(origins []string) {
 
 // トップページの内容が正しいかをチェック
 func TopPageContent(origins []string) {
-	s := session.New(randomOrigin(origins))
+	s := newSession(randomOrigin(origins))
 	defer s.Bye()
 
 	_ = action.Get(s, "/", action.OK(func(body io.Reader, l *fails.Logger) bool {
@@ -267,7 +267,7 @@ func TopPageContent(origins []string) {
 		calculatedChecksum := Adler32([]byte("<div data-reactroot=\"\" data-reactid=\"1\">" + markup + "</div>"))
 		if fmt.Sprintf("%d", calculatedChecksum) != reactChecksum {
 			l.Critical("トップページの内容が正しくありません",
-				fmt.Errorf("data-react-checksumが一致しません (%s, %s)", reactChecksum, calculatedChecksum))
+				fmt.Errorf("data-react-checksumが一致しません (%s, %d)", reactChecksum, calculatedChecksum))
 			return false
 		}
 
@@ -326,7 +326,7 @@ func TopPageContent(origins []string) {
 
 // 静的ファイルが正しいかをチェック
 func CheckStaticFiles(origins []string) {
-	s := session.New(randomOrigin(origins))
+	s := newSession(randomOrigin(origins))
 	defer s.Bye()
 
 	ok := loadStaticFiles(s, true /*checkHash*/)
@@ -337,7 +337,7 @@ func CheckStaticFiles(origins []string) {
 
 // APIとHTMLの整合性が取れているかをチェック
 func APIAndHTMLMustBeConsistent(origins []string) {
-	s := session.New(randomOrigin(origins))
+	s := newSession(randomOrigin(origins))
 	defer s.Bye()
 
 	rooms, ok := getRoomsAPI(s)
@@ -442,7 +442,7 @@ func compareToRoomHTML(s *session.Session, roomID int64, strokes []Stroke) bool
 // 入室するとWatcherCountが増える
 // 退室すると減るほうは、時間がたたないと正しい値に落ち着かないのでチェックしない
 func WatcherCountIncreases(origins []string) {
-	s := session.New(randomOrigin(origins))
+	s := newSession(randomOrigin(origins))
 	defer s.Bye()
 
 	rooms, ok := getRoomsAPI(s)
@@ -469,10 +469,10 @@ func WatcherCountIncreases(origins []string) {
 				time.Sleep(6 * time.Second)
 
 				w.Leave()
-				<-w.EndCh
+				w.Wait()
 
 				c := 0
-				for _, log := range w.WatcherCountLogs {
+				for _, log := range w.GetWatcherCountLogs() {
 					if log.Count > c {
 						c = log.Count // 送られて来た最大のwatcher_countを取得
 					}
@@ -483,9 +483,9 @@ func WatcherCountIncreases(origins []string) {
 				}
 
 				// 入室前のstrokeも含めてすべて送られる
-				if len(w.StrokeLogs) != room.StrokeCount {
+				if strokeLogs := w.GetStrokeLogs(); len(strokeLogs) != room.StrokeCount {
 					fails.Critical("正しいstrokeが送られていません",
-						fmt.Errorf("rooom: %d, expected: %d, actual: %d", room.ID, room.StrokeCount, len(w.StrokeLogs)))
+						fmt.Errorf("rooom: %d, expected: %d, actual: %d", room.ID, room.StrokeCount, len(strokeLogs)))
 				}
 			}(i, j)
 		}
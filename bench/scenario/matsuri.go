@@ -1,12 +1,11 @@
 package scenario
 
 import (
+	"sync"
 	"time"
 
-	"github.com/isucon/isucon6-final/bench/fails"
 	"github.com/isucon/isucon6-final/bench/score"
 	"github.com/isucon/isucon6-final/bench/seed"
-	"github.com/isucon/isucon6-final/bench/session"
 )
 
 const (
@@ -17,7 +16,7 @@ const (
 
 // 一人がroomを作る→大勢がそのroomをwatchする
 func Matsuri(origins []string, timeout int) {
-	s := session.New(randomOrigin(origins))
+	s := newSession(randomOrigin(origins))
 	defer s.Bye()
 
 	token, ok := fetchCSRFToken(s, "/")
@@ -32,24 +31,32 @@ func Matsuri(origins []string, timeout int) {
 
 	seedStrokes := seed.GetStrokes("isu")
 
-	postTimes := make(map[int64]time.Time)
-
 	start := time.Now()
 
-	postedStrokes := make(map[int64]Stroke)
+	posted := make(map[int64]PostedStroke)
+	var mu sync.Mutex // postedを守る
+
+	watchers := make([]*RoomWatcher, 0)
+	var muWatchers sync.Mutex // watchersを守る
 
 	go func() {
-		// 2秒おきにstrokeをPOSTする
+		// StrokePostIntervalおきにstrokeをPOSTする。配信が遅れている間は間隔を延ばす
+		pacer := newStrokePacer()
 		for {
 			for _, seedStroke := range seedStrokes {
 				postTime := time.Now()
 
 				stroke, ok := drawStroke(s, token, room.ID, seed.FluctuateStroke(seedStroke))
 				if ok {
-					postTimes[stroke.ID] = postTime
-					postedStrokes[stroke.ID] = *stroke
+					mu.Lock()
+					posted[stroke.ID] = PostedStroke{Stroke: *stroke, PostTime: postTime}
+					mu.Unlock()
+					pacer.posted(stroke.ID, postTime)
 				}
-				time.Sleep(2 * time.Second)
+				muWatchers.Lock()
+				ws := append([]*RoomWatcher(nil), watchers...)
+				muWatchers.Unlock()
+				time.Sleep(pacer.next(ws))
 				if time.Now().Sub(start).Seconds() > float64(timeout) {
 					return
 				}
@@ -57,14 +64,12 @@ func Matsuri(origins []string, timeout int) {
 		}
 	}()
 
-	watchers := make([]*RoomWatcher, 0)
-
 	for {
 		// watcherIncreaseInterval秒おきに、 (まだ退室していないwatcherの数 - 既に退室したwatcherの数) の人数が入室する
 
 		n := 0
 		for _, w := range watchers {
-			if len(w.StrokeLogs) > 0 && len(w.EndCh) == 0 { // 既にStrokeLogを1つ以上受け取ってる、かつ、まだ退室してないwatcherと同数のwatcherが入室する
+			if len(w.GetStrokeLogs()) > 0 && !w.Ended() { // 既にStrokeLogを1つ以上受け取ってる、かつ、まだ退室してないwatcherと同数のwatcherが入室する
 				n++
 			} else { // ただし、既に退室した人数をペナルティとする
 				n--
@@ -75,9 +80,11 @@ func Matsuri(origins []string, timeout int) {
 			n = initialWatcherNum
 		}
 
+		muWatchers.Lock()
 		for i := 0; i < n; i++ {
 			watchers = append(watchers, NewRoomWatcher(randomOrigin(origins), room.ID))
 		}
+		muWatchers.Unlock()
 
 		time.Sleep(time.Duration(watcherIncreaseInterval) * time.Second)
 		if time.Now().Sub(start).Seconds() > float64(timeout-watcherIncreaseInterval) {
@@ -94,31 +101,15 @@ func Matsuri(origins []string, timeout int) {
 	}
 	//fmt.Println("wait")
 	for _, w := range watchers {
-		<-w.EndCh
+		w.Wait()
 	}
 	//fmt.Println("done")
 
-	for _, w := range watchers {
-		for _, strokeLog := range w.StrokeLogs {
-			if postedStroke, ok := postedStrokes[strokeLog.Stroke.ID]; ok {
-				if len(postedStroke.Points) != len(strokeLog.Points) {
-					fails.Add("streamされたstrokeが間違っています", nil)
-				} else {
-					if postTime, ok := postTimes[strokeLog.Stroke.ID]; ok {
-						timeTaken := strokeLog.ReceivedTime.Sub(postTime).Seconds()
-
-						if timeTaken < 2 {
-							score.Increment(StrokeReceiveScore)
-						} else {
-							// 2秒以上かかって届いた。スコア増えない。5秒以上かかった場合はそこで退室したはず。
-						}
-					} else {
-						// POSTしてないstrokeが届いた。普通はありえない
-					}
-				}
-			} else {
-				// POSTしてないstrokeが届いた。普通はありえない
-			}
-		}
-	}
+	mu.Lock()
+	defer mu.Unlock()
+
+	points, breakdown := ComputeScore(watchers, posted)
+	checkStrokeDelivery(breakdown)
+	score.Increment(points)
+	addScoreBreakdown(breakdown)
 }
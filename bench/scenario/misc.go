@@ -2,6 +2,7 @@ package scenario
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -12,32 +13,92 @@ import (
 	"github.com/PuerkitoBio/goquery"
 	"github.com/isucon/isucon6-final/bench/action"
 	"github.com/isucon/isucon6-final/bench/fails"
+	"github.com/isucon/isucon6-final/bench/http"
 	"github.com/isucon/isucon6-final/bench/seed"
 	"github.com/isucon/isucon6-final/bench/session"
 	"github.com/isucon/isucon6-final/bench/svg"
 )
 
+// trueならベンチマーク中に作るセッションはHTTP/2を使わない。cmd/benchの-http1で設定する
+var ForceHTTP1 bool
+
+// scenarioの中ではsession.Newの代わりにこれを使う
+func newSession(origin string) *session.Session {
+	s := session.New(origin)
+	s.SetForceHTTP1(ForceHTTP1)
+	return s
+}
+
 func randomOrigin(origins []string) string {
 	return origins[rand.Intn(len(origins))]
 }
 
 func fetchCSRFToken(s *session.Session, path string) (string, bool) {
-	var token string
+	token, err := fetchCSRFTokenE(s, path)
+	return token, err == nil
+}
+
+// fetchCSRFTokenと同じだが、取得できなかった理由をエラーで返す
+// 失敗はこれまで通りfailsにも記録される
+func fetchCSRFTokenE(s *session.Session, path string) (string, error) {
+	var (
+		token string
+		err   error
+	)
 
-	ok := action.Get(s, path, action.OK(func(body io.Reader, l *fails.Logger) bool {
+	c := action.OK(func(body io.Reader, l *fails.Logger) bool {
 		doc, ok := makeDocument(body, l)
 		if !ok {
+			err = errors.New("ページのHTMLがパースできませんでした")
 			return false
 		}
 
 		token, ok = extractCsrfToken(doc, l)
+		if !ok {
+			err = errors.New("トークンが取得できませんでした")
+		}
 
 		return ok
-	}))
-	if !ok {
-		return "", false
+	})
+	ok, status := doRecordingStatus(c, func(c action.Checker) bool {
+		return action.Get(s, path, c)
+	})
+	if ok {
+		return token, nil
 	}
-	return token, true
+	return "", requestError(status, err)
+}
+
+// cで受け取ったステータスコードを覚えながらdoでリクエストを送り、成功したかとステータスコードを返す
+func doRecordingStatus(c action.Checker, do func(action.Checker) bool) (bool, int) {
+	r := &statusRecorder{Checker: c}
+	ok := do(r)
+	return ok, r.status
+}
+
+// 失敗したリクエストの理由を返す。checkの中で理由がわかっていればcheckErrを、そうでなければステータスコードから組み立てる
+func requestError(status int, checkErr error) error {
+	if checkErr != nil {
+		return checkErr
+	}
+	if status == 0 {
+		return errors.New("リクエストが失敗しました")
+	}
+	if status != http.StatusOK {
+		return fmt.Errorf("ステータスが%dではありません: %d", http.StatusOK, status)
+	}
+	return errors.New("レスポンスヘッダが正しくありません")
+}
+
+// 受け取ったステータスコードを覚えておくChecker
+type statusRecorder struct {
+	action.Checker
+	status int
+}
+
+func (c *statusRecorder) CheckStatus(status int, l *fails.Logger) bool {
+	c.status = status
+	return c.Checker.CheckStatus(status, l)
 }
 
 func makeDocument(body io.Reader, l *fails.Logger) (*goquery.Document, bool) {
@@ -58,7 +119,7 @@ func parseResponseJSON(body io.Reader, l *fails.Logger) (*Response, bool) {
 	var res Response
 	err = json.Unmarshal(b, &res)
 	if err != nil {
-		l.Add("レスポンスのJSONがパースできませんでした: "+string(b[:20]), err)
+		l.Add("レスポンスのJSONがパースできませんでした: "+bodySnippet(b), err)
 		return nil, false
 	}
 	return &res, true
@@ -149,14 +210,34 @@ func loadImages(s *session.Session, images []string) bool {
 }
 
 func makeRoom(s *session.Session, token string) (*Room, bool) {
+	name := "ひたすら椅子を描く部屋【" + strconv.Itoa(rand.Intn(1000)+1000) + "】"
+	room, err := createRoom(s, token, name, 1024, 768)
+	return room, err == nil
+}
+
+// トップページからCSRFトークンを取って部屋を作り、その部屋のIDを返す
+// 失敗したときはfailsに記録した上で、その理由をエラーで返す
+func CreateRoom(s *session.Session, name string, canvasWidth, canvasHeight int) (int64, error) {
+	token, err := fetchCSRFTokenE(s, "/")
+	if err != nil {
+		return 0, err
+	}
+	room, err := createRoom(s, token, name, canvasWidth, canvasHeight)
+	if err != nil {
+		return 0, err
+	}
+	return room.ID, nil
+}
+
+func createRoom(s *session.Session, token string, name string, canvasWidth, canvasHeight int) (*Room, error) {
 	postBody, _ := json.Marshal(struct {
 		Name         string `json:"name"`
 		CanvasWidth  int    `json:"canvas_width"`
 		CanvasHeight int    `json:"canvas_height"`
 	}{
-		Name:         "ひたすら椅子を描く部屋【" + strconv.Itoa(rand.Intn(1000)+1000) + "】",
-		CanvasWidth:  1024,
-		CanvasHeight: 768,
+		Name:         name,
+		CanvasWidth:  canvasWidth,
+		CanvasHeight: canvasHeight,
 	})
 
 	headers := map[string]string{
@@ -164,30 +245,50 @@ func makeRoom(s *session.Session, token string) (*Room, bool) {
 		"x-csrf-token": token,
 	}
 
-	var room *Room
+	var (
+		room *Room
+		err  error
+	)
 
-	ok := action.Post(s, "/api/rooms", postBody, headers, action.OK(func(body io.Reader, l *fails.Logger) bool {
-		b, err := ioutil.ReadAll(body)
-		if err != nil {
-			l.Add("レスポンス内容が読み込めませんでした", err)
+	c := action.OK(func(body io.Reader, l *fails.Logger) bool {
+		b, e := ioutil.ReadAll(body)
+		if e != nil {
+			l.Add("レスポンス内容が読み込めませんでした", e)
+			err = errors.New("レスポンス内容が読み込めませんでした")
 			return false
 		}
 		var res Response
-		err = json.Unmarshal(b, &res)
-		if err != nil {
-			l.Add("レスポンス内容が正しくありません"+string(b[:20]), err)
+		e = json.Unmarshal(b, &res)
+		if e != nil {
+			l.Add("レスポンス内容が正しくありません"+bodySnippet(b), e)
+			err = errors.New("レスポンス内容が正しくありません")
 			return false
 		}
 		if res.Room == nil || res.Room.ID <= 0 {
-			l.Add("レスポンス内容が正しくありません"+string(b[:20]), nil)
+			l.Add("レスポンス内容が正しくありません"+bodySnippet(b), nil)
+			err = errors.New("レスポンスに部屋のIDがありません")
 			return false
 		}
 		room = res.Room
 
 		return true
-	}))
+	})
 
-	return room, ok
+	ok, status := doRecordingStatus(c, func(c action.Checker) bool {
+		return action.Post(s, "/api/rooms", postBody, headers, c)
+	})
+	if ok {
+		return room, nil
+	}
+	return nil, requestError(status, err)
+}
+
+// エラーメッセージに含めるレスポンスbodyの先頭
+func bodySnippet(b []byte) string {
+	if len(b) > 20 {
+		b = b[:20]
+	}
+	return string(b)
 }
 
 func drawStroke(s *session.Session, token string, roomID int64, seedStroke seed.Stroke) (*Stroke, bool) {
@@ -218,11 +319,11 @@ func drawStroke(s *session.Session, token string, roomID int64, seedStroke seed.
 		var res Response
 		err = json.Unmarshal(b, &res)
 		if err != nil {
-			l.Add("レスポンス内容が正しくありません"+string(b[:20]), err)
+			l.Add("レスポンス内容が正しくありません"+bodySnippet(b), err)
 			return false
 		}
 		if res.Stroke == nil || res.Stroke.ID <= 0 {
-			l.Add("レスポンス内容が正しくありません"+string(b[:20]), nil)
+			l.Add("レスポンス内容が正しくありません"+bodySnippet(b), nil)
 			return false
 		}
 
@@ -0,0 +1,102 @@
+package scenario
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/isucon/isucon6-final/bench/fails"
+	"github.com/isucon/isucon6-final/bench/http"
+	"github.com/isucon/isucon6-final/bench/http/httptest"
+	"github.com/isucon/isucon6-final/bench/session"
+)
+
+func TestFetchCSRFTokenE(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ok", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `<html data-csrf-token="token"><body></body></html>`)
+	})
+	mux.HandleFunc("/notoken", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `<html><body></body></html>`)
+	})
+	mux.HandleFunc("/error", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "error", http.StatusInternalServerError)
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	s := session.New(ts.URL)
+
+	token, err := fetchCSRFTokenE(s, "/ok")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if token != "token" {
+		t.Errorf("want %q, got %q", "token", token)
+	}
+
+	_, err = fetchCSRFTokenE(s, "/notoken")
+	if err == nil || !strings.Contains(err.Error(), "トークン") {
+		t.Errorf("want a token error, got %v", err)
+	}
+
+	_, err = fetchCSRFTokenE(s, "/error")
+	if err == nil || !strings.Contains(err.Error(), "500") {
+		t.Errorf("want a status error, got %v", err)
+	}
+
+	if _, ok := fetchCSRFToken(s, "/error"); ok {
+		t.Errorf("want false, got true")
+	}
+}
+
+func TestCreateRoom(t *testing.T) {
+	var posted struct {
+		Name         string `json:"name"`
+		CanvasWidth  int    `json:"canvas_width"`
+		CanvasHeight int    `json:"canvas_height"`
+	}
+	var token string
+	roomJSON := `{"room":{"id":42,"name":"test","canvas_width":640,"canvas_height":480}}`
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `<html data-csrf-token="token"><body></body></html>`)
+	})
+	mux.HandleFunc("/api/rooms", func(w http.ResponseWriter, r *http.Request) {
+		token = r.Header.Get("x-csrf-token")
+		json.NewDecoder(r.Body).Decode(&posted)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, roomJSON)
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	s := session.New(ts.URL)
+	defer s.Bye()
+
+	id, err := CreateRoom(s, "test", 640, 480)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if id != 42 {
+		t.Errorf("want %d, got %d", 42, id)
+	}
+	if token != "token" {
+		t.Errorf("want %q, got %q", "token", token)
+	}
+	if posted.Name != "test" || posted.CanvasWidth != 640 || posted.CanvasHeight != 480 {
+		t.Errorf("unexpected request: %+v", posted)
+	}
+
+	// IDが無ければ失敗にする
+	n := len(fails.Get())
+	roomJSON = `{}`
+	_, err = CreateRoom(s, "test", 640, 480)
+	if err == nil {
+		t.Errorf("want an error, got nil")
+	}
+	if len(fails.Get()) != n+1 {
+		t.Errorf("want %d messages, got %d", n+1, len(fails.Get()))
+	}
+}
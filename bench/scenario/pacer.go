@@ -0,0 +1,98 @@
+package scenario
+
+import (
+	"sort"
+	"time"
+)
+
+// strokeをPOSTする間隔。watcherへの配信が遅れている間は StrokePostMaxInterval まで延ばす
+// 遅いサーバーに対してPOSTし続けて、配信の遅れを隠してしまわないようにする
+var (
+	StrokePostInterval     = 2 * time.Second
+	StrokePostMaxInterval  = 16 * time.Second
+	StrokeLatencyThreshold = time.Second // 直近のwatcherのp95のレイテンシがこれを超えたら遅れているとみなす
+)
+
+type strokePacer struct {
+	interval time.Duration
+
+	// POSTしたstrokeのIDとPOSTした時刻。サーバーのCreatedAtではなくベンチマーカーの時計で測る
+	postTimes map[int64]time.Time
+	prevID    int64
+	prevPost  time.Time // 1つ前にPOSTした時刻
+	lastID    int64
+	lastPost  time.Time // 最後にPOSTした時刻
+}
+
+func newStrokePacer() *strokePacer {
+	return &strokePacer{
+		interval:  StrokePostInterval,
+		postTimes: make(map[int64]time.Time),
+	}
+}
+
+// POSTに成功したstrokeを記録する
+func (p *strokePacer) posted(id int64, postTime time.Time) {
+	p.prevID, p.prevPost = p.lastID, p.lastPost
+	p.lastID, p.lastPost = id, postTime
+	p.postTimes[id] = postTime
+}
+
+// 直近のwatchersのレイテンシを見て、次のPOSTまでの間隔を返す
+// 遅れていれば間隔を倍にし、追いついていれば StrokePostInterval まで半分ずつ戻す
+func (p *strokePacer) next(watchers []*RoomWatcher) time.Duration {
+	if p.observedLatency(watchers) > StrokeLatencyThreshold {
+		p.interval *= 2
+		if p.interval > StrokePostMaxInterval {
+			p.interval = StrokePostMaxInterval
+		}
+	} else {
+		p.interval /= 2
+		if p.interval < StrokePostInterval {
+			p.interval = StrokePostInterval
+		}
+	}
+	return p.interval
+}
+
+// 1つ前のPOST以降にwatchersが受け取ったstrokeについて、POSTしてから届くまでの時間のp95を求め、一番遅いwatcherの値を返す
+// 最初からのp95だと一度遅れると戻らず、間の悪い時間帯を引きずってしまうので直近だけを見る
+func (p *strokePacer) observedLatency(watchers []*RoomWatcher) time.Duration {
+	if p.prevPost.IsZero() {
+		return 0
+	}
+
+	var latency time.Duration
+	for _, w := range watchers {
+		// 退室したwatcherにはもう何も届かないので、遅れとは数えない
+		if w.left() || w.Ended() {
+			continue
+		}
+		latencies := make([]time.Duration, 0)
+		receivedPrev := false
+		for _, log := range w.GetStrokeLogs() {
+			if log.ID == p.prevID {
+				receivedPrev = true
+			}
+			if log.ReceivedTime.Before(p.prevPost) {
+				continue
+			}
+			if postTime, ok := p.postTimes[log.ID]; ok {
+				latencies = append(latencies, log.ReceivedTime.Sub(postTime))
+			}
+		}
+		// 1つ前のstrokeがまだ届いていなければ、少なくとも今回のPOSTまでは遅れている
+		// 配信が止まったときに何も届かないのを遅れていないとみなさないようにする
+		if !receivedPrev && w.openedBefore(p.prevPost) {
+			latencies = append(latencies, p.lastPost.Sub(p.prevPost))
+		}
+		if len(latencies) == 0 {
+			continue
+		}
+		sort.Sort(durations(latencies))
+		if p95 := percentile(latencies, 0.95); p95 > latency {
+			latency = p95
+		}
+	}
+	return latency
+}
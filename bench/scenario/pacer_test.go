@@ -0,0 +1,110 @@
+package scenario
+
+import (
+	"testing"
+	"time"
+)
+
+// 決まった遅れでstrokeを配信するサーバーを模したもの。時計も進めるだけで実際には待たない
+type pacerSim struct {
+	start    time.Time
+	now      time.Time
+	lastID   int64
+	watchers []*RoomWatcher
+	latency  []time.Duration
+	pending  [][]StrokeLog
+}
+
+func newPacerSim(latency ...time.Duration) *pacerSim {
+	s := &pacerSim{start: time.Now(), latency: latency, pending: make([][]StrokeLog, len(latency))}
+	s.now = s.start
+	for range latency {
+		s.watchers = append(s.watchers, &RoomWatcher{openTime: s.start.Add(-time.Second)})
+	}
+	return s
+}
+
+// 1回POSTして、次のPOSTまでの間隔だけ時計を進める
+func (s *pacerSim) step(p *strokePacer) {
+	s.lastID++
+	p.posted(s.lastID, s.now)
+	for i := range s.watchers {
+		s.pending[i] = append(s.pending[i], StrokeLog{ReceivedTime: s.now.Add(s.latency[i]), Stroke: Stroke{ID: s.lastID}})
+	}
+	s.deliver()
+	s.now = s.now.Add(p.next(s.watchers))
+}
+
+// 今の時刻までに届いているはずのstrokeをwatcherに渡す
+func (s *pacerSim) deliver() {
+	for i, w := range s.watchers {
+		rest := s.pending[i][:0]
+		for _, log := range s.pending[i] {
+			if log.ReceivedTime.After(s.now) {
+				rest = append(rest, log)
+			} else {
+				w.StrokeLogs = append(w.StrokeLogs, log)
+			}
+		}
+		s.pending[i] = rest
+	}
+}
+
+// 1分の間にPOSTできる回数
+func (s *pacerSim) postsPerMinute(p *strokePacer) int {
+	n := 0
+	for end := s.now.Add(time.Minute); s.now.Before(end); n++ {
+		s.step(p)
+	}
+	return n
+}
+
+func TestStrokePacer(t *testing.T) {
+	if n := newPacerSim(100*time.Millisecond, 200*time.Millisecond).postsPerMinute(newStrokePacer()); n != 30 {
+		t.Errorf("want %d, got %d", 30, n)
+	}
+	if n := newPacerSim(100*time.Millisecond, 3*time.Second).postsPerMinute(newStrokePacer()); n >= 10 {
+		t.Errorf("posting rate did not drop: %d posts per minute", n)
+	}
+
+	// 配信が止まって何も届かなくても遅れているとみなす
+	if n := newPacerSim(100*time.Millisecond, time.Hour).postsPerMinute(newStrokePacer()); n >= 10 {
+		t.Errorf("posting rate did not drop: %d posts per minute", n)
+	}
+
+	// まだつながっていないwatcherは何も受け取っていなくても遅れとはみなさない
+	s := newPacerSim(100*time.Millisecond, 200*time.Millisecond)
+	s.watchers = append(s.watchers, &RoomWatcher{})
+	s.latency = append(s.latency, time.Hour)
+	s.pending = append(s.pending, nil)
+	if n := s.postsPerMinute(newStrokePacer()); n != 30 {
+		t.Errorf("want %d, got %d", 30, n)
+	}
+
+	// 退室したwatcherには届かないが、遅れとはみなさない
+	s = newPacerSim(100*time.Millisecond, time.Hour)
+	s.watchers[1].isLeft = true
+	s.watchers[1].EndCh = make(chan struct{})
+	close(s.watchers[1].EndCh)
+	if n := s.postsPerMinute(newStrokePacer()); n != 30 {
+		t.Errorf("want %d, got %d", 30, n)
+	}
+
+	// 遅れている間は StrokePostMaxInterval で頭打ちになり、追いついたら元の間隔に戻る
+	// 直近のレイテンシだけを見るので、それまでの遅れは引きずらない
+	p := newStrokePacer()
+	s = newPacerSim(100*time.Millisecond, 3*time.Second)
+	for i := 0; i < 10; i++ {
+		s.step(p)
+	}
+	if p.interval != StrokePostMaxInterval {
+		t.Errorf("want %s, got %s", StrokePostMaxInterval, p.interval)
+	}
+	s.latency[1] = 200 * time.Millisecond
+	for i := 0; i < 10; i++ {
+		s.step(p)
+	}
+	if p.interval != StrokePostInterval {
+		t.Errorf("want %s, got %s", StrokePostInterval, p.interval)
+	}
+}
@@ -0,0 +1,156 @@
+package scenario
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// 部屋ごとのstrokeの配信状況
+type RoomDelivery struct {
+	RoomID    int64 `json:"room_id"`
+	Posted    int   `json:"posted"`
+	Expected  int   `json:"expected"`  // 各watcherに届くはずだったstrokeの数の合計
+	Delivered int   `json:"delivered"` // そのうち実際に届いた数
+	Watchers  int   `json:"watchers"`
+}
+
+// 届くはずだったもののうち届いた割合。届くはずのものが無ければ1
+func (d RoomDelivery) Ratio() float64 {
+	if d.Expected == 0 {
+		return 1
+	}
+	return float64(d.Delivered) / float64(d.Expected)
+}
+
+// 全watcherのstrokeの配信状況をまとめたもの。NewReportで作る
+type Report struct {
+	Posted           int
+	Expected         int
+	Delivered        int
+	DuplicateStrokes int
+	Rooms            []RoomDelivery // RoomIDの順
+
+	// POSTしてから届くまでにかかった時間の分布
+	LatencyP50 time.Duration
+	LatencyP95 time.Duration
+	LatencyP99 time.Duration
+	LatencyMax time.Duration
+}
+
+// 退室し終えたwatchersと、部屋ごとにPOSTしたstrokeのIDとPOSTした時刻から、配信状況を集計する
+// POSTしていないstrokeや、部屋にいなかった間にPOSTされたstrokeは数えない
+func NewReport(watchers []*RoomWatcher, postTimesByRoom map[int64]map[int64]time.Time) *Report {
+	r := &Report{}
+	rooms := make(map[int64]*RoomDelivery)
+	room := func(roomID int64) *RoomDelivery {
+		d, ok := rooms[roomID]
+		if !ok {
+			d = &RoomDelivery{RoomID: roomID, Posted: len(postTimesByRoom[roomID])}
+			rooms[roomID] = d
+		}
+		return d
+	}
+	for roomID := range postTimesByRoom {
+		room(roomID)
+	}
+
+	latencies := []time.Duration{}
+	for _, w := range watchers {
+		expected, ls := w.deliveryLatencies(postTimesByRoom[w.roomID])
+		d := room(w.roomID)
+		d.Watchers++
+		d.Expected += expected
+		d.Delivered += len(ls)
+		latencies = append(latencies, ls...)
+		r.DuplicateStrokes += w.GetDuplicateStrokes()
+	}
+
+	for _, d := range rooms {
+		r.Posted += d.Posted
+		r.Expected += d.Expected
+		r.Delivered += d.Delivered
+		r.Rooms = append(r.Rooms, *d)
+	}
+	sort.Sort(roomDeliveries(r.Rooms))
+
+	if len(latencies) > 0 {
+		sort.Sort(durations(latencies))
+		r.LatencyP50 = percentile(latencies, 0.50)
+		r.LatencyP95 = percentile(latencies, 0.95)
+		r.LatencyP99 = percentile(latencies, 0.99)
+		r.LatencyMax = latencies[len(latencies)-1]
+	}
+
+	return r
+}
+
+type roomDeliveries []RoomDelivery
+
+func (d roomDeliveries) Len() int           { return len(d) }
+func (d roomDeliveries) Less(i, j int) bool { return d[i].RoomID < d[j].RoomID }
+func (d roomDeliveries) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+
+// 全体で届くはずだったもののうち届いた割合。届くはずのものが無ければ1
+func (r *Report) Ratio() float64 {
+	if r.Expected == 0 {
+		return 1
+	}
+	return float64(r.Delivered) / float64(r.Expected)
+}
+
+func (r *Report) String() string {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "POSTしたstroke: %d\n", r.Posted)
+	fmt.Fprintf(&b, "届いたstroke: %d/%d (%.1f%%)\n", r.Delivered, r.Expected, r.Ratio()*100)
+	if r.DuplicateStrokes > 0 {
+		fmt.Fprintf(&b, "重複して届いたstroke: %d\n", r.DuplicateStrokes)
+	}
+	for _, d := range r.Rooms {
+		fmt.Fprintf(&b, "  room %d: %d/%d (%.1f%%), watchers: %d\n", d.RoomID, d.Delivered, d.Expected, d.Ratio()*100, d.Watchers)
+	}
+	fmt.Fprintf(&b, "レイテンシ: p50=%s p95=%s p99=%s max=%s\n", r.LatencyP50, r.LatencyP95, r.LatencyP99, r.LatencyMax)
+	return b.String()
+}
+
+type roomDeliveryJSON struct {
+	RoomDelivery
+	Ratio float64 `json:"ratio"`
+}
+
+// 時間はミリ秒で出す
+func (r *Report) MarshalJSON() ([]byte, error) {
+	rooms := make([]roomDeliveryJSON, 0, len(r.Rooms))
+	for _, d := range r.Rooms {
+		rooms = append(rooms, roomDeliveryJSON{d, d.Ratio()})
+	}
+	return json.Marshal(struct {
+		Posted           int                `json:"posted"`
+		Expected         int                `json:"expected"`
+		Delivered        int                `json:"delivered"`
+		Ratio            float64            `json:"ratio"`
+		DuplicateStrokes int                `json:"duplicate_strokes"`
+		Rooms            []roomDeliveryJSON `json:"rooms"`
+		LatencyP50       float64            `json:"latency_p50_ms"`
+		LatencyP95       float64            `json:"latency_p95_ms"`
+		LatencyP99       float64            `json:"latency_p99_ms"`
+		LatencyMax       float64            `json:"latency_max_ms"`
+	}{
+		r.Posted,
+		r.Expected,
+		r.Delivered,
+		r.Ratio(),
+		r.DuplicateStrokes,
+		rooms,
+		milliseconds(r.LatencyP50),
+		milliseconds(r.LatencyP95),
+		milliseconds(r.LatencyP99),
+		milliseconds(r.LatencyMax),
+	})
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -0,0 +1,95 @@
+package scenario
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReport(t *testing.T) {
+	startTime := time.Now()
+	endTime := startTime.Add(time.Minute)
+	threshold := 5 * time.Second
+
+	// room 1には4つ、room 2には2つPOSTした
+	postTimesByRoom := map[int64]map[int64]time.Time{
+		1: {},
+		2: {},
+	}
+	for i := int64(1); i <= 4; i++ {
+		postTimesByRoom[1][i] = startTime.Add(time.Duration(i) * time.Second)
+	}
+	for i := int64(5); i <= 6; i++ {
+		postTimesByRoom[2][i] = startTime.Add(time.Duration(i) * time.Second)
+	}
+
+	receive := func(w *RoomWatcher, roomID int64, ids []int64, latency time.Duration) {
+		for _, id := range ids {
+			w.StrokeLogs = append(w.StrokeLogs, StrokeLog{
+				ReceivedTime: postTimesByRoom[roomID][id].Add(latency),
+				Stroke:       Stroke{ID: id, RoomID: roomID},
+			})
+		}
+	}
+
+	// room 1の1人目は全部、2人目は半分だけ受け取った
+	w1 := &RoomWatcher{roomID: 1, startTime: startTime, openTime: startTime, endTime: endTime, threshold: threshold}
+	receive(w1, 1, []int64{1, 2, 3, 4}, 100*time.Millisecond)
+	w2 := &RoomWatcher{roomID: 1, startTime: startTime, openTime: startTime, endTime: endTime, threshold: threshold}
+	receive(w2, 1, []int64{1, 2}, 300*time.Millisecond)
+	// room 2の1人は全部受け取ったが、POSTしていないstrokeも届いた
+	w3 := &RoomWatcher{roomID: 2, startTime: startTime, openTime: startTime, endTime: endTime, threshold: threshold}
+	receive(w3, 2, []int64{5, 6}, 200*time.Millisecond)
+	w3.StrokeLogs = append(w3.StrokeLogs, StrokeLog{ReceivedTime: startTime, Stroke: Stroke{ID: 100, RoomID: 2}})
+	// streamに繋がらなかったwatcherは数えない
+	w4 := &RoomWatcher{roomID: 2, threshold: threshold}
+
+	r := NewReport([]*RoomWatcher{w1, w2, w3, w4}, postTimesByRoom)
+
+	if r.Posted != 6 || r.Expected != 10 || r.Delivered != 8 {
+		t.Errorf("want 6, 10, 8, got %d, %d, %d", r.Posted, r.Expected, r.Delivered)
+	}
+	if r.Ratio() != 0.8 {
+		t.Errorf("want %v, got %v", 0.8, r.Ratio())
+	}
+	if len(r.Rooms) != 2 {
+		t.Fatalf("want %d rooms, got %d", 2, len(r.Rooms))
+	}
+	if d := r.Rooms[0]; d.RoomID != 1 || d.Ratio() != 0.75 || d.Watchers != 2 {
+		t.Errorf("something went wrong: %#v", d)
+	}
+	if d := r.Rooms[1]; d.RoomID != 2 || d.Ratio() != 1 || d.Watchers != 2 {
+		t.Errorf("something went wrong: %#v", d)
+	}
+	if r.LatencyP50 != 100*time.Millisecond {
+		t.Errorf("want %s, got %s", 100*time.Millisecond, r.LatencyP50)
+	}
+	if r.LatencyMax != 300*time.Millisecond {
+		t.Errorf("want %s, got %s", 300*time.Millisecond, r.LatencyMax)
+	}
+
+	if s := r.String(); !strings.Contains(s, "届いたstroke: 8/10 (80.0%)") || !strings.Contains(s, "room 1: 6/8 (75.0%)") {
+		t.Errorf("something went wrong: %s", s)
+	}
+
+	b, err := json.Marshal(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got struct {
+		Ratio      float64 `json:"ratio"`
+		LatencyMax float64 `json:"latency_max_ms"`
+		Rooms      []struct {
+			RoomID int64   `json:"room_id"`
+			Ratio  float64 `json:"ratio"`
+		} `json:"rooms"`
+	}
+	err = json.Unmarshal(b, &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Ratio != 0.8 || got.LatencyMax != 300 || len(got.Rooms) != 2 || got.Rooms[0].Ratio != 0.75 {
+		t.Errorf("something went wrong: %s", b)
+	}
+}
@@ -2,13 +2,19 @@ package scenario
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
+	"math/rand"
 	"net/url"
+	"sort"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/isucon/isucon6-final/bench/action"
 	"github.com/isucon/isucon6-final/bench/fails"
+	"github.com/isucon/isucon6-final/bench/logger"
 	"github.com/isucon/isucon6-final/bench/session"
 	"github.com/isucon/isucon6-final/bench/sse"
 )
@@ -24,37 +30,121 @@ type WatcherCountLog struct {
 }
 
 type RoomWatcher struct {
-	EndCh            chan struct{}
-	StrokeLogs       []StrokeLog
-	WatcherCountLogs []WatcherCountLog
+	EndCh            chan struct{}     // 退室し終えたらcloseされる。Waitで待ってもよい
+	StrokeLogs       []StrokeLog       // 直接読まずにGetStrokeLogsを使う
+	WatcherCountLogs []WatcherCountLog // 直接読まずにGetWatcherCountLogsを使う
+	FirstEventTime   time.Time         // 最初のstrokeを受け取った時刻。直接読まずにTimeToFirstEventを使う
 
+	roomID int64
 	s      *session.Session
 	es     *sse.EventSource
 	isLeft bool
+	leftCh chan struct{} // Leaveされたらcloseする
+	mu     sync.Mutex    // StrokeLogs, WatcherCountLogs, FirstEventTime, es, isLeft, leftCh, startTime, openTime, endTime, seenStrokes, duplicateStrokes, eventCountsを守る
+
+	seenStrokes      map[int64]bool // 入室してから描かれたstrokeのうち、受け取ったもののID
+	duplicateStrokes int
+	eventCounts      map[string]int // 受け取ったイベントの種類ごとの数
+
+	endOnce sync.Once // finalizeを1回だけ行う
+
+	readyCh   chan struct{} // streamに初めて繋がるか、繋がらずに退室したらcloseする
+	readyOnce sync.Once
+	readyErr  error // 繋がらずに退室した理由。readyChがcloseされた後は書き換えない
+
+	threshold time.Duration
+	now       func() time.Time // テストで時計を差し替える
+	startTime time.Time
+	openTime  time.Time // streamに初めて繋がった時刻。これより前にPOSTされたstrokeは届かなくてもよい
+	endTime   time.Time
 }
 
 func NewRoomWatcher(target string, roomID int64) *RoomWatcher {
-	w := &RoomWatcher{
-		EndCh:            make(chan struct{}, 1),
-		StrokeLogs:       make([]StrokeLog, 0),
-		WatcherCountLogs: make([]WatcherCountLog, 0),
-		isLeft:           false,
-		s:                session.New(target),
-	}
+	return NewRoomWatcherWithThreshold(target, roomID, thresholdResponseTime)
+}
+
+// strokeが届くまでに我慢できる時間をthresholdで指定する
+func NewRoomWatcherWithThreshold(target string, roomID int64, threshold time.Duration) *RoomWatcher {
+	w := newRoomWatcher(target, roomID, threshold)
 
 	go w.watch(roomID)
 
 	return w
 }
 
+// startDelayだけ待ってから入室する。待っている間にLeaveされたら入室しない
+func NewRoomWatcherDelayed(target string, roomID int64, startDelay time.Duration) *RoomWatcher {
+	w := newRoomWatcher(target, roomID, thresholdResponseTime)
+
+	go func() {
+		t := time.NewTimer(startDelay)
+		defer t.Stop()
+		select {
+		case <-t.C:
+		case <-w.leftCh:
+		}
+		w.watch(roomID)
+	}()
+
+	return w
+}
+
+// n人のwatcherを、全員が同時に接続しに行かないようにwindowの間にばらして入室させる
+func NewRoomWatchersStaggered(target string, roomID int64, n int, window time.Duration) []*RoomWatcher {
+	watchers := make([]*RoomWatcher, 0, n)
+	if n <= 0 {
+		return watchers
+	}
+	slot := window / time.Duration(n)
+	for i := 0; i < n; i++ {
+		delay := slot * time.Duration(i)
+		if slot > 0 {
+			delay += time.Duration(rand.Int63n(int64(slot)))
+		}
+		watchers = append(watchers, NewRoomWatcherDelayed(target, roomID, delay))
+	}
+	return watchers
+}
+
+func newRoomWatcher(target string, roomID int64, threshold time.Duration) *RoomWatcher {
+	return &RoomWatcher{
+		EndCh:            make(chan struct{}),
+		StrokeLogs:       make([]StrokeLog, 0),
+		WatcherCountLogs: make([]WatcherCountLog, 0),
+		isLeft:           false,
+		leftCh:           make(chan struct{}),
+		readyCh:          make(chan struct{}),
+		roomID:           roomID,
+		seenStrokes:      make(map[int64]bool),
+		eventCounts:      make(map[string]int),
+		s:                newSession(target),
+		threshold:        threshold,
+		now:              time.Now,
+	}
+}
+
+var watcherLog = logger.New("watcher")
+
 // 描いたstrokeがこの時間以上経ってから届いたら、ユーザーがストレスに感じてタブを閉じる、という設定にした。
 const thresholdResponseTime = 5 * time.Second
 
 func (w *RoomWatcher) watch(roomID int64) {
+	if w.left() {
+		// 入室する前にLeaveされた
+		w.finalize()
+		return
+	}
 
 	path := fmt.Sprintf("/rooms/%d", roomID)
-	token, ok := fetchCSRFToken(w.s, path)
-	if !ok || w.isLeft {
+	token, err := fetchCSRFTokenE(w.s, path)
+	if err != nil {
+		l := &fails.Logger{Prefix: "[" + path + "] "}
+		l.Add("CSRFトークンが取得できなかったため入室できませんでした", err)
+		w.markReady(fmt.Errorf("CSRFトークンが取得できませんでした: %s", err))
+		w.finalize()
+		return
+	}
+	if w.left() {
 		w.finalize()
 		return
 	}
@@ -62,18 +152,45 @@ func (w *RoomWatcher) watch(roomID int64) {
 	path = "/api/stream" + path
 	l := &fails.Logger{Prefix: "[" + path + "] "}
 
+	// streamは終わらないので、タイムアウトで切られないようにする
+	// 切れた場合はEventSourceがLast-Event-IDをつけて繋ぎ直す
+	w.s.SetTimeout(0)
+
 	values := url.Values{}
 	values.Add("csrf_token", token)
 
-	startTime := time.Now()
-	w.es, ok = action.SSE(w.s, path+"?"+values.Encode())
+	startTime := w.now()
+	es, ok := action.SSE(w.s, path+"?"+values.Encode())
 	if !ok {
 		w.finalize()
 		return
 	}
 
+	w.stream(es, roomID, startTime, l)
+}
+
+// esから届いたイベントを記録する。esが終わるまで戻らない
+func (w *RoomWatcher) stream(es *sse.EventSource, roomID int64, startTime time.Time, l *fails.Logger) {
+	w.mu.Lock()
+	if w.isLeft {
+		w.mu.Unlock()
+		w.finalize()
+		return
+	}
+	w.es = es
+	w.startTime = startTime
+	w.mu.Unlock()
+
+	watcherLog.Info("入室しました", logger.Fields{"room_id": roomID})
+
+	// サーバーが何を送ってきているのか調べられるように、知らない種類のものも含めて数えておく
+	w.es.OnAny(func(event, data string) {
+		w.mu.Lock()
+		w.eventCounts[event]++
+		w.mu.Unlock()
+	})
 	w.es.On("stroke", func(data string) {
-		now := time.Now()
+		now := w.now()
 		var stroke Stroke
 		err := json.Unmarshal([]byte(data), &stroke)
 		if err != nil {
@@ -81,31 +198,60 @@ func (w *RoomWatcher) watch(roomID int64) {
 			w.es.Close()
 		}
 		// strokes APIには最初はLast-Event-IDをつけずに送るので、これまでに描かれたstrokeが全部降ってくるが、それは無視する。
-		if stroke.CreatedAt.After(startTime) && now.Sub(stroke.CreatedAt) > thresholdResponseTime {
+		if stroke.CreatedAt.After(startTime) && now.Sub(stroke.CreatedAt) > w.threshold {
+			watcherLog.Warn("strokeが届くまでに時間がかかりすぎたので退室します", logger.Fields{
+				"room_id":    roomID,
+				"stroke_id":  stroke.ID,
+				"latency_ms": now.Sub(stroke.CreatedAt).Nanoseconds() / int64(time.Millisecond),
+			})
 			l.Add("strokeが届くまでに時間がかかりすぎています", nil)
 			w.es.Close()
 		}
+		w.mu.Lock()
+		if w.FirstEventTime.IsZero() {
+			w.FirstEventTime = now
+		}
+		// 入室前のstrokeは毎回降ってくるので、入室してから描かれたものだけ重複を調べる
+		if stroke.CreatedAt.After(startTime) {
+			if w.seenStrokes[stroke.ID] {
+				w.duplicateStrokes++
+				w.mu.Unlock()
+				watcherLog.Warn("同じstrokeが2回届きました", logger.Fields{"room_id": roomID, "stroke_id": stroke.ID})
+				l.Add("同じstrokeが2回以上届きました", nil)
+				return
+			}
+			w.seenStrokes[stroke.ID] = true
+		}
 		w.StrokeLogs = append(w.StrokeLogs, StrokeLog{
 			ReceivedTime: now,
 			Stroke:       stroke,
 		})
+		w.mu.Unlock()
 	})
 	w.es.On("bad_request", func(data string) {
 		l.Add("bad_request: "+data, nil)
 		w.es.Close()
 	})
 	w.es.On("watcher_count", func(data string) {
-		now := time.Now()
+		now := w.now()
 		count, err := strconv.Atoi(data)
 		if err != nil {
 			l.Add("watcher_countがパースできませんでした "+data, err)
+			return
 		}
+		w.mu.Lock()
 		w.WatcherCountLogs = append(w.WatcherCountLogs, WatcherCountLog{
 			ReceivedTime: now,
 			Count:        count,
 		})
+		w.mu.Unlock()
 	})
 	w.es.OnError(func(err error) {
+		if _, ok := err.(*sse.ClosedByServer); ok {
+			// 部屋が閉じられたときはエラーにせず、そのまま退室する
+			watcherLog.Info("部屋が閉じられました", logger.Fields{"room_id": roomID})
+			return
+		}
 		if e, ok := err.(*sse.BadContentType); ok {
 			l.Add("Content-Typeが正しくありません: "+e.ContentType, err)
 			return
@@ -115,8 +261,22 @@ func (w *RoomWatcher) watch(roomID int64) {
 			w.es.Close()
 			return
 		}
+		if _, ok := err.(*sse.ConnectTimeout); ok {
+			// 他のリクエストのタイムアウトと同じく、1回では問題にしない
+			l.Minor(fails.Msg(fails.MsgRequestTimeout), err)
+			return
+		}
+		watcherLog.Warn("streamでエラーが起きました", logger.Fields{"room_id": roomID, "error": err})
 		l.Add("リクエストに失敗しました", err)
 	})
+	w.es.OnOpen(func() {
+		w.mu.Lock()
+		if w.openTime.IsZero() {
+			w.openTime = w.now()
+		}
+		w.mu.Unlock()
+		w.markReady(nil)
+	})
 	w.es.OnEnd(func() {
 		w.finalize()
 	})
@@ -124,15 +284,220 @@ func (w *RoomWatcher) watch(roomID int64) {
 	w.es.Open()
 }
 
-// Watcherを部屋から退出させるために呼ぶ。Leaveを呼ばれたらWatcher内部でクリーンアップ処理などをし、EndChに通知が行く
+// Watcherを部屋から退出させるために呼ぶ。Leaveを呼ばれたらWatcher内部でクリーンアップ処理などをし、EndChがcloseされる
 func (w *RoomWatcher) Leave() {
+	w.mu.Lock()
+	if !w.isLeft {
+		close(w.leftCh)
+	}
 	w.isLeft = true
-	if w.es != nil {
-		w.es.Close()
+	es := w.es
+	w.mu.Unlock()
+
+	if es != nil {
+		es.Close()
+	}
+}
+
+func (w *RoomWatcher) left() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.isLeft
+}
+
+// これまでに受け取ったstrokeのコピーを返す
+func (w *RoomWatcher) GetStrokeLogs() []StrokeLog {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]StrokeLog(nil), w.StrokeLogs...)
+}
+
+// TimeToFirstEventでstrokeをまだ1つも受け取っていないときに返す値
+const NoFirstEvent time.Duration = -1
+
+// streamを開いてから最初のstrokeを受け取るまでの時間を返す。まだ受け取っていなければNoFirstEventを返す
+func (w *RoomWatcher) TimeToFirstEvent() time.Duration {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.FirstEventTime.IsZero() || w.startTime.IsZero() {
+		return NoFirstEvent
+	}
+	return w.FirstEventTime.Sub(w.startTime)
+}
+
+// これまでに受け取ったイベントの数を種類ごとに返す
+func (w *RoomWatcher) GetEventCounts() map[string]int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	counts := make(map[string]int, len(w.eventCounts))
+	for event, n := range w.eventCounts {
+		counts[event] = n
+	}
+	return counts
+}
+
+// 入室してから描かれたstrokeが2回以上届いた回数を返す。重複したものはStrokeLogsには入らない
+func (w *RoomWatcher) GetDuplicateStrokes() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.duplicateStrokes
+}
+
+// 入室してから描かれたstrokeが届くまでにかかった時間の分布を返す。入室前のstrokeは無視する
+func (w *RoomWatcher) LatencyStats() (p50, p95, p99, max time.Duration) {
+	w.mu.Lock()
+	latencies := make([]time.Duration, 0, len(w.StrokeLogs))
+	for _, log := range w.StrokeLogs {
+		if log.CreatedAt.After(w.startTime) {
+			latencies = append(latencies, log.ReceivedTime.Sub(log.CreatedAt))
+		}
+	}
+	w.mu.Unlock()
+
+	if len(latencies) == 0 {
+		return 0, 0, 0, 0
 	}
+	sort.Sort(durations(latencies))
+	return percentile(latencies, 0.50), percentile(latencies, 0.95), percentile(latencies, 0.99), latencies[len(latencies)-1]
 }
 
+type durations []time.Duration
+
+func (d durations) Len() int           { return len(d) }
+func (d durations) Less(i, j int) bool { return d[i] < d[j] }
+func (d durations) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+
+// sortedはソート済みであること
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	i := int(math.Ceil(p*float64(len(sorted)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
+}
+
+// tより前にストリームがつながっていたか
+func (w *RoomWatcher) openedBefore(t time.Time) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return !w.openTime.IsZero() && w.openTime.Before(t)
+}
+
+// これまでに受け取ったwatcher_countのコピーを返す
+func (w *RoomWatcher) GetWatcherCountLogs() []WatcherCountLog {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]WatcherCountLog(nil), w.WatcherCountLogs...)
+}
+
+// 部屋にいる間にPOSTされ、thresholdまでに届くはずだったstrokeのうち、届かなかったもののIDを返す
+// postTimesはPOSTしたstrokeのIDとPOSTした時刻。退室した後に呼ぶこと
+func (w *RoomWatcher) missingStrokes(postTimes map[int64]time.Time) []int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.openTime.IsZero() || w.endTime.IsZero() {
+		// streamに繋がらなかった。接続のエラーは別に記録しているので、届かなかったとは数えない
+		return nil
+	}
+
+	received := make(map[int64]bool, len(w.StrokeLogs))
+	for _, log := range w.StrokeLogs {
+		received[log.ID] = true
+	}
+
+	missing := []int64{}
+	for id, postTime := range postTimes {
+		if !w.shouldReceive(postTime) {
+			continue
+		}
+		if !received[id] {
+			missing = append(missing, id)
+		}
+	}
+	return missing
+}
+
+// postTimeにPOSTされたstrokeが、streamに繋がってから退室するまでの間にthresholdまでに届くはずだったかどうか
+// w.muをロックしてから呼ぶこと
+func (w *RoomWatcher) shouldReceive(postTime time.Time) bool {
+	return !postTime.Before(w.openTime) && !postTime.Add(w.threshold).After(w.endTime)
+}
+
+// 部屋にいる間にPOSTされ、thresholdまでに届くはずだったstrokeの数と、そのうち実際に届いたものがPOSTから届くまでにかかった時間を返す
+// postTimesはPOSTしたstrokeのIDとPOSTした時刻。退室した後に呼ぶこと
+func (w *RoomWatcher) deliveryLatencies(postTimes map[int64]time.Time) (expected int, latencies []time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.openTime.IsZero() || w.endTime.IsZero() {
+		// streamに繋がらなかった。接続のエラーは別に記録しているので、届かなかったとは数えない
+		return 0, nil
+	}
+
+	for _, postTime := range postTimes {
+		if w.shouldReceive(postTime) {
+			expected++
+		}
+	}
+	for _, log := range w.StrokeLogs {
+		postTime, ok := postTimes[log.ID]
+		if !ok || !w.shouldReceive(postTime) {
+			continue
+		}
+		latencies = append(latencies, log.ReceivedTime.Sub(postTime))
+	}
+	return expected, latencies
+}
+
+// streamに初めて繋がったらnilを、繋がらずに退室したらその理由を送るチャンネルを返す
+// strokeを描き始める前にこれを待てば、入室前に描いたstrokeとして扱われることがない
+func (w *RoomWatcher) Ready() <-chan error {
+	ch := make(chan error, 1)
+	go func() {
+		<-w.readyCh
+		ch <- w.readyErr
+	}()
+	return ch
+}
+
+// 2回目以降は何もしない
+func (w *RoomWatcher) markReady(err error) {
+	w.readyOnce.Do(func() {
+		w.readyErr = err
+		close(w.readyCh)
+	})
+}
+
+// 入室できなかった場合も含めて、退室するときに必ず呼ぶ。何回呼ばれても2回目以降は何もしない
 func (w *RoomWatcher) finalize() {
-	w.s.Bye()
-	w.EndCh <- struct{}{}
+	// streamに繋がる前に退室した
+	w.markReady(errors.New("streamに接続する前に退室しました"))
+
+	w.endOnce.Do(func() {
+		w.mu.Lock()
+		w.endTime = w.now()
+		strokes := len(w.StrokeLogs)
+		w.mu.Unlock()
+
+		watcherLog.Info("退室しました", logger.Fields{"room_id": w.roomID, "strokes": strokes})
+
+		w.s.Bye()
+		close(w.EndCh)
+	})
+}
+
+// 退室し終えるまで待つ
+func (w *RoomWatcher) Wait() {
+	<-w.EndCh
+}
+
+// 既に退室し終えていればtrueを返す
+func (w *RoomWatcher) Ended() bool {
+	select {
+	case <-w.EndCh:
+		return true
+	default:
+		return false
+	}
 }
@@ -0,0 +1,622 @@
+package scenario
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/isucon/isucon6-final/bench/fails"
+	"github.com/isucon/isucon6-final/bench/http"
+	"github.com/isucon/isucon6-final/bench/http/httptest"
+	"github.com/isucon/isucon6-final/bench/sse"
+)
+
+// /rooms/{id} でCSRFトークンを返し、/api/stream/rooms/{id} でstreamを返すサーバー
+func newRoomServer(stream func(w http.ResponseWriter, r *http.Request)) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/rooms/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `<html data-csrf-token="token"><body></body></html>`)
+	})
+	mux.HandleFunc("/api/stream/rooms/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		stream(w, r)
+	})
+	return httptest.NewServer(mux)
+}
+
+func strokeEvent(id int64, createdAt string) string {
+	return fmt.Sprintf("id: %d\nevent: stroke\ndata: {\"id\":%d,\"room_id\":1,\"created_at\":\"%s\",\"points\":[]}\n\n", id, id, createdAt)
+}
+
+func TestRoomWatcherConcurrentLogs(t *testing.T) {
+	ts := newRoomServer(func(w http.ResponseWriter, r *http.Request) {
+		for i := int64(1); i <= 100; i++ {
+			fmt.Fprint(w, strokeEvent(i, "2016-10-22T10:00:00Z"))
+			fmt.Fprintf(w, "event: watcher_count\ndata: %d\n\n", i)
+			w.(http.Flusher).Flush()
+		}
+		fmt.Fprint(w, "event: bad_request\ndata: done\n\n")
+	})
+	defer ts.Close()
+
+	w := NewRoomWatcher(ts.URL, 1)
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+					w.GetStrokeLogs()
+					w.GetWatcherCountLogs()
+				}
+			}
+		}()
+	}
+
+	<-w.EndCh
+	close(done)
+	wg.Wait()
+
+	if n := len(w.GetStrokeLogs()); n != 100 {
+		t.Errorf("want %d, got %d", 100, n)
+	}
+	if n := len(w.GetWatcherCountLogs()); n != 100 {
+		t.Errorf("want %d, got %d", 100, n)
+	}
+}
+
+func TestRoomWatcherThreshold(t *testing.T) {
+	ts := newRoomServer(func(w http.ResponseWriter, r *http.Request) {
+		createdAt := time.Now().UTC().Format(time.RFC3339Nano)
+		w.(http.Flusher).Flush()
+		time.Sleep(300 * time.Millisecond)
+		fmt.Fprint(w, strokeEvent(1, createdAt))
+		w.(http.Flusher).Flush()
+		<-w.(http.CloseNotifier).CloseNotify()
+	})
+	defer ts.Close()
+
+	w := NewRoomWatcherWithThreshold(ts.URL, 1, 100*time.Millisecond)
+
+	select {
+	case <-w.EndCh:
+	case <-time.After(3 * time.Second):
+		w.Leave()
+		t.Fatalf("the watcher did not leave on a late stroke")
+	}
+}
+
+func TestRoomWatcherWatcherCount(t *testing.T) {
+	ts := newRoomServer(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "event: watcher_count\ndata: 1\n\n")
+		fmt.Fprint(w, "event: watcher_count\ndata: 3\n\n")
+		fmt.Fprint(w, "event: watcher_count\ndata: abc\n\n")
+		fmt.Fprint(w, "event: watcher_count\ndata: 2\n\n")
+		fmt.Fprint(w, "event: bad_request\ndata: done\n\n")
+	})
+	defer ts.Close()
+
+	w := NewRoomWatcher(ts.URL, 1)
+	<-w.EndCh
+
+	counts := []int{}
+	for _, log := range w.GetWatcherCountLogs() {
+		counts = append(counts, log.Count)
+	}
+	if want := []int{1, 3, 2}; !reflect.DeepEqual(counts, want) {
+		t.Errorf("want %v, got %v", want, counts)
+	}
+}
+
+func TestRoomWatcherLatencyStats(t *testing.T) {
+	startTime := time.Now()
+	w := &RoomWatcher{startTime: startTime}
+
+	p50, p95, p99, max := w.LatencyStats()
+	if p50 != 0 || p95 != 0 || p99 != 0 || max != 0 {
+		t.Errorf("want zeros, got %s %s %s %s", p50, p95, p99, max)
+	}
+
+	// 入室前に描かれたstrokeは無視される
+	w.StrokeLogs = append(w.StrokeLogs, StrokeLog{
+		ReceivedTime: startTime.Add(time.Second),
+		Stroke:       Stroke{CreatedAt: startTime.Add(-time.Hour)},
+	})
+	for i := 100; i >= 1; i-- {
+		createdAt := startTime.Add(time.Duration(i) * time.Second)
+		w.StrokeLogs = append(w.StrokeLogs, StrokeLog{
+			ReceivedTime: createdAt.Add(time.Duration(i) * time.Millisecond),
+			Stroke:       Stroke{CreatedAt: createdAt},
+		})
+	}
+
+	p50, p95, p99, max = w.LatencyStats()
+	if p50 != 50*time.Millisecond {
+		t.Errorf("want %s, got %s", 50*time.Millisecond, p50)
+	}
+	if p95 != 95*time.Millisecond {
+		t.Errorf("want %s, got %s", 95*time.Millisecond, p95)
+	}
+	if p99 != 99*time.Millisecond {
+		t.Errorf("want %s, got %s", 99*time.Millisecond, p99)
+	}
+	if max != 100*time.Millisecond {
+		t.Errorf("want %s, got %s", 100*time.Millisecond, max)
+	}
+}
+
+func TestCheckStrokeDelivery(t *testing.T) {
+	startTime := time.Now()
+	endTime := startTime.Add(time.Minute)
+	postTime := startTime.Add(time.Second)
+
+	received := &RoomWatcher{startTime: startTime, openTime: startTime, endTime: endTime, threshold: 5 * time.Second}
+	received.StrokeLogs = append(received.StrokeLogs, StrokeLog{
+		ReceivedTime: postTime.Add(100 * time.Millisecond),
+		Stroke:       Stroke{ID: 1, CreatedAt: postTime},
+	})
+	notReceived := &RoomWatcher{startTime: startTime, openTime: startTime, endTime: endTime, threshold: 5 * time.Second}
+	// POSTより後に入室したwatcherには届かなくてよい
+	lateComer := &RoomWatcher{startTime: postTime.Add(time.Second), openTime: postTime.Add(time.Second), endTime: endTime, threshold: 5 * time.Second}
+	// streamに繋がらなかったwatcherは、接続のエラーとは別に届かなかったとは数えない
+	neverOpened := &RoomWatcher{startTime: startTime, endTime: endTime, threshold: 5 * time.Second}
+
+	posted := map[int64]PostedStroke{1: {Stroke: Stroke{ID: 1}, PostTime: postTime}}
+
+	n := len(fails.Get())
+	_, b := ComputeScore([]*RoomWatcher{received, lateComer, neverOpened}, posted)
+	if b.Missing != 0 {
+		t.Errorf("want %d, got %d", 0, b.Missing)
+	}
+	checkStrokeDelivery(b)
+	if len(fails.Get()) != n {
+		t.Errorf("want no messages, got %v", fails.Get()[n:])
+	}
+
+	_, b = ComputeScore([]*RoomWatcher{received, notReceived}, posted)
+	if b.Missing != 1 {
+		t.Errorf("want %d, got %d", 1, b.Missing)
+	}
+	checkStrokeDelivery(b)
+	if len(fails.Get()) != n+1 {
+		t.Errorf("want %d messages, got %d", n+1, len(fails.Get()))
+	}
+}
+
+func TestRoomWatcherReconnect(t *testing.T) {
+	var (
+		mu           sync.Mutex
+		requests     int
+		lastEventIDs []string
+	)
+	ts := newRoomServer(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		n := requests
+		lastEventIDs = append(lastEventIDs, r.Header.Get("Last-Event-ID"))
+		mu.Unlock()
+
+		fmt.Fprint(w, "retry: 100\n\n")
+		if n == 1 {
+			fmt.Fprint(w, strokeEvent(1, "2016-10-22T10:00:00Z"))
+			w.(http.Flusher).Flush()
+			// 1回目は途中で接続を切る
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+		fmt.Fprint(w, strokeEvent(2, "2016-10-22T10:00:00Z"))
+		fmt.Fprint(w, "event: bad_request\ndata: done\n\n")
+	})
+	defer ts.Close()
+
+	w := NewRoomWatcher(ts.URL, 1)
+	select {
+	case <-w.EndCh:
+	case <-time.After(5 * time.Second):
+		w.Leave()
+		t.Fatal("the watcher did not finish")
+	}
+
+	ids := []int64{}
+	for _, log := range w.GetStrokeLogs() {
+		ids = append(ids, log.ID)
+	}
+	if want := []int64{1, 2}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("want %v, got %v", want, ids)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if want := []string{"", "1"}; !reflect.DeepEqual(lastEventIDs, want) {
+		t.Errorf("want %q, got %q", want, lastEventIDs)
+	}
+}
+
+func TestRoomWatcherDuplicateStrokes(t *testing.T) {
+	ts := newRoomServer(func(w http.ResponseWriter, r *http.Request) {
+		createdAt := time.Now().UTC().Format(time.RFC3339Nano)
+		// 入室前に描かれたstrokeは重複していても数えない
+		fmt.Fprint(w, strokeEvent(1, "2016-10-22T10:00:00Z"))
+		fmt.Fprint(w, strokeEvent(1, "2016-10-22T10:00:00Z"))
+		fmt.Fprint(w, strokeEvent(2, createdAt))
+		fmt.Fprint(w, strokeEvent(2, createdAt))
+		fmt.Fprint(w, strokeEvent(3, createdAt))
+		fmt.Fprint(w, "event: bad_request\ndata: done\n\n")
+	})
+	defer ts.Close()
+
+	n := len(fails.Get())
+
+	w := NewRoomWatcher(ts.URL, 1)
+	<-w.EndCh
+
+	if d := w.GetDuplicateStrokes(); d != 1 {
+		t.Errorf("want %d, got %d", 1, d)
+	}
+
+	ids := []int64{}
+	for _, log := range w.GetStrokeLogs() {
+		ids = append(ids, log.ID)
+	}
+	if want := []int64{1, 1, 2, 3}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("want %v, got %v", want, ids)
+	}
+
+	found := false
+	for _, msg := range fails.Get()[n:] {
+		if strings.Contains(msg, "同じstrokeが2回以上届きました") {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("want a duplicate message, got %q", fails.Get()[n:])
+	}
+}
+
+func TestRoomWatcherTimeToFirstEvent(t *testing.T) {
+	delay := 300 * time.Millisecond
+	ts := newRoomServer(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "event: watcher_count\ndata: 1\n\n")
+		w.(http.Flusher).Flush()
+		time.Sleep(delay)
+		fmt.Fprint(w, strokeEvent(1, "2016-10-22T10:00:00Z"))
+		fmt.Fprint(w, strokeEvent(2, "2016-10-22T10:00:00Z"))
+		fmt.Fprint(w, "event: bad_request\ndata: done\n\n")
+	})
+	defer ts.Close()
+
+	w := NewRoomWatcher(ts.URL, 1)
+	<-w.EndCh
+
+	// watcher_countは最初のイベントとして数えない
+	if d := w.TimeToFirstEvent(); d < delay || d > delay+time.Second {
+		t.Errorf("want about %s, got %s", delay, d)
+	}
+
+	empty := &RoomWatcher{startTime: time.Now()}
+	if d := empty.TimeToFirstEvent(); d != NoFirstEvent {
+		t.Errorf("want %s, got %s", NoFirstEvent, d)
+	}
+}
+
+func TestRoomWatcherDelayed(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		requests int
+	)
+	ts := newRoomServer(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "event: bad_request\ndata: done\n\n")
+	})
+	defer ts.Close()
+	counted := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		mu.Unlock()
+		ts.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer counted.Close()
+
+	// 待っている間にLeaveされたら接続しない
+	w := NewRoomWatcherDelayed(counted.URL, 1, time.Second)
+	w.Leave()
+	select {
+	case <-w.EndCh:
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("the watcher did not finish soon after leaving")
+	}
+
+	// ばらして入室させても全員入室できる
+	watchers := NewRoomWatchersStaggered(counted.URL, 1, 3, 300*time.Millisecond)
+	if len(watchers) != 3 {
+		t.Fatalf("want %d, got %d", 3, len(watchers))
+	}
+	for _, w := range watchers {
+		<-w.EndCh
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	// 入室するとCSRFトークンとstreamで2回ずつリクエストする
+	if requests != 6 {
+		t.Errorf("want %d, got %d", 6, requests)
+	}
+}
+
+func TestRoomWatcherRoomClosed(t *testing.T) {
+	ts := newRoomServer(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	defer ts.Close()
+
+	n := len(fails.Get())
+
+	w := NewRoomWatcher(ts.URL, 1)
+	select {
+	case <-w.EndCh:
+	case <-time.After(3 * time.Second):
+		w.Leave()
+		t.Fatal("the watcher did not leave the closed room")
+	}
+
+	if len(fails.Get()) != n {
+		t.Errorf("want no messages, got %q", fails.Get()[n:])
+	}
+}
+
+// 記録しておいたstreamをrから読ませるwatcher。nowで時計を差し替える
+func newReplayRoomWatcher(r io.Reader, roomID int64, threshold time.Duration, now func() time.Time) *RoomWatcher {
+	w := newRoomWatcher("http://127.0.0.1", roomID, threshold)
+	w.now = now
+	l := &fails.Logger{Prefix: fmt.Sprintf("[/api/stream/rooms/%d] ", roomID)}
+	go w.stream(sse.NewEventSourceFromReader(r), roomID, now(), l)
+	return w
+}
+
+// 呼ばれるたびにstepずつ進む時計
+func steppingClock(start time.Time, step time.Duration) func() time.Time {
+	var mu sync.Mutex
+	t := start.Add(-step)
+	return func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		t = t.Add(step)
+		return t
+	}
+}
+
+func TestRoomWatcherReplay(t *testing.T) {
+	start := time.Date(2016, 10, 22, 10, 0, 0, 0, time.UTC)
+
+	replay := func(threshold time.Duration) *RoomWatcher {
+		f, err := os.Open("testdata/room_stream.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+
+		// 入室, 接続, stroke 1, watcher_count, stroke 2, stroke 3, 退室の順に0.5秒ずつ進む
+		w := newReplayRoomWatcher(f, 1, threshold, steppingClock(start, 500*time.Millisecond))
+		select {
+		case <-w.EndCh:
+		case <-time.After(3 * time.Second):
+			w.Leave()
+			t.Fatal("the replay did not finish")
+		}
+		return w
+	}
+
+	w := replay(thresholdResponseTime)
+
+	logs := w.GetStrokeLogs()
+	want := []struct {
+		id       int64
+		received time.Time
+	}{
+		{1, start.Add(1000 * time.Millisecond)},
+		{2, start.Add(2000 * time.Millisecond)},
+		{3, start.Add(2500 * time.Millisecond)},
+	}
+	if len(logs) != len(want) {
+		t.Fatalf("want %d, got %d", len(want), len(logs))
+	}
+	for i, log := range logs {
+		if log.ID != want[i].id || !log.ReceivedTime.Equal(want[i].received) {
+			t.Errorf("want %d at %s, got %d at %s", want[i].id, want[i].received, log.ID, log.ReceivedTime)
+		}
+	}
+	if len(logs[0].Points) != 1 || logs[0].Points[0].X != 10 {
+		t.Errorf("unexpected points: %+v", logs[0].Points)
+	}
+
+	if counts := w.GetWatcherCountLogs(); len(counts) != 1 || counts[0].Count != 3 {
+		t.Errorf("want one watcher_count of 3, got %+v", counts)
+	}
+	if d := w.TimeToFirstEvent(); d != time.Second {
+		t.Errorf("want %s, got %s", time.Second, d)
+	}
+	if p50, _, _, max := w.LatencyStats(); p50 != 1900*time.Millisecond || max != 2300*time.Millisecond {
+		t.Errorf("want %s %s, got %s %s", 1900*time.Millisecond, 2300*time.Millisecond, p50, max)
+	}
+
+	// 同じstreamでも、thresholdを短くすれば遅すぎるstrokeとして記録される
+	n := len(fails.Get())
+	replay(time.Second)
+	found := false
+	for _, msg := range fails.Get()[n:] {
+		if strings.Contains(msg, "strokeが届くまでに時間がかかりすぎています") {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("want a message about the late stroke, got %q", fails.Get()[n:])
+	}
+}
+
+func TestRoomWatcherEndSignal(t *testing.T) {
+	wait := func(w *RoomWatcher) {
+		done := make(chan struct{})
+		go func() {
+			w.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(3 * time.Second):
+			w.Leave()
+			t.Fatal("the watcher did not end")
+		}
+	}
+
+	// CSRFトークンが取れずに入室できなかった
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "error", http.StatusInternalServerError)
+	}))
+	defer ts.Close()
+
+	n := len(fails.Get())
+	w := NewRoomWatcher(ts.URL, 1)
+	wait(w)
+	if !w.Ended() {
+		t.Errorf("the watcher should have ended")
+	}
+	if msgs := fails.Get()[n:]; len(msgs) == 0 || !strings.Contains(msgs[len(msgs)-1], "CSRFトークンが取得できなかった") {
+		t.Errorf("want a message about the CSRF token, got %q", msgs)
+	}
+	// 後からLeaveしたりもう一度finalizeされたりしても、詰まったりpanicしたりしない
+	w.Leave()
+	w.finalize()
+	wait(w)
+
+	// streamが終わって普通に退室した
+	w = newReplayRoomWatcher(strings.NewReader(strokeEvent(1, "2016-10-22T10:00:00Z")), 1, thresholdResponseTime, time.Now)
+	wait(w)
+	if !w.Ended() {
+		t.Errorf("the watcher should have ended")
+	}
+	w.Leave()
+	w.finalize()
+	wait(w)
+
+	// 入室する前にLeaveされた
+	w = NewRoomWatcherDelayed(ts.URL, 1, time.Hour)
+	if w.Ended() {
+		t.Errorf("the watcher should not have ended yet")
+	}
+	w.Leave()
+	wait(w)
+}
+
+func TestRoomWatcherEventCounts(t *testing.T) {
+	stream := strokeEvent(1, "2016-10-22T10:00:00Z") +
+		"event: watcher_count\ndata: 2\n\n" +
+		strokeEvent(2, "2016-10-22T10:00:01Z") +
+		"event: watcher_count\ndata: 3\n\n" +
+		"event: unknown\ndata: ?\n\n" +
+		"data: no event type\n\n" +
+		"event: bad_request\ndata: done\n\n"
+
+	w := newReplayRoomWatcher(strings.NewReader(stream), 1, thresholdResponseTime, time.Now)
+	select {
+	case <-w.EndCh:
+	case <-time.After(3 * time.Second):
+		w.Leave()
+		t.Fatal("the replay did not finish")
+	}
+
+	want := map[string]int{
+		"stroke":        2,
+		"watcher_count": 2,
+		"unknown":       1,
+		"message":       1,
+		"bad_request":   1,
+	}
+	if got := w.GetEventCounts(); !reflect.DeepEqual(got, want) {
+		t.Errorf("want %v, got %v", want, got)
+	}
+}
+
+func TestRoomWatcherReady(t *testing.T) {
+	strokes := make(chan string)
+	var (
+		mu          sync.Mutex
+		connectedAt time.Time
+	)
+	ts := newRoomServer(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		connectedAt = time.Now()
+		mu.Unlock()
+		w.(http.Flusher).Flush()
+		for {
+			select {
+			case s, ok := <-strokes:
+				if !ok {
+					fmt.Fprint(w, "event: bad_request\ndata: done\n\n")
+					return
+				}
+				fmt.Fprint(w, s)
+				w.(http.Flusher).Flush()
+			case <-time.After(3 * time.Second):
+				return
+			}
+		}
+	})
+	defer ts.Close()
+
+	w := NewRoomWatcher(ts.URL, 1)
+	select {
+	case err := <-w.Ready():
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	case <-time.After(3 * time.Second):
+		w.Leave()
+		t.Fatal("the watcher did not get ready")
+	}
+
+	// 繋がってから描いたstrokeは取りこぼさない
+	postedAt := time.Now()
+	mu.Lock()
+	if connectedAt.IsZero() || connectedAt.After(postedAt) {
+		t.Errorf("ready before connecting: connected at %s, posted at %s", connectedAt, postedAt)
+	}
+	mu.Unlock()
+	strokes <- strokeEvent(1, postedAt.UTC().Format(time.RFC3339Nano))
+	close(strokes)
+	w.Wait()
+
+	if logs := w.GetStrokeLogs(); len(logs) != 1 || logs[0].ID != 1 {
+		t.Errorf("want stroke 1, got %+v", logs)
+	}
+	// 何度呼んでも同じ結果になる
+	if err := <-w.Ready(); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	// 繋がらなければエラーが届く
+	es := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "error", http.StatusInternalServerError)
+	}))
+	defer es.Close()
+	w = NewRoomWatcher(es.URL, 1)
+	select {
+	case err := <-w.Ready():
+		if err == nil {
+			t.Errorf("want an error, got nil")
+		}
+	case <-time.After(3 * time.Second):
+		w.Leave()
+		t.Fatal("the watcher did not report the error")
+	}
+}
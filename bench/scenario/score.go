@@ -0,0 +1,119 @@
+package scenario
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/isucon/isucon6-final/bench/fails"
+)
+
+const (
+	// POSTしてからこの時間までに届いたstrokeだけ StrokeReceiveScore を加点する
+	strokeOnTimeThreshold = 2 * time.Second
+
+	// 中身が違うstrokeが届いたら1つごとに減点する
+	StrokeErrorPenalty int64 = 10
+	// 部屋にいたのに届かなかったstrokeは1つごとに減点する
+	StrokeMissingPenalty int64 = 1
+)
+
+// POSTしたstrokeと、POSTした時刻
+type PostedStroke struct {
+	Stroke
+	PostTime time.Time
+}
+
+// ComputeScoreで数えたstrokeの内訳。ベンチマーカーの結果に含めてポータルに送る
+type ScoreBreakdown struct {
+	Posted   int `json:"posted"`  // POSTしたstrokeの数
+	OnTime   int `json:"on_time"` // strokeOnTimeThresholdまでに届いた数。これだけが加点される
+	Late     int `json:"late"`    // 届いたが遅すぎた数
+	Wrong    int `json:"wrong"`   // POSTしたものと中身が違った数
+	Unknown  int `json:"unknown"` // POSTの結果を受け取れなかったstrokeのIDの数。サーバーには保存されていて届くことがある
+	Missing  int `json:"missing"` // 部屋にいたのに届かなかった数
+	Watchers int `json:"watchers"`
+}
+
+func (b *ScoreBreakdown) add(other ScoreBreakdown) {
+	b.Posted += other.Posted
+	b.OnTime += other.OnTime
+	b.Late += other.Late
+	b.Wrong += other.Wrong
+	b.Unknown += other.Unknown
+	b.Missing += other.Missing
+	b.Watchers += other.Watchers
+}
+
+// 退室し終えたwatchersが受け取ったstrokeを、postedと突き合わせて点数をつける
+// POSTした数だけでなく、中身とPOSTした時刻まで比べるので、strokeのIDごとにPOSTしたものを渡す
+// 時間内に届いたものを加点し、間違ったものと届かなかったものを減点する。遅れて届いたものは加点も減点もしない
+// postedに無いstrokeは、POSTがタイムアウトしただけでサーバーには保存されていることがあるので減点しない
+// 減点で0未満にはしない
+func ComputeScore(watchers []*RoomWatcher, posted map[int64]PostedStroke) (int64, ScoreBreakdown) {
+	b := ScoreBreakdown{Posted: len(posted), Watchers: len(watchers)}
+
+	unknownIDs := make(map[int64]struct{})
+	postTimes := make(map[int64]time.Time, len(posted))
+	for id, p := range posted {
+		postTimes[id] = p.PostTime
+	}
+
+	for _, w := range watchers {
+		for _, strokeLog := range w.GetStrokeLogs() {
+			p, ok := posted[strokeLog.Stroke.ID]
+			if !ok {
+				unknownIDs[strokeLog.Stroke.ID] = struct{}{}
+				continue
+			}
+			if len(p.Points) != len(strokeLog.Points) {
+				b.Wrong++
+				continue
+			}
+			if strokeLog.ReceivedTime.Sub(p.PostTime) < strokeOnTimeThreshold {
+				b.OnTime++
+			} else {
+				// 5秒以上かかった場合はそこで退室したはず
+				b.Late++
+			}
+		}
+		b.Missing += len(w.missingStrokes(postTimes))
+	}
+	b.Unknown = len(unknownIDs)
+
+	score := int64(b.OnTime)*StrokeReceiveScore -
+		int64(b.Wrong)*StrokeErrorPenalty -
+		int64(b.Missing)*StrokeMissingPenalty
+	if score < 0 {
+		score = 0
+	}
+	return score, b
+}
+
+// 間違ったstrokeや届かなかったstrokeがあればエラーとして記録する
+func checkStrokeDelivery(b ScoreBreakdown) {
+	if b.Wrong > 0 {
+		fails.Add(fmt.Sprintf("streamされたstrokeが間違っています (%d件)", b.Wrong), nil)
+	}
+	if b.Missing > 0 {
+		fails.Add(fmt.Sprintf("streamされるはずのstrokeが%d件届いていません", b.Missing), nil)
+	}
+}
+
+var (
+	totalBreakdown ScoreBreakdown
+	muBreakdown    sync.Mutex
+)
+
+func addScoreBreakdown(b ScoreBreakdown) {
+	muBreakdown.Lock()
+	totalBreakdown.add(b)
+	muBreakdown.Unlock()
+}
+
+// これまでに終わったMatsuriのstrokeの内訳を合計して返す
+func GetScoreBreakdown() ScoreBreakdown {
+	muBreakdown.Lock()
+	defer muBreakdown.Unlock()
+	return totalBreakdown
+}
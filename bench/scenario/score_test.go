@@ -0,0 +1,86 @@
+package scenario
+
+import (
+	"testing"
+	"time"
+)
+
+func TestComputeScore(t *testing.T) {
+	startTime := time.Now()
+	endTime := startTime.Add(time.Minute)
+	threshold := 5 * time.Second
+
+	// 3つPOSTした。どれも点は2つ
+	posted := map[int64]PostedStroke{}
+	for id := int64(1); id <= 3; id++ {
+		posted[id] = PostedStroke{
+			Stroke:   Stroke{ID: id, Points: make([]Point, 2)},
+			PostTime: startTime.Add(time.Duration(id) * time.Second),
+		}
+	}
+
+	receive := func(w *RoomWatcher, id int64, points int, latency time.Duration) {
+		w.StrokeLogs = append(w.StrokeLogs, StrokeLog{
+			ReceivedTime: posted[id].PostTime.Add(latency),
+			Stroke:       Stroke{ID: id, Points: make([]Point, points)},
+		})
+	}
+	newWatcher := func() *RoomWatcher {
+		return &RoomWatcher{roomID: 1, startTime: startTime, openTime: startTime, endTime: endTime, threshold: threshold}
+	}
+
+	// 8人は全部すぐに受け取った
+	watchers := []*RoomWatcher{}
+	for i := 0; i < 8; i++ {
+		w := newWatcher()
+		receive(w, 1, 2, 100*time.Millisecond)
+		receive(w, 2, 2, 100*time.Millisecond)
+		receive(w, 3, 2, 1999*time.Millisecond)
+		watchers = append(watchers, w)
+	}
+	// 1人は1つが遅れ、1つは中身が違い、1つは届かず、POSTの結果を受け取れなかったものが届いた
+	bad := newWatcher()
+	receive(bad, 1, 2, 2*time.Second)
+	receive(bad, 2, 1, 100*time.Millisecond)
+	bad.StrokeLogs = append(bad.StrokeLogs, StrokeLog{ReceivedTime: startTime, Stroke: Stroke{ID: 100}})
+	watchers = append(watchers, bad)
+
+	score, b := ComputeScore(watchers, posted)
+
+	want := ScoreBreakdown{Posted: 3, OnTime: 24, Late: 1, Wrong: 1, Unknown: 1, Missing: 1, Watchers: 9}
+	if b != want {
+		t.Errorf("want %#v, got %#v", want, b)
+	}
+	// 24点から、間違い1件と届かなかった1件の分を引く
+	if want := 24*StrokeReceiveScore - StrokeErrorPenalty - StrokeMissingPenalty; score != want {
+		t.Errorf("want %d, got %d", want, score)
+	}
+
+	// 同じ入力なら同じ点になる
+	if again, _ := ComputeScore(watchers, posted); again != score {
+		t.Errorf("want %d, got %d", score, again)
+	}
+
+	// POSTがタイムアウトしてもサーバーに保存されていれば全員に届く。IDごとに1件と数え、減点はしない
+	for _, w := range watchers {
+		w.StrokeLogs = append(w.StrokeLogs, StrokeLog{ReceivedTime: endTime, Stroke: Stroke{ID: 200}})
+	}
+	if again, b := ComputeScore(watchers, posted); again != score || b.Unknown != 2 {
+		t.Errorf("want %d (unknown %d), got %d (unknown %d)", score, 2, again, b.Unknown)
+	}
+
+	// 減点で0未満にはならない
+	if score, _ := ComputeScore([]*RoomWatcher{bad}, posted); score != 0 {
+		t.Errorf("want %d, got %d", 0, score)
+	}
+}
+
+func TestScoreBreakdownAdd(t *testing.T) {
+	var total ScoreBreakdown
+	total.add(ScoreBreakdown{Posted: 3, OnTime: 5, Missing: 1, Watchers: 2})
+	total.add(ScoreBreakdown{Posted: 2, OnTime: 1, Late: 1, Wrong: 1, Unknown: 1, Watchers: 1})
+	want := ScoreBreakdown{Posted: 5, OnTime: 6, Late: 1, Wrong: 1, Unknown: 1, Missing: 1, Watchers: 3}
+	if total != want {
+		t.Errorf("want %#v, got %#v", want, total)
+	}
+}
@@ -0,0 +1,115 @@
+package scenario
+
+import (
+	"errors"
+	"sync"
+)
+
+// 複数の部屋にまとめてRoomWatcherを入室させ、まとめて退室させる
+type WatcherPool struct {
+	watchers []*RoomWatcher
+	isLeft   bool
+	mu       sync.Mutex // watchers, isLeftを守る
+
+	sem chan struct{}
+	wg  sync.WaitGroup
+}
+
+// roomIDsの部屋に順番にn人のwatcherを入室させる
+// 同時に接続しようとするwatcherはconcurrency人までで、誰かが繋がるか諦めたら次のwatcherが接続を始める
+// 一度に大量の接続を張ろうとしてベンチマーカー側が詰まらないようにする
+func NewWatcherPool(origins []string, roomIDs []int64, n int, concurrency int) (*WatcherPool, error) {
+	if n < 0 {
+		return nil, errors.New("n must not be negative")
+	}
+	if concurrency <= 0 {
+		return nil, errors.New("concurrency must be positive")
+	}
+	if len(roomIDs) == 0 {
+		return nil, errors.New("roomIDs is empty")
+	}
+
+	p := &WatcherPool{
+		watchers: make([]*RoomWatcher, 0, n),
+		sem:      make(chan struct{}, concurrency),
+	}
+	p.wg.Add(n)
+
+	go func() {
+		for i := 0; i < n; i++ {
+			p.sem <- struct{}{}
+
+			p.mu.Lock()
+			if p.isLeft {
+				p.mu.Unlock()
+				<-p.sem
+				// まだ入室していない分は入室させずに終わる
+				p.wg.Add(-(n - i))
+				return
+			}
+			w := NewRoomWatcher(randomOrigin(origins), roomIDs[i%len(roomIDs)])
+			p.watchers = append(p.watchers, w)
+			p.mu.Unlock()
+
+			go func() {
+				<-w.Ready()
+				<-p.sem
+				w.Wait()
+				p.wg.Done()
+			}()
+		}
+	}()
+
+	return p, nil
+}
+
+// 全員が退室するまで待つ
+func (p *WatcherPool) Wait() {
+	p.wg.Wait()
+}
+
+// 全員を退室させる。まだ入室していないwatcherは入室しない
+func (p *WatcherPool) LeaveAll() {
+	p.mu.Lock()
+	p.isLeft = true
+	watchers := append([]*RoomWatcher(nil), p.watchers...)
+	p.mu.Unlock()
+
+	for _, w := range watchers {
+		w.Leave()
+	}
+}
+
+// 全員が受け取ったstrokeをまとめて返す
+func (p *WatcherPool) GetStrokeLogs() []StrokeLog {
+	logs := []StrokeLog{}
+	for _, w := range p.getWatchers() {
+		logs = append(logs, w.GetStrokeLogs()...)
+	}
+	return logs
+}
+
+// 全員が受け取ったstrokeを部屋ごとにまとめて返す
+func (p *WatcherPool) GetStrokeLogsByRoom() map[int64][]StrokeLog {
+	logs := make(map[int64][]StrokeLog)
+	for _, w := range p.getWatchers() {
+		logs[w.roomID] = append(logs[w.roomID], w.GetStrokeLogs()...)
+	}
+	return logs
+}
+
+// 全員が受け取ったwatcher_countをまとめて返す
+func (p *WatcherPool) GetWatcherCountLogs() []WatcherCountLog {
+	logs := []WatcherCountLog{}
+	for _, w := range p.getWatchers() {
+		logs = append(logs, w.GetWatcherCountLogs()...)
+	}
+	return logs
+}
+
+// これまでに入室したwatcherを返す
+func (p *WatcherPool) getWatchers() []*RoomWatcher {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]*RoomWatcher(nil), p.watchers...)
+}
@@ -0,0 +1,110 @@
+package scenario
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/isucon/isucon6-final/bench/http"
+)
+
+func TestWatcherPool(t *testing.T) {
+	var connecting, maxConnecting, connected, maxConnected int32
+	updateMax := func(max *int32, n int32) {
+		for {
+			m := atomic.LoadInt32(max)
+			if n <= m || atomic.CompareAndSwapInt32(max, m, n) {
+				break
+			}
+		}
+	}
+	ts := newRoomServer(func(w http.ResponseWriter, r *http.Request) {
+		// 繋がるまでに時間がかかるサーバー
+		updateMax(&maxConnecting, atomic.AddInt32(&connecting, 1))
+		time.Sleep(20 * time.Millisecond)
+		atomic.AddInt32(&connecting, -1)
+
+		updateMax(&maxConnected, atomic.AddInt32(&connected, 1))
+		defer atomic.AddInt32(&connected, -1)
+
+		// /api/stream/rooms/{id} の部屋のIDをstrokeのIDにする
+		id, _ := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, "/api/stream/rooms/"), 10, 64)
+		fmt.Fprint(w, strokeEvent(id, "2016-10-22T10:00:00Z"))
+		fmt.Fprint(w, "event: watcher_count\ndata: 1\n\n")
+		w.(http.Flusher).Flush()
+		time.Sleep(300 * time.Millisecond)
+		fmt.Fprint(w, "event: bad_request\ndata: done\n\n")
+	})
+	defer ts.Close()
+
+	p, err := NewWatcherPool([]string{ts.URL}, []int64{1, 2, 3}, 6, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Wait()
+
+	// 同時に接続しようとするのは2人までだが、繋がった後は次のwatcherが入室できる
+	if m := atomic.LoadInt32(&maxConnecting); m > 2 {
+		t.Errorf("want at most %d connection attempts, got %d", 2, m)
+	}
+	if m := atomic.LoadInt32(&maxConnected); m != 6 {
+		t.Errorf("want %d connections, got %d", 6, m)
+	}
+	if n := len(p.GetStrokeLogs()); n != 6 {
+		t.Errorf("want %d, got %d", 6, n)
+	}
+	if n := len(p.GetWatcherCountLogs()); n != 6 {
+		t.Errorf("want %d, got %d", 6, n)
+	}
+	for roomID, logs := range p.GetStrokeLogsByRoom() {
+		if len(logs) != 2 {
+			t.Errorf("room %d: want %d, got %d", roomID, 2, len(logs))
+		}
+		for _, log := range logs {
+			if log.ID != roomID {
+				t.Errorf("room %d: got a stroke %d", roomID, log.ID)
+			}
+		}
+	}
+}
+
+func TestNewWatcherPoolInvalid(t *testing.T) {
+	if _, err := NewWatcherPool([]string{"http://127.0.0.1"}, []int64{1}, 1, 0); err == nil {
+		t.Errorf("want an error for concurrency 0")
+	}
+	if _, err := NewWatcherPool([]string{"http://127.0.0.1"}, nil, 1, 1); err == nil {
+		t.Errorf("want an error for empty roomIDs")
+	}
+	if _, err := NewWatcherPool([]string{"http://127.0.0.1"}, []int64{1}, -1, 1); err == nil {
+		t.Errorf("want an error for negative n")
+	}
+}
+
+func TestWatcherPoolLeaveAll(t *testing.T) {
+	ts := newRoomServer(func(w http.ResponseWriter, r *http.Request) {
+		w.(http.Flusher).Flush()
+		<-w.(http.CloseNotifier).CloseNotify()
+	})
+	defer ts.Close()
+
+	p, err := NewWatcherPool([]string{ts.URL}, []int64{1}, 10, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	p.LeaveAll()
+
+	done := make(chan struct{})
+	go func() {
+		p.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("the pool did not finish after LeaveAll")
+	}
+}
@@ -0,0 +1,102 @@
+package session
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"github.com/isucon/isucon6-final/bench/http"
+	"github.com/isucon/isucon6-final/bench/http/httputil"
+)
+
+// デバッグ出力に含めるレスポンスbodyの最大バイト数
+const MaxDebugBodySize = 1024
+
+// 送ったリクエストと受け取ったレスポンスをwに書き出す
+// nilを渡すと書き出さなくなる
+func (s *Session) SetDebugLogger(w io.Writer) {
+	if w == nil {
+		s.Client.Transport = s.wrapTransport(s.Transport)
+		return
+	}
+	s.Client.Transport = s.wrapTransport(&debugTransport{transport: s.Transport, w: w})
+}
+
+type debugTransport struct {
+	transport http.RoundTripper
+	w         io.Writer
+	mu        sync.Mutex
+}
+
+func (t *debugTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// bodyを書き出すとDumpRequestOutが全部読んでメモリに載せてしまうので、長さがわかっている小さなものだけにする
+	// 長さのわからないbody (PostReaderなど) は読みながら送りたいので触らない
+	// bodyがあってContentLengthが0のときは長さがわからない
+	reqLength := req.ContentLength
+	if req.Body != nil && reqLength == 0 {
+		reqLength = -1
+	}
+	dumpBody := req.Body == nil || (reqLength > 0 && reqLength <= MaxDebugBodySize)
+	dump, err := httputil.DumpRequestOut(req, dumpBody)
+	if err != nil {
+		t.write("request dump failed: %s\n", err)
+	} else if dumpBody {
+		t.write("%s\n", dump)
+	} else {
+		t.write("%s(body not dumped: %s)\n", dump, bodySize(reqLength))
+	}
+
+	res, err := t.transport.RoundTrip(req)
+	if err != nil {
+		t.write("response error: %s\n", err)
+		return res, err
+	}
+
+	dump, err = httputil.DumpResponse(res, false)
+	if err != nil {
+		t.write("response dump failed: %s\n", err)
+		return res, nil
+	}
+
+	// 長さのわからないbodyは読まない。SSEはContent-Typeに関わらず終わらないので、読み始めると止まってしまう
+	if res.ContentLength < 0 || strings.HasPrefix(res.Header.Get("Content-Type"), "text/event-stream") {
+		t.write("%s(body not dumped: %s)\n", dump, bodySize(res.ContentLength))
+		return res, nil
+	}
+
+	// 先頭のMaxDebugBodySizeバイトだけを読み、読んだ分は戻しておく
+	// 残りはcheckがそのまま読むので、MaxBodySizeもそちらで効く
+	head, err := ioutil.ReadAll(io.LimitReader(res.Body, MaxDebugBodySize))
+	res.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(head), res.Body), res.Body}
+	if err != nil {
+		// 同じエラーはcheckが残りを読むときにも返るので、ここではdumpにだけ残す
+		t.write("%s%s(body read failed: %s)\n", dump, head, err)
+		return res, nil
+	}
+
+	if res.ContentLength > int64(len(head)) {
+		t.write("%s%s...(%s)\n", dump, head, bodySize(res.ContentLength))
+	} else {
+		t.write("%s%s\n", dump, head)
+	}
+	return res, nil
+}
+
+func bodySize(length int64) string {
+	if length < 0 {
+		return "unknown length"
+	}
+	return fmt.Sprintf("%d bytes", length)
+}
+
+func (t *debugTransport) write(format string, a ...interface{}) {
+	t.mu.Lock()
+	fmt.Fprintf(t.w, format, a...)
+	t.mu.Unlock()
+}
@@ -1,29 +1,92 @@
 package session
 
 import (
+	"context"
+	"crypto/sha256"
 	"crypto/tls"
+	"encoding/hex"
 	"fmt"
+	"io"
+	"net"
 	"net/url"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/isucon/isucon6-final/bench/http"
 	"github.com/isucon/isucon6-final/bench/http/cookiejar"
+	"github.com/isucon/isucon6-final/bench/http/httptrace"
+	"github.com/isucon/isucon6-final/bench/logger"
 )
 
 const (
 	DefaultTimeout      = time.Duration(5) * time.Second
 	MaxIdleConnsPerHost = 6
+	MaxIdleConns        = 100
+	IdleConnTimeout     = time.Duration(90) * time.Second
+
+	// checkに渡すレスポンスbodyの大きさの上限のデフォルト
+	DefaultMaxBodySize = 10 * 1024 * 1024
 )
 
+var sessionLog = logger.New("session")
+
 type Session struct {
 	Scheme    string
 	Host      string
 	UserAgent string
 	Client    *http.Client
 	Transport *http.Transport
+
+	// 設定されていれば、レスポンスを受け取るたびにbodyを読む前に呼ばれる
+	// bodyを読んだりCloseしたりしてはいけない
+	OnResponse func(*http.Response)
+
+	// checkに渡すレスポンスbodyの大きさの上限。これを超えたら失敗にする。0以下なら制限しない
+	// SSEには適用されない
+	MaxBodySize int64
+
+	lastTLSState *tls.ConnectionState
+	muTLSState   sync.Mutex
+
+	dialedConns int64 // 新しく繋いだ接続の数。atomicに読み書きする
+	reusedConns int64 // keep-aliveで使い回した接続の数。atomicに読み書きする
 }
 
 func New(baseURL string) *Session {
+	return NewWithTimeout(baseURL, DefaultTimeout)
+}
+
+// Newと同じだが、URLのパースに失敗した場合はpanicせずにエラーを返す
+func NewE(baseURL string) (*Session, error) {
+	return newSession(baseURL, DefaultTimeout, nil)
+}
+
+// timeoutに0を渡すとタイムアウトしない。SSEを読み続ける場合は0にすること
+func NewWithTimeout(baseURL string, timeout time.Duration) *Session {
+	s, err := newSession(baseURL, timeout, nil)
+	if err != nil {
+		panic(err) // should be cared at initialization
+	}
+	return s
+}
+
+// 同じユーザーとして振る舞う複数のセッションでjarを共有するときに使う
+func NewWithJar(baseURL string, jar http.CookieJar) *Session {
+	s, err := newSession(baseURL, DefaultTimeout, jar)
+	if err != nil {
+		panic(err) // should be cared at initialization
+	}
+	return s
+}
+
+// jarがnilなら新しく作る
+func newSession(baseURL string, timeout time.Duration, jar http.CookieJar) (*Session, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, err
+	}
+
 	s := &Session{}
 
 	s.Transport = &http.Transport{
@@ -31,29 +94,238 @@ func New(baseURL string) *Session {
 			InsecureSkipVerify: true,
 		},
 		MaxIdleConnsPerHost: MaxIdleConnsPerHost,
+		MaxIdleConns:        MaxIdleConns,
+		IdleConnTimeout:     IdleConnTimeout,
 	}
 
-	jar, _ := cookiejar.New(nil)
+	if jar == nil {
+		jar, _ = cookiejar.New(nil)
+	}
 
 	s.Client = &http.Client{
-		Transport: s.Transport,
-		Jar:       jar,
-		Timeout:   DefaultTimeout,
-		CheckRedirect: func(req *http.Request, via []*http.Request) error {
-			return fmt.Errorf("redirect attempted")
-		},
+		Transport:     s.wrapTransport(s.Transport),
+		Jar:           jar,
+		Timeout:       timeout,
+		CheckRedirect: rejectRedirect,
 	}
 
 	s.UserAgent = "benchmarker"
+	s.MaxBodySize = DefaultMaxBodySize
 
-	u, err := url.Parse(baseURL)
-	if err != nil {
-		panic(err) // should be cared at initialization
-	}
 	s.Scheme = u.Scheme
 	s.Host = u.Host
 
-	return s
+	return s, nil
+}
+
+// セッションのホストのpathに対して送られるcookieを返す
+func (s *Session) Cookies(path string) []*http.Cookie {
+	u := &url.URL{Scheme: s.Scheme, Host: s.Host, Path: path}
+	return s.Client.Jar.Cookies(u)
+}
+
+func rejectRedirect(req *http.Request, via []*http.Request) error {
+	return fmt.Errorf("redirect attempted")
+}
+
+// maxまでリダイレクトをたどるようにする。0以下ならリダイレクトをエラーにする（デフォルト）
+// 同じURLに戻ってくるリダイレクトはループとしてエラーにする
+func (s *Session) SetFollowRedirects(max int) {
+	if max <= 0 {
+		s.Client.CheckRedirect = rejectRedirect
+		return
+	}
+	s.Client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if len(via) > max {
+			sessionLog.Warn("リダイレクトが多すぎます", logger.Fields{"host": s.Host, "url": req.URL.String(), "redirects": len(via)})
+			return fmt.Errorf("stopped after %d redirects", max)
+		}
+		for _, v := range via {
+			if v.URL.String() == req.URL.String() {
+				sessionLog.Warn("リダイレクトがループしています", logger.Fields{"host": s.Host, "url": req.URL.String()})
+				return fmt.Errorf("redirect loop detected: %s", req.URL)
+			}
+		}
+		return nil
+	}
+}
+
+// 同時にリクエストを送る数に合わせて、使い回すコネクションの数を変える
+// リクエストを送り始める前に呼ぶこと
+func (s *Session) SetMaxIdleConnsPerHost(n int) {
+	s.Transport.MaxIdleConnsPerHost = n
+	if s.Transport.MaxIdleConns < n {
+		s.Transport.MaxIdleConns = n
+	}
+}
+
+// リクエストをプロキシ経由で送るようにする
+// TLSClientConfigはそのまま使われるので、プロキシがTLSを中継してもInsecureSkipVerifyが効く
+func (s *Session) SetProxy(proxyURL string) error {
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("unsupported proxy scheme: %q", u.Scheme)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("proxy host is empty: %q", proxyURL)
+	}
+	s.Transport.Proxy = http.ProxyURL(u)
+	sessionLog.Info("プロキシ経由でリクエストを送ります", logger.Fields{"host": s.Host, "proxy": u.Host})
+	return nil
+}
+
+// セッションのホストへの接続をTCPではなくsocketPathのUnixドメインソケットにする
+// 他のホストへの接続はこれまで通りTCPで行う。SSEもs.Clientを使うので同じソケットに繋がる
+// リクエストを送り始める前に呼ぶこと
+func (s *Session) SetUnixSocket(socketPath string) {
+	dial := s.Transport.DialContext
+	if dial == nil {
+		dial = (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext
+	}
+	host := hostname(s.Host)
+	s.Transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if hostname(addr) != host {
+			return dial(ctx, network, addr)
+		}
+		var d net.Dialer
+		return d.DialContext(ctx, "unix", socketPath)
+	}
+	sessionLog.Info("Unixドメインソケット経由で接続します", logger.Fields{"host": s.Host, "socket": socketPath})
+}
+
+// "host:port"からhostを取り出す。portが無ければそのまま返す
+func hostname(hostport string) string {
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return hostport
+	}
+	return host
+}
+
+// 有効にすると、HTTP/2に対応したサーバーともHTTP/1.1で通信する。HTTP/2の場合と結果を比べたいときに使う
+// デフォルトでは、サーバーがALPNでh2に対応していればHTTP/2で通信する
+// リクエストを送り始める前に呼ぶこと
+func (s *Session) SetForceHTTP1(b bool) {
+	// bench/httpはTLSClientConfigを指定していてもHTTP/2を有効にするようにパッチしてある
+	// TLSNextProtoを空でnilでないmapにするとHTTP/2が無効になり、nilに戻すと有効になる
+	if b {
+		s.Transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	} else {
+		s.Transport.TLSNextProto = nil
+	}
+}
+
+// TLSの最低バージョンを指定する。例: tls.VersionTLS12
+// リクエストを送り始める前に呼ぶこと
+func (s *Session) SetMinTLSVersion(version uint16) {
+	s.Transport.TLSClientConfig.MinVersion = version
+}
+
+// 最後に受け取ったレスポンスのTLSの状態を返す。TLSで通信していなければnilを返す
+func (s *Session) LastTLSState() *tls.ConnectionState {
+	s.muTLSState.Lock()
+	defer s.muTLSState.Unlock()
+	if s.lastTLSState == nil {
+		return nil
+	}
+	state := *s.lastTLSState
+	return &state
+}
+
+// これまでのリクエストで新しく繋いだ接続と、使い回した接続の数を返す
+// サーバーがkeep-aliveに対応していれば、reusedの方がずっと多くなる
+func (s *Session) ConnStats() (dialed, reused int) {
+	return int(atomic.LoadInt64(&s.dialedConns)), int(atomic.LoadInt64(&s.reusedConns))
+}
+
+// s.Clientが使うRoundTripperを作る。TLSの状態を覚えて、接続を数えてからrtに渡す
+func (s *Session) wrapTransport(rt http.RoundTripper) http.RoundTripper {
+	return &tlsStateRecorder{transport: &connCounter{transport: rt, s: s}, s: s}
+}
+
+// レスポンスを受け取るたびにTLSの状態を覚えておく
+type tlsStateRecorder struct {
+	transport http.RoundTripper
+	s         *Session
+}
+
+func (t *tlsStateRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := t.transport.RoundTrip(req)
+	if err == nil && res.TLS != nil {
+		state := *res.TLS
+		t.s.muTLSState.Lock()
+		t.s.lastTLSState = &state
+		t.s.muTLSState.Unlock()
+	}
+	return res, err
+}
+
+// ConnStatsのために、新しく繋いだ接続と使い回した接続を数える
+type connCounter struct {
+	transport http.RoundTripper
+	s         *Session
+}
+
+func (t *connCounter) RoundTrip(req *http.Request) (*http.Response, error) {
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				atomic.AddInt64(&t.s.reusedConns, 1)
+			} else {
+				atomic.AddInt64(&t.s.dialedConns, 1)
+			}
+		},
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+	return t.transport.RoundTrip(req)
+}
+
+// pathをGETしてレスポンスbodyのSHA-256を16進数で返す。ステータスが200でなければエラーにする
+// JSやCSSなどの静的ファイルが壊れたり差し替えられたりしていないか確かめるのに使う
+// 大きなファイルでもメモリに載せないように、bodyは読みながらハッシュを計算する
+func (s *Session) GetChecksum(path string) (string, error) {
+	u := &url.URL{Scheme: s.Scheme, Host: s.Host}
+	req, err := http.NewRequest("GET", u.String()+path, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("User-Agent", s.UserAgent)
+
+	res, err := s.Client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status: %d", res.StatusCode)
+	}
+
+	h := sha256.New()
+	_, err = io.Copy(h, res.Body)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// リクエストを送ってからbodyを読み終わるまで全体のタイムアウトを指定する
+// 0を渡すとタイムアウトしない。SSEを読み続ける場合は0にすること
+func (s *Session) SetTimeout(timeout time.Duration) {
+	s.Client.Timeout = timeout
+}
+
+// リクエストを送り終わってからレスポンスヘッダが届くまでのタイムアウトを指定する
+// SetTimeoutより短くしておくと、止まっているサーバーでは早めに失敗にしつつ、大きなbodyを読むのには全体のタイムアウトまで待てる
+// 0を渡すとヘッダだけのタイムアウトはしない（デフォルト）
+func (s *Session) SetHeaderTimeout(timeout time.Duration) {
+	s.Transport.ResponseHeaderTimeout = timeout
 }
 
 func (s *Session) Bye() {
@@ -0,0 +1,593 @@
+package session
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/isucon/isucon6-final/bench/http"
+	"github.com/isucon/isucon6-final/bench/http/httptest"
+	"github.com/isucon/isucon6-final/bench/sse"
+)
+
+func TestNewE(t *testing.T) {
+	s, err := NewE("http://127.0.0.1:8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Scheme != "http" || s.Host != "127.0.0.1:8080" {
+		t.Errorf("want %q %q, got %q %q", "http", "127.0.0.1:8080", s.Scheme, s.Host)
+	}
+
+	_, err = NewE("http://[::1")
+	if err == nil {
+		t.Errorf("want an error for a malformed URL")
+	}
+}
+
+func TestSetFollowRedirects(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/a", func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "hop", Value: "a"})
+		http.Redirect(w, r, "/b", http.StatusFound)
+	})
+	mux.HandleFunc("/b", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/c", http.StatusFound)
+	})
+	mux.HandleFunc("/c", func(w http.ResponseWriter, r *http.Request) {
+		c, err := r.Cookie("hop")
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		fmt.Fprint(w, c.Value)
+	})
+	mux.HandleFunc("/loop", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/loop", http.StatusFound)
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	s := New(ts.URL)
+	defer s.Bye()
+
+	// デフォルトではリダイレクトはエラーになる
+	if _, err := s.Client.Get(ts.URL + "/a"); err == nil {
+		t.Errorf("want an error for a redirect by default")
+	}
+
+	s.SetFollowRedirects(1)
+	if _, err := s.Client.Get(ts.URL + "/a"); err == nil {
+		t.Errorf("want an error for too many redirects")
+	}
+
+	s.SetFollowRedirects(2)
+	res, err := s.Client.Get(ts.URL + "/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("want %d, got %d", http.StatusOK, res.StatusCode)
+	}
+	if string(body) != "a" {
+		t.Errorf("want %q, got %q", "a", body)
+	}
+
+	s.SetFollowRedirects(10)
+	if _, err := s.Client.Get(ts.URL + "/loop"); err == nil {
+		t.Errorf("want an error for a redirect loop")
+	}
+}
+
+func TestSetMaxIdleConnsPerHost(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(10 * time.Millisecond)
+		fmt.Fprint(w, "ok")
+	}))
+	defer ts.Close()
+
+	const concurrency = 20
+
+	s := New(ts.URL)
+	defer s.Bye()
+	s.SetMaxIdleConnsPerHost(concurrency)
+
+	var dials int32
+	dialer := &net.Dialer{}
+	s.Transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		atomic.AddInt32(&dials, 1)
+		return dialer.DialContext(ctx, network, addr)
+	}
+
+	for round := 0; round < 5; round++ {
+		var wg sync.WaitGroup
+		for i := 0; i < concurrency; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				res, err := s.Client.Get(ts.URL)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				ioutil.ReadAll(res.Body)
+				res.Body.Close()
+			}()
+		}
+		wg.Wait()
+	}
+
+	if n := atomic.LoadInt32(&dials); n > concurrency {
+		t.Errorf("want at most %d dials, got %d", concurrency, n)
+	}
+}
+
+func TestSetProxy(t *testing.T) {
+	var proxied string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// プロキシには絶対URLでリクエストが届く
+		proxied = r.URL.String()
+		fmt.Fprint(w, "proxied")
+	}))
+	defer proxy.Close()
+
+	s := New("http://isucon.example.com")
+	defer s.Bye()
+
+	for _, u := range []string{"http://[::1", "ftp://127.0.0.1", "http://"} {
+		if err := s.SetProxy(u); err == nil {
+			t.Errorf("want an error for %q", u)
+		}
+	}
+
+	if err := s.SetProxy(proxy.URL); err != nil {
+		t.Fatal(err)
+	}
+	res, err := s.Client.Get("http://isucon.example.com/rooms/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+
+	if string(body) != "proxied" {
+		t.Errorf("want %q, got %q", "proxied", body)
+	}
+	if proxied != "http://isucon.example.com/rooms/1" {
+		t.Errorf("want %q, got %q", "http://isucon.example.com/rooms/1", proxied)
+	}
+}
+
+func TestNewWithJar(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "user", Value: "isucon", Path: "/"})
+	})
+	mux.HandleFunc("/secret", func(w http.ResponseWriter, r *http.Request) {
+		if _, err := r.Cookie("user"); err != nil {
+			w.WriteHeader(http.StatusForbidden)
+		}
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	s1 := New(ts.URL)
+	defer s1.Bye()
+
+	res, err := s1.Client.Get(ts.URL + "/login")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	cookies := s1.Cookies("/")
+	if len(cookies) != 1 || cookies[0].Name != "user" || cookies[0].Value != "isucon" {
+		t.Errorf("want [user=isucon], got %v", cookies)
+	}
+
+	s2 := NewWithJar(ts.URL, s1.Client.Jar)
+	defer s2.Bye()
+
+	res, err = s2.Client.Get(ts.URL + "/secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("want %d, got %d", http.StatusOK, res.StatusCode)
+	}
+
+	// jarを共有しないセッションでは入れない
+	s3 := New(ts.URL)
+	defer s3.Bye()
+
+	res, err = s3.Client.Get(ts.URL + "/secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusForbidden {
+		t.Errorf("want %d, got %d", http.StatusForbidden, res.StatusCode)
+	}
+}
+
+func TestSetDebugLogger(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Debug", "yes")
+		fmt.Fprint(w, strings.Repeat("a", MaxDebugBodySize+10))
+	}))
+	defer ts.Close()
+
+	s := New(ts.URL)
+	defer s.Bye()
+
+	var buf bytes.Buffer
+	s.SetDebugLogger(&buf)
+
+	res, err := s.Client.Post(ts.URL+"/api/strokes/rooms/1", "application/json", strings.NewReader(`{"id":1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+
+	// bodyはそのまま読める
+	if len(body) != MaxDebugBodySize+10 {
+		t.Errorf("want %d, got %d", MaxDebugBodySize+10, len(body))
+	}
+
+	dump := buf.String()
+	for _, want := range []string{"POST /api/strokes/rooms/1 HTTP/1.1", `{"id":1}`, "200 OK", "X-Debug: yes", fmt.Sprintf("...(%d bytes)", MaxDebugBodySize+10)} {
+		if !strings.Contains(dump, want) {
+			t.Errorf("want %q in the dump, got %q", want, dump)
+		}
+	}
+
+	// 長さのわからないbodyは読みながら送るので、dumpには書き出さない
+	buf.Reset()
+	res, err = s.Client.Post(ts.URL+"/api/strokes/rooms/1", "application/json", struct{ io.Reader }{strings.NewReader(`{"id":2}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if dump := buf.String(); strings.Contains(dump, `{"id":2}`) || !strings.Contains(dump, "(body not dumped: unknown length)") {
+		t.Errorf("something went wrong: %q", dump)
+	}
+
+	s.SetDebugLogger(nil)
+	buf.Reset()
+	res, err = s.Client.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if buf.Len() != 0 {
+		t.Errorf("want no dump, got %q", buf.String())
+	}
+}
+
+func TestHTTP2(t *testing.T) {
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Proto)
+	}))
+	ts.TLS = &tls.Config{NextProtos: []string{"h2", "http/1.1"}}
+	ts.StartTLS()
+	defer ts.Close()
+
+	get := func(forceHTTP1 bool) (*http.Response, string) {
+		s := New(ts.URL)
+		defer s.Bye()
+		s.SetForceHTTP1(forceHTTP1)
+		res, err := s.Client.Get(ts.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		b, _ := ioutil.ReadAll(res.Body)
+		return res, string(b)
+	}
+
+	res, body := get(false)
+	if res.ProtoMajor != 2 || res.TLS.NegotiatedProtocol != "h2" {
+		t.Errorf("want %q %q, got %q %q", "HTTP/2.0", "h2", res.Proto, res.TLS.NegotiatedProtocol)
+	}
+	if body != "HTTP/2.0" {
+		t.Errorf("want %q, got %q", "HTTP/2.0", body)
+	}
+
+	res, body = get(true)
+	if res.ProtoMajor != 1 || res.TLS.NegotiatedProtocol == "h2" {
+		t.Errorf("want %q, got %q %q", "HTTP/1.1", res.Proto, res.TLS.NegotiatedProtocol)
+	}
+	if body != "HTTP/1.1" {
+		t.Errorf("want %q, got %q", "HTTP/1.1", body)
+	}
+}
+
+func TestLastTLSState(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	defer ts.Close()
+
+	s := New(ts.URL)
+	defer s.Bye()
+
+	if state := s.LastTLSState(); state != nil {
+		t.Errorf("want nil before any request, got %#v", state)
+	}
+
+	res, err := s.Client.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	state := s.LastTLSState()
+	if state == nil {
+		t.Fatalf("want the TLS state, got nil")
+	}
+	if !state.HandshakeComplete || state.Version != res.TLS.Version || state.CipherSuite != res.TLS.CipherSuite {
+		t.Errorf("want %x %x, got %x %x", res.TLS.Version, res.TLS.CipherSuite, state.Version, state.CipherSuite)
+	}
+
+	// デバッグ出力を有効にしても記録される
+	s2 := New(ts.URL)
+	defer s2.Bye()
+	s2.SetDebugLogger(ioutil.Discard)
+	res, err = s2.Client.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if s2.LastTLSState() == nil {
+		t.Errorf("want the TLS state with the debug logger, got nil")
+	}
+}
+
+func TestSetDebugLoggerStream(t *testing.T) {
+	done := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// text/event-stream以外でもSSEとして受け付けることがある (sse.EventSource.SetAcceptedContentTypes)
+		w.Header().Set("Content-Type", "application/stream+json")
+		fmt.Fprint(w, "{\"id\":1}\n")
+		w.(http.Flusher).Flush()
+		<-done
+	}))
+	defer ts.Close()
+	defer close(done)
+
+	s := New(ts.URL)
+	defer s.Bye()
+
+	var buf bytes.Buffer
+	s.SetDebugLogger(&buf)
+
+	resCh := make(chan *http.Response, 1)
+	go func() {
+		res, err := s.Client.Get(ts.URL)
+		if err != nil {
+			t.Error(err)
+		}
+		resCh <- res
+	}()
+
+	select {
+	case res := <-resCh:
+		if res == nil {
+			return
+		}
+		defer res.Body.Close()
+		line, err := bufio.NewReader(res.Body).ReadString('\n')
+		if err != nil || line != "{\"id\":1}\n" {
+			t.Errorf("something went wrong: %q, %v", line, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("the debug logger blocked on a stream")
+	}
+
+	if dump := buf.String(); !strings.Contains(dump, "(body not dumped: unknown length)") {
+		t.Errorf("something went wrong: %q", dump)
+	}
+}
+
+func TestSetMinTLSVersion(t *testing.T) {
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	ts.TLS = &tls.Config{MaxVersion: tls.VersionTLS12}
+	ts.StartTLS()
+	defer ts.Close()
+
+	s := New(ts.URL)
+	defer s.Bye()
+	s.SetMinTLSVersion(tls.VersionTLS12)
+	res, err := s.Client.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if v := s.LastTLSState().Version; v != tls.VersionTLS12 {
+		t.Errorf("want %x, got %x", tls.VersionTLS12, v)
+	}
+
+	s2 := New(ts.URL)
+	defer s2.Bye()
+	s2.SetMinTLSVersion(tls.VersionTLS13)
+	if _, err := s2.Client.Get(ts.URL); err == nil {
+		t.Errorf("want an error when the server does not support the minimum version")
+	}
+}
+
+func TestGetChecksum(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/bundle.js" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, "hello")
+	}))
+	defer ts.Close()
+
+	s := New(ts.URL)
+	defer s.Bye()
+
+	// echo -n hello | sha256sum
+	want := "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+	got, err := s.GetChecksum("/bundle.js")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+
+	_, err = s.GetChecksum("/missing.js")
+	if err == nil {
+		t.Errorf("want an error for 404")
+	}
+}
+
+func TestSetUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	socketPath := filepath.Join(dir, "app.sock")
+	l, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "event: stroke\ndata: 1\n\nevent: stroke\ndata: 2\n\n")
+	}))
+	ts.Listener = l
+	ts.Start()
+	defer ts.Close()
+
+	// TCPでは繋がらないホストでも、ソケット経由で繋がる
+	s := New("http://isucon.example.com")
+	defer s.Bye()
+	s.SetUnixSocket(socketPath)
+
+	es := sse.NewEventSource(s.Client, "http://isucon.example.com/api/stream/rooms/1")
+	got := []string{}
+	es.On("stroke", func(data string) {
+		got = append(got, data)
+	})
+	err = es.OpenOnce()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"1", "2"}; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestSetHeaderTimeout(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/slow-headers", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(500 * time.Millisecond)
+		fmt.Fprint(w, "ok")
+	})
+	mux.HandleFunc("/slow-body", func(w http.ResponseWriter, r *http.Request) {
+		// ヘッダはすぐに返し、bodyをゆっくり返す
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		for i := 0; i < 5; i++ {
+			time.Sleep(100 * time.Millisecond)
+			fmt.Fprint(w, "ok")
+			w.(http.Flusher).Flush()
+		}
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	s := NewWithTimeout(ts.URL, 2*time.Second)
+	defer s.Bye()
+	s.SetHeaderTimeout(100 * time.Millisecond)
+
+	// ヘッダが届かなければ全体のタイムアウトを待たずに失敗する
+	start := time.Now()
+	_, err := s.Client.Get(ts.URL + "/slow-headers")
+	if err == nil {
+		t.Fatalf("want an error, got nil")
+	}
+	if e, ok := err.(net.Error); !ok || !e.Timeout() {
+		t.Errorf("want a timeout, got %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("want a fast failure, took %s", d)
+	}
+
+	// ヘッダがすぐに届けば、bodyはヘッダのタイムアウトより長くかかってもよい
+	res, err := s.Client.Get(ts.URL + "/slow-body")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "okokokokok" {
+		t.Errorf("want %q, got %q", "okokokokok", body)
+	}
+
+	// 全体のタイムアウトはこれまで通り効く
+	s.SetTimeout(200 * time.Millisecond)
+	res, err = s.Client.Get(ts.URL + "/slow-body")
+	if err == nil {
+		_, err = ioutil.ReadAll(res.Body)
+		res.Body.Close()
+	}
+	if err == nil {
+		t.Errorf("want an error, got nil")
+	}
+}
+
+func TestConnStats(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	defer ts.Close()
+
+	s := New(ts.URL)
+	defer s.Bye()
+
+	const requests = 10
+	for i := 0; i < requests; i++ {
+		res, err := s.Client.Get(ts.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(res.Body)
+		res.Body.Close()
+	}
+
+	dialed, reused := s.ConnStats()
+	if dialed+reused != requests {
+		t.Errorf("want %d connections, got %d dialed and %d reused", requests, dialed, reused)
+	}
+	if dialed != 1 || reused != requests-1 {
+		t.Errorf("want 1 dialed and %d reused, got %d and %d", requests-1, dialed, reused)
+	}
+}
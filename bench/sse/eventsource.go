@@ -2,22 +2,34 @@ package sse
 
 import (
 	"bufio"
+	"bytes"
+	"compress/gzip"
 	"context"
 	"fmt"
+	"io"
+	"math/rand"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/isucon/isucon6-final/bench/http"
+	"github.com/isucon/isucon6-final/bench/logger"
 )
 
+var sseLog = logger.New("sse")
+
 type Listener func(data string)
 
+type AnyListener func(event, data string)
+
 type ErrListener func(err error)
 
 type EndListener func()
 
+type OpenListener func()
+
 type BadContentType struct {
 	ContentType string
 }
@@ -34,23 +46,124 @@ func (err *BadStatusCode) Error() string {
 	return fmt.Sprintf("bad status code %d", err.StatusCode)
 }
 
+// ClosedByServer is the error when the server responds 204 No Content,
+// which tells the client to stop reconnecting (e.g. the room was closed)
+type ClosedByServer struct{}
+
+func (err *ClosedByServer) Error() string {
+	return "closed by server (204 No Content)"
+}
+
+// TooManyReconnects is the error when reconnection failed more times in a row than set by SetMaxReconnects.
+// Err is the error of the last attempt.
+type TooManyReconnects struct {
+	Max int
+	Err error
+}
+
+func (err *TooManyReconnects) Error() string {
+	return fmt.Sprintf("gave up after %d failed reconnects: %s", err.Max, err.Err)
+}
+
+// OutOfOrderID is the error when an event id is not greater than the previous one, reported by SetEnforceMonotonicID
+type OutOfOrderID struct {
+	Prev int64
+	ID   int64
+}
+
+func (err *OutOfOrderID) Error() string {
+	return fmt.Sprintf("event id %d arrived after %d", err.ID, err.Prev)
+}
+
+// SuspectedBuffering is the error when several events arrive at once after a long silence, reported by SetDetectBuffering.
+// It suggests that a proxy between the server and the client buffers the stream.
+type SuspectedBuffering struct {
+	Gap    time.Duration // 塊で届く前に何も届かなかった時間
+	Events int           // 塊で届いたイベントの数
+}
+
+func (err *SuspectedBuffering) Error() string {
+	return fmt.Sprintf("%d events arrived at once after %s of silence", err.Events, err.Gap)
+}
+
+// Stats is statistics of an EventSource
+type Stats struct {
+	Events      int       // 発火したイベントの数
+	DataBytes   int       // 発火したイベントのdataの合計バイト数
+	Reconnects  int       // 2回目以降に接続に成功した回数
+	LastEventAt time.Time // 最後にイベントが発火した時刻
+}
+
+// ReadIdleTimeout is the error when no line arrives within the timeout set by SetReadIdleTimeout
+type ReadIdleTimeout struct {
+	Timeout time.Duration
+}
+
+func (err *ReadIdleTimeout) Error() string {
+	return fmt.Sprintf("no data received for %s", err.Timeout)
+}
+
+// ConnectTimeout is the error when the response headers do not arrive within the client's Timeout
+type ConnectTimeout struct {
+	Timeout time.Duration
+}
+
+func (err *ConnectTimeout) Error() string {
+	return fmt.Sprintf("no response headers received within %s", err.Timeout)
+}
+
 type EventSource struct {
-	client      *http.Client
-	ctx         context.Context
-	cancelFunc  context.CancelFunc
-	listeners   map[string][]Listener
-	muListeners sync.Mutex
-	headers     map[string]string
-	errListener ErrListener
-	endListener EndListener
-	retryWait   time.Duration
-	isClosed    bool
-	lastEventID string
-	url         string
+	client          *http.Client
+	ctx             context.Context
+	cancelFunc      context.CancelFunc
+	listeners       map[string][]Listener
+	anyListeners    []AnyListener
+	muListeners     sync.RWMutex
+	headers         map[string]string
+	errListener     ErrListener
+	endListener     EndListener
+	openListener    OpenListener
+	commentListener Listener
+	retryWait       time.Duration
+	backoffMax      time.Duration
+	maxReconnects   int
+	endReason       error               // muStatsで守る
+	sleep           func(time.Duration) // テストで差し替える。nilならwaitでcontextを見ながら待つ
+	now             func() time.Time
+	openedAt        time.Time
+	isClosed        int32 // Closeされたら1。別のgoroutineからCloseされるのでatomicに読み書きする
+	lastEventID     string
+	muLastEventID   sync.Mutex
+	url             string
+	maxBufferSize   int
+	acceptGzip      bool
+	lastIDParam     string   // 空でなければ、再接続するときにLast-Event-IDをこの名前のクエリパラメータにもつける
+	contentTypes    []string // text/event-stream以外に受け付けるContent-Typeの前方一致
+	monotonicID     bool     // idが増え続けているか確かめる。整数でないidが来たらfalseに戻す
+	lastNumericID   int64
+	hasNumericID    bool
+	detectBuffering bool
+	readIdleTimeout time.Duration
+	stats           Stats
+	hasOpened       bool
+	muStats         sync.Mutex
+	reader          io.Reader // NewEventSourceFromReaderで作ったときだけnilでない
+	recorder        io.Writer
+	asyncBufferSize int
+	dispatchCh      chan dispatchedEvent // SetAsyncDispatchされていればOpenしている間だけnilでない
+	dispatchDone    chan struct{}
+	pending         bool          // 空行がまだ届いていないイベントを受信中
+	drainCh         chan struct{} // CloseGracefulが待っている間だけnilでない
+	muDrain         sync.Mutex    // pending, drainChを守る
 }
 
 func NewEventSource(c *http.Client, urlStr string) *EventSource {
-	ctx, cancelFunc := context.WithCancel(context.Background())
+	return NewEventSourceWithContext(context.Background(), c, urlStr)
+}
+
+// NewEventSourceWithContext creates an EventSource which is closed when ctx is done
+func NewEventSourceWithContext(ctx context.Context, c *http.Client, urlStr string) *EventSource {
+	ctx, cancelFunc := context.WithCancel(ctx)
 	return &EventSource{
 		client:     c,
 		ctx:        ctx,
@@ -60,18 +173,154 @@ func NewEventSource(c *http.Client, urlStr string) *EventSource {
 
 		// https://www.w3.org/TR/eventsource/#concept-event-stream-reconnection-time
 		// "This must initially be a user-agent-defined value, probably in the region of a few seconds."
-		retryWait: 1000 * time.Millisecond,
+		retryWait:  1000 * time.Millisecond,
+		backoffMax: DefaultBackoffMax,
 
-		isClosed: false,
-		url:      urlStr,
+		now: time.Now,
+		url: urlStr,
 	}
 }
 
+// NewEventSourceFromReader creates an EventSource which reads a stream recorded by SetRecorder from r
+// instead of connecting to a server. Events are parsed and dispatched the same way.
+// Open reads r until EOF and does not reconnect.
+func NewEventSourceFromReader(r io.Reader) *EventSource {
+	s := NewEventSource(nil, "")
+	s.reader = r
+	return s
+}
+
+// SetRecorder makes the raw stream written to w as it is received, so that it can be replayed by NewEventSourceFromReader.
+// A gzip-encoded stream is written after decoding.
+func (s *EventSource) SetRecorder(w io.Writer) {
+	s.recorder = w
+}
+
+// SetClock replaces the clock used for Stats and reconnection. The default is time.Now.
+func (s *EventSource) SetClock(now func() time.Time) {
+	s.now = now
+}
+
 func (s *EventSource) AddHeader(name, value string) {
 	s.headers[name] = value
 }
 
+// SetMaxBufferSize sets the maximum size of a line in the stream.
+// The default is bufio.MaxScanTokenSize (64KB).
+func (s *EventSource) SetMaxBufferSize(n int) {
+	s.maxBufferSize = n
+}
+
+// SetReadIdleTimeout makes the current connection abort and reconnect
+// if no line (including comments) arrives within d. Zero means no timeout.
+func (s *EventSource) SetReadIdleTimeout(d time.Duration) {
+	s.readIdleTimeout = d
+}
+
+// SetAcceptGzip makes the request send "Accept-Encoding: gzip" explicitly.
+// A gzip-encoded stream is decoded regardless of this flag.
+func (s *EventSource) SetAcceptGzip(accept bool) {
+	s.acceptGzip = accept
+}
+
+// SetLastEventIDParam makes reconnections send the last event ID also as the query parameter name,
+// in addition to the Last-Event-ID header, for servers that only resume from a query parameter.
+// Other query parameters in the URL are kept. An empty name disables it (default). Call it before Open.
+func (s *EventSource) SetLastEventIDParam(name string) {
+	s.lastIDParam = name
+}
+
+// SetAcceptedContentTypes makes responses whose Content-Type starts with one of prefixes accepted
+// in addition to text/event-stream. Other responses still fail with BadContentType.
+func (s *EventSource) SetAcceptedContentTypes(prefixes ...string) {
+	s.contentTypes = prefixes
+}
+
+// SetEnforceMonotonicID makes the EventSource parse ids as integers and report OutOfOrderID to OnError
+// when an id is not greater than the largest one received so far, which indicates a bug in the order of events.
+// If a non-integer id arrives, the check is disabled with a warning. Call it before Open.
+func (s *EventSource) SetEnforceMonotonicID(enforce bool) {
+	s.monotonicID = enforce
+}
+
+// SetEnforceMonotonicIDが有効なら、idが前のものより大きいか確かめる
+func (s *EventSource) checkMonotonicID(value string) {
+	if !s.monotonicID || value == "" {
+		return
+	}
+	id, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		s.monotonicID = false
+		sseLog.Warn("idが整数ではないので、順番の確認をやめます", logger.Fields{"url": s.url, "id": value})
+		return
+	}
+	if s.hasNumericID && id <= s.lastNumericID {
+		s.emitError(&OutOfOrderID{Prev: s.lastNumericID, ID: id})
+		return
+	}
+	s.lastNumericID = id
+	s.hasNumericID = true
+}
+
+// SetDetectBuffering makes the EventSource report SuspectedBuffering via OnError
+// when several events arrive almost at the same time after a gap of a few seconds,
+// which is the pattern of a proxy buffering the stream instead of passing events through. Call it before Open.
+func (s *EventSource) SetDetectBuffering(detect bool) {
+	s.detectBuffering = detect
+}
+
+const (
+	bufferingGap         = 2 * time.Second  // これ以上何も届かなかった後に
+	bufferingBurstWindow = time.Millisecond // 前のイベントからこれ以内に
+	bufferingBurstEvents = 3                // これだけのイベントが続けて届いたら、バッファされていたとみなす
+)
+
+// イベントが届いた時刻から、バッファされて塊で届いていないか調べる。1つの接続ごとに作る
+type burstDetector struct {
+	last   time.Time
+	gap    time.Duration // 今の塊が届く前に空いていた時間
+	events int           // 今の塊のイベントの数。gapがbufferingGapより短ければ数えない
+}
+
+// 塊がbufferingBurstEventsに達したときだけエラーを返す
+func (d *burstDetector) observe(t time.Time) *SuspectedBuffering {
+	interval := t.Sub(d.last)
+	d.last = t
+	if interval >= bufferingGap {
+		d.gap = interval
+		d.events = 1
+		return nil
+	}
+	if d.events == 0 || interval > bufferingBurstWindow {
+		d.events = 0
+		return nil
+	}
+	d.events++
+	if d.events == bufferingBurstEvents {
+		return &SuspectedBuffering{Gap: d.gap, Events: d.events}
+	}
+	return nil
+}
+
+func (s *EventSource) acceptsContentType(contentType string) bool {
+	if strings.HasPrefix(contentType, "text/event-stream") {
+		return true
+	}
+	for _, prefix := range s.contentTypes {
+		if strings.HasPrefix(contentType, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// On registers a listener for the event.
+// Listeners for events, errors, opens and comments registered after Close would never be called,
+// so they are ignored with a warning. OnEnd is the exception, because Open still calls it when it returns.
 func (s *EventSource) On(event string, listener Listener) {
+	if s.ignoreAfterClose("On") {
+		return
+	}
 	s.muListeners.Lock()
 	defer s.muListeners.Unlock()
 	if _, ok := s.listeners[event]; !ok {
@@ -80,20 +329,108 @@ func (s *EventSource) On(event string, listener Listener) {
 	s.listeners[event] = append(s.listeners[event], listener)
 }
 
-func (s *EventSource) emit(event string, data string) {
-	if listeners, ok := s.listeners[event]; ok {
-		for _, listener := range listeners {
-			listener(data)
+// Off removes all listeners registered for the event and returns the number of removed listeners
+func (s *EventSource) Off(event string) int {
+	s.muListeners.Lock()
+	defer s.muListeners.Unlock()
+	n := len(s.listeners[event])
+	delete(s.listeners, event)
+	return n
+}
+
+// OffAll removes all listeners registered by On and OnAny and returns the number of removed listeners
+func (s *EventSource) OffAll() int {
+	s.muListeners.Lock()
+	defer s.muListeners.Unlock()
+	n := len(s.anyListeners)
+	for _, listeners := range s.listeners {
+		n += len(listeners)
+	}
+	s.listeners = map[string][]Listener{}
+	s.anyListeners = nil
+	return n
+}
+
+// OnAny registers a listener called for every event regardless of its type,
+// in addition to the listeners registered by On
+func (s *EventSource) OnAny(listener AnyListener) {
+	if s.ignoreAfterClose("OnAny") {
+		return
+	}
+	s.muListeners.Lock()
+	defer s.muListeners.Unlock()
+	s.anyListeners = append(s.anyListeners, listener)
+}
+
+// SetAsyncDispatch makes listeners called from a separate goroutine through a buffer of bufferSize events,
+// so that a slow listener does not block reading the stream. Events are still delivered in order.
+// Zero (default) calls listeners from the goroutine reading the stream. Call it before Open.
+func (s *EventSource) SetAsyncDispatch(bufferSize int) {
+	s.asyncBufferSize = bufferSize
+}
+
+type dispatchedEvent struct {
+	event string
+	data  string
+}
+
+func (s *EventSource) startDispatcher() {
+	if s.asyncBufferSize <= 0 {
+		return
+	}
+	s.dispatchCh = make(chan dispatchedEvent, s.asyncBufferSize)
+	s.dispatchDone = make(chan struct{})
+	go func() {
+		defer close(s.dispatchDone)
+		for e := range s.dispatchCh {
+			s.emit(e.event, e.data)
 		}
+	}()
+}
+
+// バッファに残っているイベントを全部発火し終えるまで待つ
+func (s *EventSource) stopDispatcher() {
+	if s.dispatchCh == nil {
+		return
+	}
+	close(s.dispatchCh)
+	<-s.dispatchDone
+	s.dispatchCh = nil
+}
+
+// バッファがいっぱいのときは空くまで待つ
+func (s *EventSource) dispatch(event string, data string) {
+	if s.dispatchCh == nil {
+		s.emit(event, data)
+		return
+	}
+	s.dispatchCh <- dispatchedEvent{event: event, data: data}
+}
+
+func (s *EventSource) emit(event string, data string) {
+	// listenerの中でOffなどが呼ばれてもデッドロックしないように、コピーしてからロックを外して呼ぶ
+	s.muListeners.RLock()
+	listeners := append([]Listener(nil), s.listeners[event]...)
+	anyListeners := append([]AnyListener(nil), s.anyListeners...)
+	s.muListeners.RUnlock()
+
+	for _, listener := range listeners {
+		listener(data)
+	}
+	for _, listener := range anyListeners {
+		listener(event, data)
 	}
 }
 
 func (s *EventSource) OnError(listener ErrListener) {
+	if s.ignoreAfterClose("OnError") {
+		return
+	}
 	s.errListener = listener
 }
 
 func (s *EventSource) emitError(err error) { // return whether to continue or abort
-	if s.errListener != nil && !s.isClosed {
+	if s.errListener != nil && !s.isDone() {
 		s.errListener(err)
 	}
 }
@@ -109,81 +446,435 @@ func (s *EventSource) emitEnd() {
 	}
 }
 
+// LastEventID returns the last event ID received from the server
+func (s *EventSource) LastEventID() string {
+	s.muLastEventID.Lock()
+	defer s.muLastEventID.Unlock()
+	return s.lastEventID
+}
+
+// Stats returns a snapshot of the statistics
+func (s *EventSource) Stats() Stats {
+	s.muStats.Lock()
+	defer s.muStats.Unlock()
+	return s.stats
+}
+
+// OpenListener is called every time the connection is established, including reconnections
+func (s *EventSource) OnOpen(listener OpenListener) {
+	if s.ignoreAfterClose("OnOpen") {
+		return
+	}
+	s.openListener = listener
+}
+
+func (s *EventSource) emitOpen() {
+	if s.openListener != nil && !s.isDone() {
+		s.openListener()
+	}
+}
+
+// OnComment registers a listener called with the text of comment lines (lines starting with a colon),
+// which servers often send as heartbeats
+func (s *EventSource) OnComment(listener Listener) {
+	if s.ignoreAfterClose("OnComment") {
+		return
+	}
+	s.commentListener = listener
+}
+
+func (s *EventSource) emitComment(comment string) {
+	if s.commentListener != nil && !s.isDone() {
+		s.commentListener(comment)
+	}
+}
+
 func (s *EventSource) Close() {
-	s.isClosed = true
+	atomic.StoreInt32(&s.isClosed, 1)
 	s.cancelFunc()
 }
 
+// CloseGraceful stops reconnecting like Close, but if an event is being received,
+// it waits up to timeout for the event to be completed and dispatched before cancelling the connection.
+// It blocks until then, so call Close instead in listeners.
+func (s *EventSource) CloseGraceful(timeout time.Duration) {
+	atomic.StoreInt32(&s.isClosed, 1)
+
+	s.muDrain.Lock()
+	if !s.pending {
+		s.muDrain.Unlock()
+		s.Close()
+		return
+	}
+	ch := make(chan struct{})
+	s.drainCh = ch
+	s.muDrain.Unlock()
+
+	select {
+	case <-ch:
+	case <-time.After(timeout):
+	}
+	s.Close()
+}
+
+// イベントを受信し始めたら呼ぶ
+func (s *EventSource) startEvent() {
+	s.muDrain.Lock()
+	s.pending = true
+	s.muDrain.Unlock()
+}
+
+// イベントの区切りまで来るか、接続が切れたら呼ぶ。CloseGracefulが待っていればtrueを返す
+func (s *EventSource) endEvent() bool {
+	s.muDrain.Lock()
+	defer s.muDrain.Unlock()
+	s.pending = false
+	if s.drainCh == nil {
+		return false
+	}
+	close(s.drainCh)
+	s.drainCh = nil
+	return true
+}
+
+// Closeした後に登録されたlistenerは呼ばれることがないので、バグに気づけるように警告して無視する
+func (s *EventSource) ignoreAfterClose(method string) bool {
+	if atomic.LoadInt32(&s.isClosed) != 1 {
+		return false
+	}
+	sseLog.Warn("Closeした後にlistenerを登録しようとしたので無視します", logger.Fields{"url": s.url, "method": method})
+	return true
+}
+
+// Closeされたか、親のcontextがキャンセルされたら、もうイベントは発火しない
+func (s *EventSource) isDone() bool {
+	return atomic.LoadInt32(&s.isClosed) == 1 || s.ctx.Err() != nil
+}
+
 var defaultEvent = "message"
 
+var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
+// これ以上の時間つながっていた接続が切れた場合は、再接続の間隔を初期値に戻す
+const minStableConnection = 5 * time.Second
+
+// 再接続に失敗し続けたときに、間隔をここまで延ばす
+const DefaultBackoffMax = 30 * time.Second
+
+// SetBackoff makes reconnection wait grow exponentially from base up to max with jitter
+// while reconnection keeps failing. By default it grows from the retry time up to DefaultBackoffMax.
+// Passing max <= base disables the backoff.
+func (s *EventSource) SetBackoff(base, max time.Duration) {
+	s.retryWait = base
+	s.backoffMax = max
+}
+
+// 全てのwatcherが同じタイミングで再接続しに行かないように、伸ばした間隔にはゆらぎを入れる
+func (s *EventSource) backoffWait(failures int) time.Duration {
+	if s.backoffMax <= s.retryWait {
+		return s.retryWait
+	}
+	d := s.retryWait
+	for i := 0; i < failures && d < s.backoffMax; i++ {
+		d *= 2
+	}
+	if d > s.backoffMax {
+		d = s.backoffMax
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// SetMaxReconnects makes Open give up when reconnection fails k times in a row
+// (k+1 failed attempts including the first one). A successful connection resets the count.
+// Zero (default) means it keeps reconnecting until Close is called.
+func (s *EventSource) SetMaxReconnects(k int) {
+	s.maxReconnects = k
+}
+
+// EndReason returns why Open stopped reconnecting by itself, such as *TooManyReconnects or *ClosedByServer.
+// It returns nil if Open is still running or stopped because of Close or the context.
+func (s *EventSource) EndReason() error {
+	s.muStats.Lock()
+	defer s.muStats.Unlock()
+	return s.endReason
+}
+
+func (s *EventSource) setEndReason(err error) {
+	s.muStats.Lock()
+	s.endReason = err
+	s.muStats.Unlock()
+}
+
+// サーバーからretryで極端に短い時間を指定されても、これより短い間隔では再接続しない
+const minRetryWait = 100 * time.Millisecond
+
+// Open connects to the server and keeps reconnecting until Close is called or the context is done.
+// It blocks until then, and OnEnd listener is called just before it returns.
 func (s *EventSource) Open() {
+	s.startDispatcher()
+	failures := 0
+	failedAttempts := 0 // 接続に成功せずに終わった試行が何回続いたか
 	for {
-		s.request()
-		if !s.isClosed {
-			time.Sleep(s.retryWait)
+		s.openedAt = time.Time{}
+		err := s.request()
+		if err != nil {
+			s.emitError(err)
+			if _, ok := err.(*ClosedByServer); ok {
+				// 204が返ってきたら再接続しない仕様
+				s.setEndReason(err)
+				s.Close()
+			}
+		}
+		if s.openedAt.IsZero() {
+			failedAttempts++
+		} else {
+			failedAttempts = 0
+		}
+		if s.maxReconnects > 0 && failedAttempts > s.maxReconnects && !s.isDone() {
+			// 死んだサーバーに再接続し続けないようにあきらめる
+			tooMany := &TooManyReconnects{Max: s.maxReconnects, Err: err}
+			s.emitError(tooMany)
+			s.setEndReason(tooMany)
+			s.Close()
+		}
+		if !s.isDone() && s.reader == nil {
+			if !s.openedAt.IsZero() && s.now().Sub(s.openedAt) >= minStableConnection {
+				failures = 0
+			}
+			s.wait(s.backoffWait(failures))
+			failures++
 			continue
 		}
 		break
 	}
 	s.cancelFunc() // it's a good practice to call cancel at the end
+	s.stopDispatcher()
+	s.emitEnd()
+}
+
+// OpenContext is like Open, but it also stops reconnecting and aborts the current connection when ctx is done.
+func (s *EventSource) OpenContext(ctx context.Context) {
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.cancelFunc()
+		case <-stop:
+		}
+	}()
+	s.Open()
+}
+
+// 再接続までdだけ待つ。Closeされるか親のcontextがキャンセルされたら、待っている途中でも戻る
+func (s *EventSource) wait(d time.Duration) {
+	if s.sleep != nil {
+		s.sleep(d)
+		return
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-s.ctx.Done():
+	}
+}
+
+// OpenOnce はOpenと違って再接続せず、一度だけ接続してストリームが終わるまで待つ。
+// ストリームが正常に終わればnilを、そうでなければその原因となったエラーを返す。
+func (s *EventSource) OpenOnce() error {
+	s.startDispatcher()
+	err := s.request()
+	s.cancelFunc()
+	s.stopDispatcher()
 	s.emitEnd()
+	return err
 }
 
-func (s *EventSource) request() {
+func (s *EventSource) request() error {
+	if s.reader != nil {
+		return s.replay()
+	}
+
 	req, err := http.NewRequest("GET", s.url, nil)
 	if err != nil {
-		s.emitError(err)
-		return
+		return err
 	}
-	req = req.WithContext(s.ctx)
+	ctx, cancel := context.WithCancel(s.ctx)
+	defer cancel()
+	req = req.WithContext(ctx)
 
 	req.Header.Set("Accept", "text/event-stream")
-	if s.lastEventID != "" {
-		req.Header.Set("Last-Event-ID", s.lastEventID)
+	if lastEventID := s.LastEventID(); lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+		if s.lastIDParam != "" {
+			// URLに同じ名前のパラメータが既にあれば置き換える
+			q := req.URL.Query()
+			q.Set(s.lastIDParam, lastEventID)
+			req.URL.RawQuery = q.Encode()
+		}
+	}
+	if s.acceptGzip {
+		req.Header.Set("Accept-Encoding", "gzip")
 	}
 	for name, value := range s.headers {
 		req.Header.Set(name, value)
 	}
 
-	t := s.client.Timeout
-	s.client.Timeout = 0
-	resp, err := s.client.Do(req)
-	s.client.Timeout = t
+	// client.Timeoutはレスポンスヘッダが届くまでにだけ適用し、streamを読んでいる間は適用しない
+	// clientは他のEventSourceと共有されていることがあるので、書き換えずにコピーを使う
+	c := *s.client
+	c.Timeout = 0
+	// 時間切れでcancelした場合はただの "context canceled" にせず、ConnectTimeoutとして返す
+	var connectTimer *time.Timer
+	var connectTimedOut int32
+	if s.client.Timeout > 0 {
+		connectTimer = time.AfterFunc(s.client.Timeout, func() {
+			atomic.StoreInt32(&connectTimedOut, 1)
+			cancel()
+		})
+	}
+	resp, err := c.Do(req)
+	if connectTimer != nil {
+		connectTimer.Stop()
+	}
+	if atomic.LoadInt32(&connectTimedOut) == 1 {
+		// ヘッダが届いた直後に時間切れになった場合も、もう読めないので同じ扱いにする
+		if err == nil {
+			resp.Body.Close()
+		}
+		return &ConnectTimeout{Timeout: s.client.Timeout}
+	}
 	if err != nil {
-		s.emitError(err)
-		return
+		return err
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusNoContent {
+		return &ClosedByServer{}
+	}
 	if resp.StatusCode != http.StatusOK {
-		s.emitError(&BadStatusCode{StatusCode: resp.StatusCode})
-		return
+		return &BadStatusCode{StatusCode: resp.StatusCode}
 	}
 
 	contentType := resp.Header.Get("Content-Type")
-	if !strings.HasPrefix(contentType, "text/event-stream") {
-		s.emitError(&BadContentType{ContentType: contentType})
-		return
+	if !s.acceptsContentType(contentType) {
+		return &BadContentType{ContentType: contentType}
+	}
+
+	s.openedAt = s.now()
+	s.muStats.Lock()
+	if s.hasOpened {
+		s.stats.Reconnects++
+	}
+	s.hasOpened = true
+	s.muStats.Unlock()
+	s.emitOpen()
+
+	// 接続したまま何も送ってこないサーバーに対して、一定時間何も届かなければこの接続を切って再接続させる
+	var idleTimedOut int32
+	var onLine func()
+	if s.readIdleTimeout > 0 {
+		idleTimer := time.AfterFunc(s.readIdleTimeout, func() {
+			atomic.StoreInt32(&idleTimedOut, 1)
+			cancel()
+		})
+		defer idleTimer.Stop()
+		onLine = func() {
+			idleTimer.Reset(s.readIdleTimeout)
+		}
+	}
+
+	var body io.Reader = resp.Body
+	if resp.Header.Get("Content-Encoding") == "gzip" {
+		gr, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return err
+		}
+		defer gr.Close()
+		body = gr
+	}
+	if s.recorder != nil {
+		body = io.TeeReader(body, s.recorder)
+	}
+
+	err = s.readStream(body, onLine)
+
+	if atomic.LoadInt32(&idleTimedOut) == 1 {
+		return &ReadIdleTimeout{Timeout: s.readIdleTimeout}
 	}
+	return err
+}
 
+// streamを読んでイベントを発火する。onLineがnilでなければ1行読むたびに呼ぶ
+func (s *EventSource) readStream(body io.Reader, onLine func()) error {
 	data := ""
 	event := defaultEvent
 
-	scanner := bufio.NewScanner(resp.Body) // TODO: もしBOMがあったら無視する仕様
+	// ストリームの先頭にBOMがあったら無視する仕様
+	br := bufio.NewReader(body)
+	if b, err := br.Peek(len(utf8BOM)); err == nil && bytes.Equal(b, utf8BOM) {
+		br.Discard(len(utf8BOM))
+	}
+
+	scanner := bufio.NewScanner(br)
+	split := newLineSplitter()
+	if onLine != nil {
+		lineSplit := split
+		split = func(data []byte, atEOF bool) (int, []byte, error) {
+			advance, token, err := lineSplit(data, atEOF)
+			if token != nil {
+				onLine()
+			}
+			return advance, token, err
+		}
+	}
+	scanner.Split(split)
+	if s.maxBufferSize > 0 {
+		scanner.Buffer(make([]byte, 0, 4096), s.maxBufferSize)
+	}
+
+	// 途中まで受信したイベントが捨てられても、CloseGracefulを待たせないようにする
+	defer s.endEvent()
 
-	for scanner.Scan() { // TODO: scanner.Scanは\r?\nをdelimiterとするが、SSEの仕様上は\r単独もあり得る
+	// 接続してから最初のイベントまでの間もバッファされているかもしれないので、接続した時刻から測る
+	burst := &burstDetector{last: s.openedAt}
+
+	for scanner.Scan() {
 
 		line := scanner.Text()
 
 		// https://www.w3.org/TR/eventsource/#event-stream-interpretation
 		if line == "" {
 			if data != "" {
-				s.emit(event, data)
-				event = defaultEvent
-				data = ""
+				// 最後のdata行の後ろの改行だけ取り除く
+				data = strings.TrimSuffix(data, "\n")
+				now := s.now()
+				s.muStats.Lock()
+				s.stats.Events++
+				s.stats.DataBytes += len(data)
+				s.stats.LastEventAt = now
+				s.muStats.Unlock()
+				s.dispatch(event, data)
+				if s.detectBuffering {
+					if err := burst.observe(now); err != nil {
+						s.emitError(err)
+					}
+				}
+			}
+			// dataが無くてもイベントの種類はリセットする仕様
+			event = defaultEvent
+			data = ""
+			if s.endEvent() {
+				// CloseGracefulで待っていたイベントを発火し終えたので、これ以上は読まない
+				return nil
 			}
 			continue
 		}
+		if strings.HasPrefix(line, ":") {
+			s.emitComment(strings.TrimPrefix(line[1:], " "))
+			continue
+		}
 		split := strings.SplitN(line, ":", 2)
 		field := split[0]
 		value := ""
@@ -194,22 +885,82 @@ func (s *EventSource) request() {
 		case "event":
 			event = value
 		case "retry":
-			if n, err := strconv.Atoi(value); err != nil {
+			if n, err := strconv.Atoi(value); err == nil && n >= 0 {
 				s.retryWait = time.Duration(n) * time.Millisecond
+				if s.retryWait < minRetryWait {
+					s.retryWait = minRetryWait
+				}
 			}
 		case "id":
+			// NULを含むidは無視する仕様。空のidはLast-Event-IDをリセットする
+			if strings.Contains(value, "\x00") {
+				break
+			}
+			s.checkMonotonicID(value)
+			s.muLastEventID.Lock()
 			s.lastEventID = value
+			s.muLastEventID.Unlock()
 		case "data":
-			if data != "" {
-				data += "\n"
+			// 値が空のdata行も空行として数える。改行は最後に発火するときに1つだけ取り除く
+			if data == "" {
+				s.startEvent()
 			}
-			data += value
+			data += value + "\n"
 		default:
 			// ignore
 		}
 	}
 
-	if err := scanner.Err(); err != nil {
-		s.emitError(err)
+	return scanner.Err()
+}
+
+// NewEventSourceFromReaderで作ったときに、サーバーに接続する代わりにreaderを読む
+func (s *EventSource) replay() error {
+	s.openedAt = s.now()
+	s.muStats.Lock()
+	s.hasOpened = true
+	s.muStats.Unlock()
+	s.emitOpen()
+
+	return s.readStream(&contextReader{ctx: s.ctx, r: s.reader}, nil)
+}
+
+// ctxが終わったら読むのをやめる
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+// SSEの仕様では行の区切りは\r\n, \n, \r単独のいずれもあり得るが、bufio.ScanLinesは\r単独を扱えない
+// https://www.w3.org/TR/eventsource/#parsing-an-event-stream
+func newLineSplitter() bufio.SplitFunc {
+	// \rで行を切ったあとに続く\nは、\r\nの一部なので読み飛ばす
+	skipLF := false
+
+	return func(data []byte, atEOF bool) (int, []byte, error) {
+		offset := 0
+		if skipLF && len(data) > 0 && data[0] == '\n' {
+			offset = 1
+		}
+		rest := data[offset:]
+		if i := bytes.IndexAny(rest, "\r\n"); i >= 0 {
+			skipLF = rest[i] == '\r'
+			return offset + i + 1, rest[:i], nil
+		}
+		if atEOF && len(rest) > 0 {
+			skipLF = false
+			return len(data), rest, nil
+		}
+		if offset > 0 {
+			skipLF = false
+		}
+		return offset, nil, nil
 	}
 }
@@ -0,0 +1,1234 @@
+package sse
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/isucon/isucon6-final/bench/http"
+	"github.com/isucon/isucon6-final/bench/http/httptest"
+)
+
+func newStreamServer(body string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, body)
+	}))
+}
+
+func collectStrokes(t *testing.T, body string) []string {
+	ts := newStreamServer(body)
+	defer ts.Close()
+
+	s := NewEventSource(&http.Client{}, ts.URL)
+	got := []string{}
+	s.On("stroke", func(data string) {
+		got = append(got, data)
+	})
+	if err := s.request(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	return got
+}
+
+func TestRequestLineDelimiters(t *testing.T) {
+	want := []string{"1", "2\n3"}
+
+	streams := map[string]string{
+		"LF":    "event: stroke\ndata: 1\n\nevent: stroke\ndata: 2\ndata: 3\n\n",
+		"CR":    "event: stroke\rdata: 1\r\revent: stroke\rdata: 2\rdata: 3\r\r",
+		"CRLF":  "event: stroke\r\ndata: 1\r\n\r\nevent: stroke\r\ndata: 2\r\ndata: 3\r\n\r\n",
+		"mixed": "event: stroke\rdata: 1\n\r\nevent: stroke\r\ndata: 2\rdata: 3\n\r",
+	}
+
+	for name, body := range streams {
+		got := collectStrokes(t, body)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: want %q, got %q", name, want, got)
+		}
+	}
+}
+
+func TestRequestDataFields(t *testing.T) {
+	cases := []struct {
+		name string
+		body string
+		want []string
+	}{
+		{"single", "event: stroke\ndata: {\"id\":1}\n\n", []string{`{"id":1}`}},
+		{"multi-line", "event: stroke\ndata: <svg>\ndata:   <polyline/>\ndata: </svg>\n\n", []string{"<svg>\n  <polyline/>\n</svg>"}},
+		{"empty", "event: stroke\ndata\n\nevent: stroke\ndata:\n\n", []string{"", ""}},
+		{"empty lines", "event: stroke\ndata:\ndata: 1\ndata:\ndata\n\n", []string{"\n1\n\n"}},
+		// dataの無いイベントは発火しないが、イベントの種類はリセットされる
+		{"no data", "event: stroke\n\ndata: 1\n\nevent: stroke\ndata: 2\n\n", []string{"2"}},
+	}
+
+	for _, c := range cases {
+		got := collectStrokes(t, c.body)
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: want %q, got %q", c.name, c.want, got)
+		}
+	}
+}
+
+func TestRequestSkipsBOM(t *testing.T) {
+	got := collectStrokes(t, "\xEF\xBB\xBFevent: stroke\ndata: 1\n\nevent: stroke\ndata: \xEF\xBB\xBF2\n\n")
+	want := []string{"1", "\xEF\xBB\xBF2"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestRequestRetry(t *testing.T) {
+	ts := newStreamServer("retry: 5000\n\n")
+	defer ts.Close()
+
+	s := NewEventSource(&http.Client{}, ts.URL)
+	s.request()
+	if s.retryWait != 5*time.Second {
+		t.Errorf("want %s, got %s", 5*time.Second, s.retryWait)
+	}
+
+	ts2 := newStreamServer("retry: abc\n\nretry: -1\n\n")
+	defer ts2.Close()
+
+	s.url = ts2.URL
+	s.request()
+	if s.retryWait != 5*time.Second {
+		t.Errorf("want %s, got %s", 5*time.Second, s.retryWait)
+	}
+
+	ts3 := newStreamServer("retry: 0\n\n")
+	defer ts3.Close()
+
+	s.url = ts3.URL
+	s.request()
+	if s.retryWait != minRetryWait {
+		t.Errorf("want %s, got %s", minRetryWait, s.retryWait)
+	}
+}
+
+func TestOpenFiresOnEveryConnection(t *testing.T) {
+	ts := newStreamServer("retry: 100\n\n")
+	defer ts.Close()
+
+	s := NewEventSource(&http.Client{}, ts.URL)
+	opened := 0
+	s.OnOpen(func() {
+		opened++
+		if opened == 2 {
+			s.Close()
+		}
+	})
+	ended := false
+	s.OnEnd(func() {
+		ended = true
+	})
+	s.Open()
+
+	if opened != 2 {
+		t.Errorf("want %d, got %d", 2, opened)
+	}
+	if !ended {
+		t.Errorf("OnEnd was not called")
+	}
+}
+
+func TestOpenNotFiredOnBadStatus(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer ts.Close()
+
+	s := NewEventSource(&http.Client{}, ts.URL)
+	opened := false
+	s.OnOpen(func() {
+		opened = true
+	})
+	s.request()
+
+	if opened {
+		t.Errorf("OnOpen should not be called on bad status")
+	}
+}
+
+func TestLastEventID(t *testing.T) {
+	ts := newStreamServer("id: 1\nevent: stroke\ndata: 1\n\nid: 2\nevent: stroke\ndata: 2\n\nid: 3\nevent: stroke\ndata: 3\n\n")
+	defer ts.Close()
+
+	s := NewEventSource(&http.Client{}, ts.URL)
+	if id := s.LastEventID(); id != "" {
+		t.Errorf("want %q, got %q", "", id)
+	}
+	s.request()
+	if id := s.LastEventID(); id != "3" {
+		t.Errorf("want %q, got %q", "3", id)
+	}
+}
+
+func TestOpenOnce(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/bad_status":
+			w.WriteHeader(http.StatusNotFound)
+		case "/bad_content_type":
+			w.Header().Set("Content-Type", "text/html")
+		default:
+			w.Header().Set("Content-Type", "text/event-stream")
+			fmt.Fprint(w, "event: stroke\ndata: 1\n\n")
+		}
+	}))
+	defer ts.Close()
+
+	err := NewEventSource(&http.Client{}, ts.URL+"/bad_status").OpenOnce()
+	if e, ok := err.(*BadStatusCode); !ok || e.StatusCode != http.StatusNotFound {
+		t.Errorf("want BadStatusCode, got %#v", err)
+	}
+
+	err = NewEventSource(&http.Client{}, ts.URL+"/bad_content_type").OpenOnce()
+	if e, ok := err.(*BadContentType); !ok || e.ContentType != "text/html" {
+		t.Errorf("want BadContentType, got %#v", err)
+	}
+
+	s := NewEventSource(&http.Client{}, ts.URL+"/")
+	received := 0
+	s.On("stroke", func(data string) {
+		received++
+	})
+	ended := false
+	s.OnEnd(func() {
+		ended = true
+	})
+	err = s.OpenOnce()
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if received != 1 {
+		t.Errorf("want %d, got %d", 1, received)
+	}
+	if !ended {
+		t.Errorf("OnEnd was not called")
+	}
+}
+
+func TestMaxBufferSize(t *testing.T) {
+	large := strings.Repeat("x", 100*1024)
+	ts := newStreamServer("event: stroke\ndata: " + large + "\n\n")
+	defer ts.Close()
+
+	s := NewEventSource(&http.Client{}, ts.URL)
+	err := s.request()
+	if err != bufio.ErrTooLong {
+		t.Errorf("want %v, got %v", bufio.ErrTooLong, err)
+	}
+
+	s = NewEventSource(&http.Client{}, ts.URL)
+	s.SetMaxBufferSize(200 * 1024)
+	got := ""
+	s.On("stroke", func(data string) {
+		got = data
+	})
+	err = s.request()
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if got != large {
+		t.Errorf("want %d bytes, got %d bytes", len(large), len(got))
+	}
+}
+
+func TestOnAny(t *testing.T) {
+	ts := newStreamServer("event: stroke\ndata: 1\n\nevent: unknown\ndata: 2\n\ndata: 3\n\n")
+	defer ts.Close()
+
+	s := NewEventSource(&http.Client{}, ts.URL)
+	strokes := []string{}
+	s.On("stroke", func(data string) {
+		strokes = append(strokes, data)
+	})
+	all := []string{}
+	s.OnAny(func(event, data string) {
+		all = append(all, event+":"+data)
+	})
+	if err := s.request(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if want := []string{"1"}; !reflect.DeepEqual(strokes, want) {
+		t.Errorf("want %q, got %q", want, strokes)
+	}
+	if want := []string{"stroke:1", "unknown:2", "message:3"}; !reflect.DeepEqual(all, want) {
+		t.Errorf("want %q, got %q", want, all)
+	}
+}
+
+func TestOff(t *testing.T) {
+	ts := newStreamServer("event: stroke\ndata: 1\n\n")
+	defer ts.Close()
+
+	s := NewEventSource(&http.Client{}, ts.URL)
+	fired := 0
+	s.On("stroke", func(data string) {
+		fired++
+	})
+	s.On("stroke", func(data string) {
+		fired++
+	})
+	if n := s.Off("stroke"); n != 2 {
+		t.Errorf("want %d, got %d", 2, n)
+	}
+	if err := s.request(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if fired != 0 {
+		t.Errorf("want %d, got %d", 0, fired)
+	}
+
+	s.On("stroke", func(data string) {
+		fired++
+	})
+	s.On("bad_request", func(data string) {
+		fired++
+	})
+	s.OnAny(func(event, data string) {
+		fired++
+	})
+	if n := s.OffAll(); n != 3 {
+		t.Errorf("want %d, got %d", 3, n)
+	}
+	if err := s.request(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if fired != 0 {
+		t.Errorf("want %d, got %d", 0, fired)
+	}
+}
+
+func TestConcurrentOnAndEmit(t *testing.T) {
+	ts := newStreamServer(strings.Repeat("event: stroke\ndata: 1\n\n", 1000))
+	defer ts.Close()
+
+	s := NewEventSource(&http.Client{}, ts.URL)
+	s.On("stroke", func(data string) {
+		s.Off("unknown") // listenerの中から呼んでもデッドロックしない
+	})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			s.On("stroke", func(data string) {})
+			s.OnAny(func(event, data string) {})
+		}
+	}()
+
+	if err := s.request(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	<-done
+}
+
+func TestBackoff(t *testing.T) {
+	// 5回失敗したあと1回だけ接続に成功し、その後はまた失敗し続ける
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests != 6 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+	}))
+	defer ts.Close()
+
+	s := NewEventSource(&http.Client{}, ts.URL)
+	s.SetBackoff(100*time.Millisecond, time.Second)
+
+	// 呼ばれるたびに1分進む時計にして、成功した接続は十分長く続いたことにする
+	now := time.Now()
+	s.now = func() time.Time {
+		now = now.Add(time.Minute)
+		return now
+	}
+	waits := []time.Duration{}
+	s.sleep = func(d time.Duration) {
+		waits = append(waits, d)
+		if len(waits) == 7 {
+			s.Close()
+		}
+	}
+	s.Open()
+
+	want := []time.Duration{
+		100 * time.Millisecond,
+		200 * time.Millisecond,
+		400 * time.Millisecond,
+		800 * time.Millisecond,
+		time.Second,
+		100 * time.Millisecond, // 接続に成功したので戻る
+		200 * time.Millisecond,
+	}
+	if len(waits) != len(want) {
+		t.Fatalf("want %d, got %d", len(want), len(waits))
+	}
+	for i, w := range want {
+		if waits[i] < w/2 || waits[i] > w {
+			t.Errorf("%d: want between %s and %s, got %s", i, w/2, w, waits[i])
+		}
+	}
+}
+
+func TestDefaultBackoff(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer ts.Close()
+
+	// 何も設定しなくても、1秒から DefaultBackoffMax まで延びていく
+	s := NewEventSource(&http.Client{}, ts.URL)
+	waits := []time.Duration{}
+	s.sleep = func(d time.Duration) {
+		waits = append(waits, d)
+		if len(waits) == 7 {
+			s.Close()
+		}
+	}
+	s.Open()
+
+	want := []time.Duration{
+		time.Second,
+		2 * time.Second,
+		4 * time.Second,
+		8 * time.Second,
+		16 * time.Second,
+		DefaultBackoffMax,
+		DefaultBackoffMax,
+	}
+	if len(waits) != len(want) {
+		t.Fatalf("want %d, got %d", len(want), len(waits))
+	}
+	for i, w := range want {
+		if waits[i] < w/2 || waits[i] > w {
+			t.Errorf("%d: want between %s and %s, got %s", i, w/2, w, waits[i])
+		}
+	}
+}
+
+func TestNoBackoff(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer ts.Close()
+
+	// maxをbase以下にすれば延ばさない
+	s := NewEventSource(&http.Client{}, ts.URL)
+	s.SetBackoff(time.Second, 0)
+	waits := []time.Duration{}
+	s.sleep = func(d time.Duration) {
+		waits = append(waits, d)
+		if len(waits) == 3 {
+			s.Close()
+		}
+	}
+	s.Open()
+
+	for i, w := range waits {
+		if w != time.Second {
+			t.Errorf("%d: want %s, got %s", i, time.Second, w)
+		}
+	}
+}
+
+func TestCancelParentContext(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "event: stroke\ndata: 1\n\n")
+		w.(http.Flusher).Flush()
+		<-w.(http.CloseNotifier).CloseNotify()
+	}))
+	defer ts.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s := NewEventSourceWithContext(ctx, &http.Client{}, ts.URL)
+	s.On("stroke", func(data string) {
+		cancel()
+	})
+	s.OnError(func(err error) {
+		t.Errorf("unexpected error: %v", err)
+	})
+	ended := make(chan struct{})
+	s.OnEnd(func() {
+		close(ended)
+	})
+	go s.Open()
+
+	select {
+	case <-ended:
+	case <-time.After(3 * time.Second):
+		t.Errorf("Open did not return after the parent context was cancelled")
+	}
+}
+
+func TestStats(t *testing.T) {
+	ts := newStreamServer("retry: 100\n\nevent: stroke\ndata: 1\n\nevent: stroke\ndata: 22\n\ndata: 333\n\n")
+	defer ts.Close()
+
+	// 1回再接続して、2回分のストリームを受け取ったら閉じる
+	s := NewEventSource(&http.Client{}, ts.URL)
+	s.OnAny(func(event, data string) {
+		if s.Stats().Events == 6 {
+			s.Close()
+		}
+	})
+	s.Open()
+
+	stats := s.Stats()
+	if stats.Events != 6 {
+		t.Errorf("want %d, got %d", 6, stats.Events)
+	}
+	if stats.DataBytes != 12 {
+		t.Errorf("want %d, got %d", 12, stats.DataBytes)
+	}
+	if stats.Reconnects != 1 {
+		t.Errorf("want %d, got %d", 1, stats.Reconnects)
+	}
+	if stats.LastEventAt.IsZero() {
+		t.Errorf("LastEventAt is not set")
+	}
+}
+
+func TestGzipStream(t *testing.T) {
+	acceptEncoding := ""
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		acceptEncoding = r.Header.Get("Accept-Encoding")
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Content-Encoding", "gzip")
+		gw := gzip.NewWriter(w)
+		fmt.Fprint(gw, "event: stroke\ndata: 1\n\n")
+		gw.Close()
+	}))
+	defer ts.Close()
+
+	// 頼んでいなくてもgzipで返してくるサーバー
+	c := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+	s := NewEventSource(c, ts.URL)
+	got := []string{}
+	s.On("stroke", func(data string) {
+		got = append(got, data)
+	})
+	if err := s.request(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if acceptEncoding != "" {
+		t.Errorf("want %q, got %q", "", acceptEncoding)
+	}
+
+	s.SetAcceptGzip(true)
+	if err := s.request(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if acceptEncoding != "gzip" {
+		t.Errorf("want %q, got %q", "gzip", acceptEncoding)
+	}
+
+	if want := []string{"1", "1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestLastEventIDHeaderOnReconnect(t *testing.T) {
+	headers := []string{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers = append(headers, r.Header.Get("Last-Event-ID"))
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprintf(w, "retry: 100\nid: %d\nevent: stroke\ndata: 1\n\n", len(headers))
+	}))
+	defer ts.Close()
+
+	s := NewEventSource(&http.Client{}, ts.URL)
+	opened := 0
+	s.OnOpen(func() {
+		opened++
+		if opened == 3 {
+			s.Close()
+		}
+	})
+	s.Open()
+
+	if want := []string{"", "1", "2"}; !reflect.DeepEqual(headers, want) {
+		t.Errorf("want %q, got %q", want, headers)
+	}
+}
+
+func TestLastEventIDParam(t *testing.T) {
+	queries := []url.Values{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries = append(queries, r.URL.Query())
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprintf(w, "retry: 100\nid: %d\nevent: stroke\ndata: 1\n\n", len(queries))
+	}))
+	defer ts.Close()
+
+	s := NewEventSource(&http.Client{}, ts.URL+"/api/stream/rooms/1?csrf_token=abc")
+	s.SetLastEventIDParam("last_event_id")
+	opened := 0
+	s.OnOpen(func() {
+		opened++
+		if opened == 3 {
+			s.Close()
+		}
+	})
+	s.Open()
+
+	if len(queries) != 3 {
+		t.Fatalf("want 3 requests, got %d", len(queries))
+	}
+	if _, ok := queries[0]["last_event_id"]; ok {
+		t.Errorf("want no last_event_id on the first request, got %v", queries[0])
+	}
+	for i, want := range []string{"1", "2"} {
+		q := queries[i+1]
+		if q.Get("csrf_token") != "abc" || len(q["last_event_id"]) != 1 || q.Get("last_event_id") != want {
+			t.Errorf("want last_event_id=%s with csrf_token, got %v", want, q)
+		}
+	}
+}
+
+func TestLastEventIDWithNUL(t *testing.T) {
+	ts := newStreamServer("id: 1\ndata: 1\n\nid: 2\x003\ndata: 2\n\n")
+	defer ts.Close()
+
+	s := NewEventSource(&http.Client{}, ts.URL)
+	s.request()
+	if id := s.LastEventID(); id != "1" {
+		t.Errorf("want %q, got %q", "1", id)
+	}
+
+	ts2 := newStreamServer("id\ndata: 3\n\n")
+	defer ts2.Close()
+
+	s.url = ts2.URL
+	s.request()
+	if id := s.LastEventID(); id != "" {
+		t.Errorf("want %q, got %q", "", id)
+	}
+}
+
+func TestOnComment(t *testing.T) {
+	ts := newStreamServer(": keep-alive\n\n:keep-alive\n\nevent: stroke\ndata: 1\n\n")
+	defer ts.Close()
+
+	s := NewEventSource(&http.Client{}, ts.URL)
+	comments := []string{}
+	s.OnComment(func(comment string) {
+		comments = append(comments, comment)
+	})
+	events := []string{}
+	s.OnAny(func(event, data string) {
+		events = append(events, event)
+	})
+	if err := s.request(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if want := []string{"keep-alive", "keep-alive"}; !reflect.DeepEqual(comments, want) {
+		t.Errorf("want %q, got %q", want, comments)
+	}
+	if want := []string{"stroke"}; !reflect.DeepEqual(events, want) {
+		t.Errorf("want %q, got %q", want, events)
+	}
+}
+
+func TestReadIdleTimeout(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "retry: 100\n\n")
+		w.(http.Flusher).Flush()
+		<-w.(http.CloseNotifier).CloseNotify()
+	}))
+	defer ts.Close()
+
+	s := NewEventSource(&http.Client{}, ts.URL)
+	s.SetReadIdleTimeout(200 * time.Millisecond)
+	opened := 0
+	s.OnOpen(func() {
+		opened++
+	})
+	timeouts := 0
+	s.OnError(func(err error) {
+		if _, ok := err.(*ReadIdleTimeout); !ok {
+			t.Errorf("want ReadIdleTimeout, got %#v", err)
+		}
+		timeouts++
+		if timeouts == 2 {
+			s.Close()
+		}
+	})
+
+	done := make(chan struct{})
+	go func() {
+		s.Open()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		s.Close()
+		t.Fatalf("the silent connection was not aborted")
+	}
+	if opened != 2 {
+		t.Errorf("want %d, got %d", 2, opened)
+	}
+}
+
+func TestCloseGraceful(t *testing.T) {
+	for _, complete := range []bool{true, false} {
+		proceed := make(chan struct{})
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/event-stream")
+			// 2つめのイベントは空行が届く前にCloseGracefulされる
+			fmt.Fprint(w, "data: 1\n\ndata: 2\n")
+			w.(http.Flusher).Flush()
+			if complete {
+				<-proceed
+				fmt.Fprint(w, "\n")
+				w.(http.Flusher).Flush()
+			}
+			<-w.(http.CloseNotifier).CloseNotify()
+		}))
+
+		s := NewEventSource(&http.Client{}, ts.URL)
+		var mu sync.Mutex
+		got := []string{}
+		s.On("message", func(data string) {
+			mu.Lock()
+			got = append(got, data)
+			mu.Unlock()
+		})
+		ended := make(chan struct{})
+		s.OnEnd(func() {
+			close(ended)
+		})
+		go s.Open()
+
+		// 2つめのイベントを受信し始めるまで待つ
+		for i := 0; ; i++ {
+			s.muDrain.Lock()
+			pending := s.pending
+			s.muDrain.Unlock()
+			if pending {
+				break
+			}
+			if i == 300 {
+				t.Fatalf("the second event was not received")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		go func() {
+			time.Sleep(100 * time.Millisecond)
+			close(proceed)
+		}()
+		s.CloseGraceful(time.Second)
+
+		select {
+		case <-ended:
+		case <-time.After(3 * time.Second):
+			t.Fatalf("Open did not return after CloseGraceful")
+		}
+
+		want := []string{"1"}
+		if complete {
+			want = []string{"1", "2"}
+		}
+		mu.Lock()
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("want %q, got %q", want, got)
+		}
+		mu.Unlock()
+
+		ts.Close()
+	}
+}
+
+func TestOpenContext(t *testing.T) {
+	// 接続中にキャンセルする場合と、再接続を待っている間にキャンセルする場合
+	for _, reconnecting := range []bool{false, true} {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/event-stream")
+			fmt.Fprint(w, "retry: 10000\n\nevent: stroke\ndata: 1\n\n")
+			w.(http.Flusher).Flush()
+			if !reconnecting {
+				<-w.(http.CloseNotifier).CloseNotify()
+			}
+		}))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		s := NewEventSource(&http.Client{}, ts.URL)
+		s.On("stroke", func(data string) {
+			go func() {
+				time.Sleep(100 * time.Millisecond)
+				cancel()
+			}()
+		})
+		ended := make(chan struct{})
+		s.OnEnd(func() {
+			close(ended)
+		})
+		done := make(chan struct{})
+		go func() {
+			s.OpenContext(ctx)
+			close(done)
+		}()
+
+		select {
+		case <-done:
+		case <-time.After(3 * time.Second):
+			s.Close()
+			t.Fatalf("reconnecting=%v: OpenContext did not return after the context was cancelled", reconnecting)
+		}
+		select {
+		case <-ended:
+		default:
+			t.Errorf("reconnecting=%v: OnEnd was not called", reconnecting)
+		}
+
+		cancel()
+		ts.Close()
+	}
+}
+
+func TestSharedClientTimeout(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			// レスポンスヘッダを返すまでに時間がかかる
+			time.Sleep(time.Second)
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.(http.Flusher).Flush()
+		// client.Timeoutより長くかかっても、stream中は切られない
+		time.Sleep(500 * time.Millisecond)
+		fmt.Fprint(w, "event: stroke\ndata: 1\n\n")
+	}))
+	defer ts.Close()
+
+	client := &http.Client{Timeout: 300 * time.Millisecond}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s := NewEventSource(client, ts.URL)
+			got := []string{}
+			s.On("stroke", func(data string) {
+				got = append(got, data)
+			})
+			if err := s.OpenOnce(); err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if want := []string{"1"}; !reflect.DeepEqual(got, want) {
+				t.Errorf("want %q, got %q", want, got)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if client.Timeout != 300*time.Millisecond {
+		t.Errorf("want %s, got %s", 300*time.Millisecond, client.Timeout)
+	}
+
+	s := NewEventSource(client, ts.URL+"/slow")
+	start := time.Now()
+	err := s.OpenOnce()
+	if err, ok := err.(*ConnectTimeout); !ok || err.Timeout != client.Timeout {
+		t.Errorf("want ConnectTimeout, got %#v", err)
+	}
+	if d := time.Since(start); d > 900*time.Millisecond {
+		t.Errorf("want the request aborted after about %s, took %s", client.Timeout, d)
+	}
+}
+
+func TestAsyncDispatch(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i := 1; i <= 20; i++ {
+			fmt.Fprintf(w, "id: %d\nevent: stroke\ndata: %d\n\n", i, i)
+		}
+		w.(http.Flusher).Flush()
+		<-w.(http.CloseNotifier).CloseNotify()
+	}))
+	defer ts.Close()
+
+	s := NewEventSource(&http.Client{}, ts.URL)
+	s.SetAsyncDispatch(100)
+	var mu sync.Mutex
+	got := []string{}
+	s.On("stroke", func(data string) {
+		// 遅いlistener。同期的に呼ぶと全部で1秒かかる
+		time.Sleep(50 * time.Millisecond)
+		mu.Lock()
+		got = append(got, data)
+		mu.Unlock()
+	})
+	ended := make(chan struct{})
+	s.OnEnd(func() {
+		close(ended)
+	})
+	go s.Open()
+
+	// listenerが終わるのを待たずに最後まで読み進めている
+	deadline := time.Now().Add(500 * time.Millisecond)
+	for s.LastEventID() != "20" {
+		if time.Now().After(deadline) {
+			t.Fatalf("reading the stream stalled at id %q", s.LastEventID())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	mu.Lock()
+	if len(got) == 20 {
+		t.Errorf("want the listener still running, got all events delivered")
+	}
+	mu.Unlock()
+
+	s.Close()
+	select {
+	case <-ended:
+	case <-time.After(3 * time.Second):
+		t.Fatalf("Open did not return")
+	}
+
+	// OnEndの前に残っていたイベントも順番通りに全部発火している
+	want := []string{}
+	for i := 1; i <= 20; i++ {
+		want = append(want, fmt.Sprint(i))
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestClosedByServer(t *testing.T) {
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	s := NewEventSource(&http.Client{}, ts.URL)
+	var gotErr error
+	s.OnError(func(err error) {
+		gotErr = err
+	})
+	ended := false
+	s.OnEnd(func() {
+		ended = true
+	})
+
+	done := make(chan struct{})
+	go func() {
+		s.Open()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		s.Close()
+		t.Fatalf("Open kept reconnecting after 204")
+	}
+
+	if _, ok := gotErr.(*ClosedByServer); !ok {
+		t.Errorf("want ClosedByServer, got %#v", gotErr)
+	}
+	if !ended {
+		t.Errorf("OnEnd was not called")
+	}
+	if requests != 1 {
+		t.Errorf("want %d, got %d", 1, requests)
+	}
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	stream := "retry: 100\n\nid: 1\nevent: stroke\ndata: {\"id\":1}\n\nevent: watcher_count\ndata: 2\n\nid: 2\nevent: stroke\ndata: {\"id\":2}\n\n"
+	ts := newStreamServer(stream)
+	defer ts.Close()
+
+	var recorded bytes.Buffer
+	s := NewEventSource(&http.Client{}, ts.URL)
+	s.SetRecorder(&recorded)
+	var live []string
+	s.OnAny(func(event, data string) {
+		live = append(live, event+" "+data)
+	})
+	if err := s.OpenOnce(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if recorded.String() != stream {
+		t.Errorf("want %q, got %q", stream, recorded.String())
+	}
+
+	now := time.Date(2016, 10, 22, 10, 0, 0, 0, time.UTC)
+	r := NewEventSourceFromReader(strings.NewReader(recorded.String()))
+	r.SetClock(func() time.Time {
+		return now
+	})
+	var replayed []string
+	r.OnAny(func(event, data string) {
+		replayed = append(replayed, event+" "+data)
+	})
+	ended := make(chan struct{})
+	r.OnEnd(func() {
+		close(ended)
+	})
+	go r.Open()
+	select {
+	case <-ended:
+	case <-time.After(3 * time.Second):
+		r.Close()
+		t.Fatalf("Open did not return at the end of the recorded stream")
+	}
+
+	if !reflect.DeepEqual(replayed, live) {
+		t.Errorf("want %q, got %q", live, replayed)
+	}
+	if r.LastEventID() != "2" {
+		t.Errorf("want %q, got %q", "2", r.LastEventID())
+	}
+	if at := r.Stats().LastEventAt; !at.Equal(now) {
+		t.Errorf("want %s, got %s", now, at)
+	}
+}
+
+func TestMaxReconnects(t *testing.T) {
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer ts.Close()
+
+	s := NewEventSource(&http.Client{}, ts.URL)
+	s.SetMaxReconnects(3)
+	s.sleep = func(d time.Duration) {}
+	ended := false
+	s.OnEnd(func() {
+		ended = true
+	})
+
+	done := make(chan struct{})
+	go func() {
+		s.Open()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		s.Close()
+		t.Fatalf("Open kept reconnecting")
+	}
+
+	if requests != 4 {
+		t.Errorf("want %d, got %d", 4, requests)
+	}
+	if !ended {
+		t.Errorf("OnEnd was not called")
+	}
+	err, ok := s.EndReason().(*TooManyReconnects)
+	if !ok {
+		t.Fatalf("want TooManyReconnects, got %#v", s.EndReason())
+	}
+	if _, ok := err.Err.(*BadStatusCode); !ok {
+		t.Errorf("want BadStatusCode, got %#v", err.Err)
+	}
+}
+
+func TestSetAcceptedContentTypes(t *testing.T) {
+	var contentType string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		fmt.Fprint(w, "data: hello\n\n")
+	}))
+	defer ts.Close()
+
+	request := func(s *EventSource) ([]string, error) {
+		got := []string{}
+		s.On("message", func(data string) {
+			got = append(got, data)
+		})
+		err := s.request()
+		return got, err
+	}
+
+	contentType = "text/event-stream; charset=utf-8"
+	got, err := request(NewEventSource(&http.Client{}, ts.URL))
+	if err != nil || !reflect.DeepEqual(got, []string{"hello"}) {
+		t.Errorf("something went wrong: %q, %v", got, err)
+	}
+
+	// 登録していなければ受け付けない
+	contentType = "application/stream+json"
+	_, err = request(NewEventSource(&http.Client{}, ts.URL))
+	if e, ok := err.(*BadContentType); !ok || e.ContentType != contentType {
+		t.Errorf("want BadContentType, got %#v", err)
+	}
+
+	s := NewEventSource(&http.Client{}, ts.URL)
+	s.SetAcceptedContentTypes("application/stream+json")
+	got, err = request(s)
+	if err != nil || !reflect.DeepEqual(got, []string{"hello"}) {
+		t.Errorf("something went wrong: %q, %v", got, err)
+	}
+
+	// 登録したもの以外はこれまで通り受け付けない
+	contentType = "text/plain"
+	s = NewEventSource(&http.Client{}, ts.URL)
+	s.SetAcceptedContentTypes("application/stream+json")
+	_, err = request(s)
+	if _, ok := err.(*BadContentType); !ok {
+		t.Errorf("want BadContentType, got %#v", err)
+	}
+}
+
+func TestEnforceMonotonicID(t *testing.T) {
+	collectErrors := func(stream string, enforce bool) []error {
+		s := NewEventSourceFromReader(strings.NewReader(stream))
+		s.SetEnforceMonotonicID(enforce)
+		errs := []error{}
+		s.OnError(func(err error) {
+			errs = append(errs, err)
+		})
+		s.Open()
+		return errs
+	}
+
+	stream := "id: 1\ndata: a\n\nid: 3\ndata: b\n\nid: 2\ndata: c\n\nid: 4\ndata: d\n\n"
+
+	errs := collectErrors(stream, true)
+	if len(errs) != 1 {
+		t.Fatalf("want 1 error, got %v", errs)
+	}
+	if err, ok := errs[0].(*OutOfOrderID); !ok || err.Prev != 3 || err.ID != 2 {
+		t.Errorf("want OutOfOrderID{3, 2}, got %#v", errs[0])
+	}
+
+	// 有効にしなければ何もしない
+	if errs := collectErrors(stream, false); len(errs) != 0 {
+		t.Errorf("want no errors, got %v", errs)
+	}
+
+	// 整数でないidが来たら、それ以降は確かめない
+	stream = "id: 2\ndata: a\n\nid: abc\ndata: b\n\nid: 1\ndata: c\n\n"
+	if errs := collectErrors(stream, true); len(errs) != 0 {
+		t.Errorf("want no errors, got %v", errs)
+	}
+}
+
+func TestRegisterAfterClose(t *testing.T) {
+	s := NewEventSourceFromReader(strings.NewReader(": comment\ndata: a\n\n"))
+	s.Close()
+
+	called := []string{}
+	s.On("message", func(data string) {
+		called = append(called, "On")
+	})
+	s.OnAny(func(event, data string) {
+		called = append(called, "OnAny")
+	})
+	s.OnError(func(err error) {
+		called = append(called, "OnError")
+	})
+	s.OnOpen(func() {
+		called = append(called, "OnOpen")
+	})
+	s.OnComment(func(comment string) {
+		called = append(called, "OnComment")
+	})
+	// OnEndだけはOpenが終わるときに呼ばれるので登録できる
+	s.OnEnd(func() {
+		called = append(called, "OnEnd")
+	})
+
+	if n := s.OffAll(); n != 0 {
+		t.Errorf("want no listeners, got %d", n)
+	}
+	if s.errListener != nil || s.openListener != nil || s.commentListener != nil {
+		t.Error("listeners registered after Close")
+	}
+
+	s.Open()
+	if want := []string{"OnEnd"}; !reflect.DeepEqual(called, want) {
+		t.Errorf("want %v, got %v", want, called)
+	}
+}
+
+func TestDetectBuffering(t *testing.T) {
+	start := time.Now()
+	collectErrors := func(offsets []time.Duration, detect bool) []error {
+		// 接続した時刻と、それぞれのイベントが届いた時刻を順番に返す
+		times := []time.Time{start}
+		stream := ""
+		for i, offset := range offsets {
+			times = append(times, start.Add(offset))
+			stream += fmt.Sprintf("data: %d\n\n", i)
+		}
+		s := NewEventSourceFromReader(strings.NewReader(stream))
+		s.SetClock(func() time.Time {
+			t := times[0]
+			if len(times) > 1 {
+				times = times[1:]
+			}
+			return t
+		})
+		s.SetDetectBuffering(detect)
+		errs := []error{}
+		s.OnError(func(err error) {
+			errs = append(errs, err)
+		})
+		s.Open()
+		return errs
+	}
+
+	// 5秒何も届かなかった後に、4つのイベントがほぼ同時に届いた
+	bursty := []time.Duration{
+		5 * time.Second,
+		5*time.Second + 10*time.Microsecond,
+		5*time.Second + 20*time.Microsecond,
+		5*time.Second + 30*time.Microsecond,
+		6 * time.Second,
+	}
+	errs := collectErrors(bursty, true)
+	if len(errs) != 1 {
+		t.Fatalf("want 1 error, got %v", errs)
+	}
+	if err, ok := errs[0].(*SuspectedBuffering); !ok || err.Gap != 5*time.Second || err.Events != bufferingBurstEvents {
+		t.Errorf("want SuspectedBuffering{5s, %d}, got %#v", bufferingBurstEvents, errs[0])
+	}
+
+	// 有効にしなければ何もしない
+	if errs := collectErrors(bursty, false); len(errs) != 0 {
+		t.Errorf("want no errors, got %v", errs)
+	}
+
+	// 間隔が空かずに届いているだけならバッファされていない
+	steady := []time.Duration{
+		100 * time.Millisecond,
+		100*time.Millisecond + 10*time.Microsecond,
+		100*time.Millisecond + 20*time.Microsecond,
+		100*time.Millisecond + 30*time.Microsecond,
+	}
+	if errs := collectErrors(steady, true); len(errs) != 0 {
+		t.Errorf("want no errors, got %v", errs)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ベンチマーカーのノードが最後にジョブを取りに来たり結果を送ってきたりした時刻
+// portalを再起動すると消えるが、実行中のジョブはqueuesから拾える
+var (
+	benchNodesLastSeen = map[string]time.Time{}
+	muBenchNodes       sync.Mutex
+)
+
+func touchBenchNode(name string) {
+	if name == "" {
+		return
+	}
+	muBenchNodes.Lock()
+	benchNodesLastSeen[name] = timeNow()
+	muBenchNodes.Unlock()
+}
+
+type BenchNode struct {
+	Name       string     `json:"name"`
+	LastSeenAt time.Time  `json:"last_seen_at"`
+	JobID      int        `json:"job_id,omitempty"` // 実行中のジョブが無ければ0
+	TeamID     int        `json:"team_id,omitempty"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+}
+
+type BenchNodes []BenchNode
+
+func (ns BenchNodes) Len() int           { return len(ns) }
+func (ns BenchNodes) Less(i, j int) bool { return ns[i].Name < ns[j].Name }
+func (ns BenchNodes) Swap(i, j int)      { ns[i], ns[j] = ns[j], ns[i] }
+
+// これまでに見かけたノードと、それぞれが実行中のジョブを名前順に返す
+func getBenchNodes() ([]BenchNode, error) {
+	nodes := map[string]*BenchNode{}
+
+	muBenchNodes.Lock()
+	for name, t := range benchNodesLastSeen {
+		nodes[name] = &BenchNode{Name: name, LastSeenAt: t}
+	}
+	muBenchNodes.Unlock()
+
+	rows, err := db.Query(`
+      SELECT id, team_id, bench_node, started_at FROM queues
+      WHERE status = 'running' AND bench_node IS NOT NULL`)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get running jobs")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			jobID, teamID int
+			name          string
+			startedAt     *time.Time // 列を足す前から走っていたジョブはNULL
+		)
+		err := rows.Scan(&jobID, &teamID, &name, &startedAt)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to scan running jobs")
+		}
+		n, ok := nodes[name]
+		if !ok {
+			n = &BenchNode{Name: name}
+			nodes[name] = n
+		}
+		if startedAt != nil && n.LastSeenAt.Before(*startedAt) {
+			n.LastSeenAt = *startedAt
+		}
+		n.JobID = jobID
+		n.TeamID = teamID
+		n.StartedAt = startedAt
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	list := make([]BenchNode, 0, len(nodes))
+	for _, n := range nodes {
+		list = append(list, *n)
+	}
+	sort.Sort(BenchNodes(list))
+	return list, nil
+}
+
+// serveBenchNodes は運営がベンチマーカーのノードごとに、最後に見かけた時刻と実行中のジョブを確認するエンドポイント。
+func serveBenchNodes(w http.ResponseWriter, req *http.Request) error {
+	if req.Method != http.MethodGet {
+		return errHTTP(http.StatusMethodNotAllowed)
+	}
+
+	nodes, err := getBenchNodes()
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(nodes)
+}
@@ -0,0 +1,12 @@
+-- schema.sqlで作った既存のデータベースに、後から追加したカラムを足す
+-- MySQLにはADD COLUMN IF NOT EXISTSが無いので、1回だけ流すこと
+-- 新しく作る場合はschema.sqlだけでよい
+
+ALTER TABLE queues
+    ADD COLUMN started_at DATETIME DEFAULT NULL AFTER stderr,
+    ADD COLUMN finished_at DATETIME DEFAULT NULL AFTER started_at,
+    ADD COLUMN lease_expires_at DATETIME DEFAULT NULL AFTER finished_at,
+    ADD COLUMN dry_run TINYINT UNSIGNED NOT NULL DEFAULT 0 AFTER lease_expires_at;
+
+ALTER TABLE results
+    ADD COLUMN dry_run TINYINT UNSIGNED NOT NULL DEFAULT 0 AFTER messages; -- リハーサル用。ランキングには載せない
@@ -17,6 +17,7 @@ CREATE TABLE IF NOT EXISTS results (
     pass TINYINT UNSIGNED NOT NULL,
     score BIGINT NOT NULL,
     messages MEDIUMTEXT,
+    dry_run TINYINT UNSIGNED NOT NULL DEFAULT 0, -- リハーサル用。ランキングには載せない
     created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
     PRIMARY KEY (id),
     KEY team_id (team_id)
@@ -28,6 +29,10 @@ CREATE TABLE IF NOT EXISTS queues (
     status ENUM('waiting', 'running', 'done', 'aborted') NOT NULL DEFAULT 'waiting',
     bench_node VARCHAR(64) DEFAULT NULL,
     stderr MEDIUMTEXT,
+    started_at DATETIME DEFAULT NULL,
+    finished_at DATETIME DEFAULT NULL,
+    lease_expires_at DATETIME DEFAULT NULL,
+    dry_run TINYINT UNSIGNED NOT NULL DEFAULT 0,
     created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
     updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
     KEY queues_team_status_idx (team_id, status)
@@ -4,6 +4,8 @@ type Job struct {
 	ID     int    `json:"id"`
 	TeamID int    `json:"teamID"`
 	URLs   string `json:"urls"`
+	// ジョブを取り出したベンチマーカーのノード。結果を送るときにそのまま返す
+	BenchNode string `json:"benchNode"`
 }
 
 type Result struct {
@@ -16,4 +18,28 @@ type Output struct {
 	Pass     bool     `json:"pass"`
 	Score    int64    `json:"score"`
 	Messages []string `json:"messages"`
+	// 点数の内訳。ベンチマークが最後まで走らなかったときは空
+	Strokes *StrokeBreakdown `json:"strokes,omitempty"`
 }
+
+// 受け取ったstrokeの内訳
+type StrokeBreakdown struct {
+	Posted   int `json:"posted"`
+	OnTime   int `json:"on_time"`
+	Late     int `json:"late"`
+	Wrong    int `json:"wrong"`
+	Unknown  int `json:"unknown"`
+	Missing  int `json:"missing"`
+	Watchers int `json:"watchers"`
+}
+
+// ポータルがベンチマーカーのノードにエラーを返すときのレスポンス
+type Error struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+const (
+	// チームのプロキシのURLが取得できなかった
+	ErrorCodeProxyURLs = "proxy_urls_unavailable"
+)
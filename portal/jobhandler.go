@@ -1,25 +1,63 @@
 package main
 
 import (
+	"crypto/subtle"
+	"database/sql"
 	"encoding/json"
 	"fmt"
+	"log"
+	"net"
 	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/isucon/isucon6-final/portal/job"
+	"github.com/pkg/errors"
 )
 
+const (
+	// ベンチマーカーのノードと共有する秘密の値を持つ環境変数。-insecure-bench-nodes を付けない限り必須
+	benchNodeSecretEnv = "ISU6F_BENCH_NODE_SECRET"
+	// ノードが秘密の値を送るヘッダ
+	benchNodeSecretHeader = "X-Isu6FPortal-Bench-Secret"
+)
+
+// 秘密の値が無いと全てのノードを黙って拒否することになるので、起動時に確かめる
+// 開発中に手元でノードを動かすときは -insecure-bench-nodes で確認を外せる
+func checkBenchNodeSecret() error {
+	if os.Getenv(benchNodeSecretEnv) == "" && !*insecureBenchNodes {
+		return fmt.Errorf("%s is not set; set it to the secret shared with bench nodes, or pass -insecure-bench-nodes for development", benchNodeSecretEnv)
+	}
+	return nil
+}
+
+// ベンチマーカーのノード向けのエンドポイントに、共有している秘密の値を持っているかの確認を加える
+func requireBenchNodeSecret(fn handler) handler {
+	return func(w http.ResponseWriter, req *http.Request) error {
+		secret := os.Getenv(benchNodeSecretEnv)
+		if secret == "" && *insecureBenchNodes {
+			return fn(w, req)
+		}
+		given := req.Header.Get(benchNodeSecretHeader)
+		if secret == "" || subtle.ConstantTimeCompare([]byte(secret), []byte(given)) != 1 {
+			return errHTTP(http.StatusUnauthorized)
+		}
+		return fn(w, req)
+	}
+}
+
 // serveQueueJob は参加者がベンチマーカのジョブをキューに挿入するエンドポイント。
 func serveQueueJob(w http.ResponseWriter, req *http.Request) error {
 	if req.Method != http.MethodPost {
 		return errHTTP(http.StatusMethodNotAllowed)
 	}
 
-	// 18時になったらコンテスト終了なのでジョブを挿入させない
-	switch getContestStatus() {
-	case contestStatusNotStarted:
-		return errHTTPMessage{http.StatusForbidden, "Final has not started yet"}
-	case contestStatusEnded:
-		return errHTTPMessage{http.StatusForbidden, "Final has finished"}
+	dryRun := isDryRunRequest(req)
+	err := checkContestAcceptsJob(dryRun)
+	if err != nil {
+		return err
 	}
 
 	team, err := loadTeamFromSession(req)
@@ -33,8 +71,24 @@ func serveQueueJob(w http.ResponseWriter, req *http.Request) error {
 	if team.IPAddr == "" {
 		return errHTTP(http.StatusBadRequest)
 	}
+	if _, err := normalizeIPAddr(team.IPAddr); err != nil {
+		return errHTTPMessage{http.StatusBadRequest, err.Error()}
+	}
 
-	err = enqueueJob(team.ID)
+	cooldown, err := getJobCooldown(team.ID)
+	if err != nil {
+		return err
+	}
+	if cooldown > 0 {
+		// 1チームがベンチマーカーを占有しないように、終わってすぐには積ませない
+		return serveIndexWithMessage(w, req, fmt.Sprintf("Please wait %d seconds before queueing the next job", int(cooldown/time.Second)))
+	}
+
+	if dryRun {
+		err = enqueueDryRunJob(team.ID)
+	} else {
+		err = enqueueJob(team.ID)
+	}
 	if err != nil {
 		if _, ok := err.(errAlreadyQueued); ok {
 			// ユーザに教えてあげる
@@ -44,20 +98,278 @@ func serveQueueJob(w http.ResponseWriter, req *http.Request) error {
 		return err
 	}
 
-	// TODO(motemen): flash
+	msg := "Job queued"
+	if dryRun {
+		msg = "Dry run job queued (the result will not be ranked)"
+	}
+	err = addFlash(w, req, msg)
+	if err != nil {
+		return err
+	}
 	http.Redirect(w, req, "/", http.StatusFound)
 
 	return nil
 }
 
-// 新しいジョブを取り出す。ジョブが無い場合は 204 を返す
-// クライアントは定期的(3秒おきくらい)にリクエストしてジョブを確認する
+func isDryRunRequest(req *http.Request) bool {
+	return req.FormValue("dry_run") == "1"
+}
+
+// dry runはリハーサル用なのでコンテスト開始前でも積める
+func checkContestAcceptsJob(dryRun bool) error {
+	// 18時になったらコンテスト終了なのでジョブを挿入させない
+	switch getContestStatus() {
+	case contestStatusNotStarted:
+		if !dryRun {
+			return errHTTPMessage{http.StatusForbidden, "Final has not started yet"}
+		}
+	case contestStatusEnded:
+		return errHTTPMessage{http.StatusForbidden, "Final has finished"}
+	}
+	return nil
+}
+
+// serveRequeueLast は参加者が直前のジョブと同じ設定でもう一度ジョブを積むエンドポイント。
+// 一時的な失敗の後に同じデプロイのままベンチマークをやり直すときに使う
+func serveRequeueLast(w http.ResponseWriter, req *http.Request) error {
+	if req.Method != http.MethodPost {
+		return errHTTP(http.StatusMethodNotAllowed)
+	}
+
+	team, err := loadTeamFromSession(req)
+	if err != nil {
+		return err
+	}
+	if team == nil {
+		return errHTTP(http.StatusForbidden)
+	}
+
+	dryRun, err := getLastJobDryRun(team.ID)
+	if err != nil {
+		if _, ok := err.(errNoPreviousJob); ok {
+			return errHTTPMessage{http.StatusNotFound, "No previous job"}
+		}
+		return err
+	}
+	err = checkContestAcceptsJob(dryRun)
+	if err != nil {
+		return err
+	}
+
+	if _, err := normalizeIPAddr(team.IPAddr); err != nil {
+		return errHTTPMessage{http.StatusBadRequest, err.Error()}
+	}
+
+	cooldown, err := getJobCooldown(team.ID)
+	if err != nil {
+		return err
+	}
+	if cooldown > 0 {
+		return errHTTPMessage{http.StatusTooManyRequests, fmt.Sprintf("Please wait %d seconds before queueing the next job", int(cooldown/time.Second))}
+	}
+
+	err = insertJob(team.ID, dryRun)
+	if err != nil {
+		if _, ok := err.(errAlreadyQueued); ok {
+			return errHTTPMessage{http.StatusConflict, "Job already queued"}
+		}
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(map[string]bool{"success": true, "dry_run": dryRun})
+}
+
+// serveJobStatus は参加者が自分のチームのジョブの状態を確認するエンドポイント。
+func serveJobStatus(w http.ResponseWriter, req *http.Request) error {
+	if req.Method != http.MethodGet {
+		return errHTTP(http.StatusMethodNotAllowed)
+	}
+
+	team, err := loadTeamFromSession(req)
+	if err != nil {
+		return err
+	}
+	if team == nil {
+		return errHTTP(http.StatusForbidden)
+	}
+
+	st, err := getJobStatus(team.ID)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(st)
+}
+
+// serveCancelJob は参加者がまだ実行されていない自分のチームのジョブを取り消すエンドポイント。
+func serveCancelJob(w http.ResponseWriter, req *http.Request) error {
+	if req.Method != http.MethodPost {
+		return errHTTP(http.StatusMethodNotAllowed)
+	}
+
+	team, err := loadTeamFromSession(req)
+	if err != nil {
+		return err
+	}
+	if team == nil {
+		return errHTTP(http.StatusForbidden)
+	}
+
+	err = cancelJob(team.ID)
+	if err != nil {
+		switch err.(type) {
+		case errJobRunning:
+			return errHTTPMessage{http.StatusConflict, "Job is already running and cannot be canceled"}
+		case errJobNotQueued:
+			return errHTTPMessage{http.StatusNotFound, "No job queued"}
+		}
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, `{"success":true}`)
+	return nil
+}
+
+const (
+	jobHistoryDefaultLimit = 10
+	jobHistoryMaxLimit     = 100
+
+	// 履歴に含める失敗メッセージの最大数
+	jobHistoryMaxMessages = 5
+)
+
+type JobHistoryItem struct {
+	Score     int64     `json:"score"`
+	Pass      bool      `json:"pass"`
+	DryRun    bool      `json:"dry_run"`
+	CreatedAt time.Time `json:"created_at"`
+	Messages  []string  `json:"messages"`
+}
+
+// serveJobHistory は参加者が自分のチームの過去の結果を新しい順に確認するエンドポイント。
+// limitで件数を指定できる
+func serveJobHistory(w http.ResponseWriter, req *http.Request) error {
+	if req.Method != http.MethodGet {
+		return errHTTP(http.StatusMethodNotAllowed)
+	}
+
+	team, err := loadTeamFromSession(req)
+	if err != nil {
+		return err
+	}
+	if team == nil {
+		return errHTTP(http.StatusForbidden)
+	}
+
+	limit := jobHistoryDefaultLimit
+	if v := req.FormValue("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit < 1 {
+			return errHTTPMessage{http.StatusBadRequest, "limit must be a positive integer"}
+		}
+		if limit > jobHistoryMaxLimit {
+			limit = jobHistoryMaxLimit
+		}
+	}
+
+	results, err := getRecentTeamResults(db, team.ID, limit)
+	if err != nil {
+		return err
+	}
+
+	items := make([]JobHistoryItem, 0, len(results))
+	for _, r := range results {
+		messages := []string{}
+		if r.Msg != "" {
+			messages = strings.Split(r.Msg, "\n")
+		}
+		if len(messages) > jobHistoryMaxMessages {
+			messages = messages[:jobHistoryMaxMessages]
+		}
+		items = append(items, JobHistoryItem{
+			Score:     r.Score,
+			Pass:      r.Pass == 1,
+			DryRun:    r.DryRun == 1,
+			CreatedAt: r.At,
+			Messages:  messages,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(items)
+}
+
+// serveJobFailures は参加者が自分のチームの直近の結果の失敗メッセージを、同じものはまとめて確認するエンドポイント。
+func serveJobFailures(w http.ResponseWriter, req *http.Request) error {
+	if req.Method != http.MethodGet {
+		return errHTTP(http.StatusMethodNotAllowed)
+	}
+
+	team, err := loadTeamFromSession(req)
+	if err != nil {
+		return err
+	}
+	if team == nil {
+		return errHTTP(http.StatusForbidden)
+	}
+
+	failures, err := getLatestFailureMessages(db, team.ID, latestFailuresLimit)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(failures)
+}
+
+// 前後の空白を取り除いてIPアドレスとしてパースし、正規化した文字列を返す(v4, v6どちらも可)
+// カンマや空白で区切られた複数の値は受け付けない
+func normalizeIPAddr(addr string) (string, error) {
+	addr = strings.TrimSpace(addr)
+	if strings.ContainsAny(addr, ", \t\r\n") {
+		return "", fmt.Errorf("Invalid IP address (only one address is allowed): %q", addr)
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return "", fmt.Errorf("Invalid IP address: %q", addr)
+	}
+	return ip.String(), nil
+}
+
+// serveNewJob でジョブが積まれるのを待つ最大時間
+const newJobLongPollTimeout = 30 * time.Second
+
+// serveQueueStats は今どれだけジョブが溜まっているかを返すエンドポイント。
+func serveQueueStats(w http.ResponseWriter, req *http.Request) error {
+	if req.Method != http.MethodGet {
+		return errHTTP(http.StatusMethodNotAllowed)
+	}
+
+	st, err := getQueueStats(db)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(st)
+}
+
+// serveNewJobでジョブに載せるURLを取得する。テストで差し替える
+var getJobURLs = getProxyURLs
+
+// 新しいジョブを取り出す。ジョブが無い場合は積まれるまで最大 newJobLongPollTimeout 待ち、
+// それでも無ければ 204 を返す
+// クライアントは 204 が返ってきたら改めてリクエストしてジョブを確認する
 func serveNewJob(w http.ResponseWriter, req *http.Request) error {
 	if req.Method != http.MethodPost {
 		return errHTTP(http.StatusMethodNotAllowed)
 	}
 	benchNode := req.FormValue("bench_node")
-	j, err := dequeueJob(benchNode)
+	touchBenchNode(benchNode)
+	j, err := waitJob(req.Context(), benchNode, newJobLongPollTimeout)
 	if err != nil {
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return nil
@@ -66,9 +378,17 @@ func serveNewJob(w http.ResponseWriter, req *http.Request) error {
 		w.WriteHeader(http.StatusNoContent)
 		return nil
 	}
-	j.URLs, err = getProxyURLs(j.TeamID)
+	j.BenchNode = benchNode
+	j.URLs, err = getJobURLs(j.TeamID)
 	if err != nil {
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		// ノードのログで原因がわかるように、理由をJSONで返す
+		log.Printf("failed to get proxy URLs (teamID=%d): %s", j.TeamID, err)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(job.Error{
+			Code:    job.ErrorCodeProxyURLs,
+			Message: fmt.Sprintf("failed to get proxy URLs (teamID=%d): %s", j.TeamID, err),
+		})
 		return nil
 	}
 	w.Header().Set("Content-Type", "application/json")
@@ -77,6 +397,39 @@ func serveNewJob(w http.ResponseWriter, req *http.Request) error {
 	return nil
 }
 
+// 結果が、実行中でそのノードに渡したジョブのものかを確かめる
+func validateResult(res *job.Result) error {
+	if res.Job == nil || res.Output == nil {
+		return errHTTPMessage{http.StatusBadRequest, "Job and Output are required"}
+	}
+
+	var (
+		teamID    int
+		status    string
+		benchNode string
+	)
+	err := db.QueryRow(`
+      SELECT team_id, status, IFNULL(bench_node, '') FROM queues
+      WHERE id = ?`, res.Job.ID).Scan(&teamID, &status, &benchNode)
+	switch {
+	case err == sql.ErrNoRows:
+		return errHTTPMessage{http.StatusBadRequest, fmt.Sprintf("Unknown job: %d", res.Job.ID)}
+	case err != nil:
+		return errors.Wrap(err, "failed to validate result")
+	}
+
+	if teamID != res.Job.TeamID {
+		return errHTTPMessage{http.StatusBadRequest, fmt.Sprintf("Job %d does not belong to team %d", res.Job.ID, res.Job.TeamID)}
+	}
+	if status != "running" {
+		return errHTTPMessage{http.StatusConflict, fmt.Sprintf("Job %d is not running: %s", res.Job.ID, status)}
+	}
+	if benchNode != res.Job.BenchNode {
+		return errHTTPMessage{http.StatusConflict, fmt.Sprintf("Job %d is not leased to %q", res.Job.ID, res.Job.BenchNode)}
+	}
+	return nil
+}
+
 func servePostResult(w http.ResponseWriter, req *http.Request) error {
 	if req.Method != http.MethodPost {
 		http.Error(w, "Method Not Allowd", http.StatusMethodNotAllowed)
@@ -92,6 +445,11 @@ func servePostResult(w http.ResponseWriter, req *http.Request) error {
 		http.Error(w, err.Error(), 400)
 		return nil
 	}
+	err = validateResult(&res)
+	if err != nil {
+		return err
+	}
+	touchBenchNode(res.Job.BenchNode)
 	err = doneJob(&res)
 	if err != nil {
 		return err
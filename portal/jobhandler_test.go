@@ -0,0 +1,830 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/isucon/isucon6-final/portal/job"
+)
+
+// debugモードのcookieでチームとしてリクエストを送る
+func requestAsTeam(h handler, method, path string, teamID string) *httptest.ResponseRecorder {
+	*debugMode = true
+	req := httptest.NewRequest(method, path, nil)
+	req.AddCookie(&http.Cookie{Name: "debug_team", Value: teamID})
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+func getJobStatusAsTeam(t *testing.T, teamID string) JobStatus {
+	w := requestAsTeam(serveJobStatus, http.MethodGet, "/api/job/status", teamID)
+	if w.Code != http.StatusOK {
+		t.Fatalf("want %d, got %d", http.StatusOK, w.Code)
+	}
+	var st JobStatus
+	err := json.NewDecoder(w.Body).Decode(&st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return st
+}
+
+func TestServeJobStatus(t *testing.T) {
+	// 事前に `TRUNCATE queues` しないと動きません…
+	err := initWeb()
+	if err != nil {
+		t.Fatal(err)
+	}
+	*startsAtHour = -1
+	*endsAtHour = -1
+
+	for _, id := range []int{21, 22} {
+		_, err = db.Exec(`
+      INSERT IGNORE INTO teams (id, name, password, category, azure_resource_group)
+      VALUES (?, ?, '', 'official', '')`, id, fmt.Sprintf("team%d", id))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// ジョブを積んでいない
+	st := getJobStatusAsTeam(t, "21")
+	if st.State != jobStateNone || st.PositionInQueue != 0 {
+		t.Errorf("something went wrong: %#v", st)
+	}
+
+	// ジョブを積むと待ち状態になる
+	err = enqueueJob(21)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = enqueueJob(22)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st = getJobStatusAsTeam(t, "22")
+	if st.State != "waiting" || st.PositionInQueue != 2 || st.StartedAt != nil {
+		t.Errorf("something went wrong: %#v", st)
+	}
+
+	// 取り出されると実行中になり、後ろのジョブは前に進む
+	j, err := dequeueJob("host1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	st = getJobStatusAsTeam(t, "21")
+	if st.State != "running" || st.PositionInQueue != 0 || st.StartedAt == nil || st.FinishedAt != nil {
+		t.Errorf("something went wrong: %#v", st)
+	}
+	st = getJobStatusAsTeam(t, "22")
+	if st.State != "waiting" || st.PositionInQueue != 1 {
+		t.Errorf("something went wrong: %#v", st)
+	}
+
+	// あとかたづけ
+	err = doneJob(&job.Result{Job: j, Output: &job.Output{}})
+	if err != nil {
+		t.Error(err)
+	}
+	st = getJobStatusAsTeam(t, "21")
+	if st.State != "done" || st.FinishedAt == nil {
+		t.Errorf("something went wrong: %#v", st)
+	}
+	j, err = dequeueJob("host2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = doneJob(&job.Result{Job: j, Output: &job.Output{}})
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestServeQueueJobCooldown(t *testing.T) {
+	// 事前に `TRUNCATE queues` しないと動きません…
+	err := initWeb()
+	if err != nil {
+		t.Fatal(err)
+	}
+	*startsAtHour = -1
+	*endsAtHour = -1
+
+	_, err = db.Exec(`
+      INSERT IGNORE INTO teams (id, name, password, ip_address, category, azure_resource_group)
+      VALUES (41, 'team41', '', '127.0.0.1', 'official', '')`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := requestAsTeam(serveQueueJob, http.MethodPost, "/queue", "41")
+	if w.Code != http.StatusFound {
+		t.Fatalf("want %d, got %d", http.StatusFound, w.Code)
+	}
+
+	j, err := dequeueJob("host1")
+	if err != nil || j == nil || j.TeamID != 41 {
+		t.Fatalf("something went wrong: %#v, %v", j, err)
+	}
+	err = doneJob(&job.Result{Job: j, Output: &job.Output{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 終わってすぐには積めない
+	w = requestAsTeam(serveQueueJob, http.MethodPost, "/queue", "41")
+	if w.Code != http.StatusOK {
+		t.Errorf("want %d, got %d", http.StatusOK, w.Code)
+	}
+	if !strings.Contains(w.Body.String(), "before queueing the next job") {
+		t.Errorf("something went wrong: %s", w.Body.String())
+	}
+	st := getJobStatusAsTeam(t, "41")
+	if st.State != "done" {
+		t.Errorf("something went wrong: %#v", st)
+	}
+}
+
+func TestServeQueueJobDryRun(t *testing.T) {
+	// 事前に `TRUNCATE queues` しないと動きません…
+	err := initWeb()
+	if err != nil {
+		t.Fatal(err)
+	}
+	*startsAtHour = -1
+	*endsAtHour = -1
+
+	// コンテストはまだ始まっていない
+	startsAt := time.Now().Add(time.Hour)
+	contestStartsAt = &startsAt
+	defer func() {
+		contestStartsAt = nil
+	}()
+
+	_, err = db.Exec(`
+      INSERT IGNORE INTO teams (id, name, password, ip_address, category, azure_resource_group)
+      VALUES (48, 'team48', '', '127.0.0.1', 'general', '')`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 普通のジョブは積めない
+	w := requestAsTeam(serveQueueJob, http.MethodPost, "/queue", "48")
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("want %d, got %d", http.StatusForbidden, w.Code)
+	}
+
+	// dry runなら積める
+	w = requestAsTeam(serveQueueJob, http.MethodPost, "/queue?dry_run=1", "48")
+	if w.Code != http.StatusFound {
+		t.Fatalf("want %d, got %d", http.StatusFound, w.Code)
+	}
+
+	j, err := dequeueJob("host1")
+	if err != nil || j == nil || j.TeamID != 48 {
+		t.Fatalf("something went wrong: %#v, %v", j, err)
+	}
+	err = doneJob(&job.Result{Job: j, Output: &job.Output{Pass: true, Score: 1000}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 結果はdry runとして記録され、ランキングには載らない
+	results, err := getRecentTeamResults(db, 48, 1)
+	if err != nil || len(results) != 1 || results[0].DryRun != 1 {
+		t.Errorf("something went wrong: %#v, %v", results, err)
+	}
+	scores, err := getBestScores(db, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, bs := range scores {
+		if bs.TeamID == 48 {
+			t.Errorf("something went wrong: %#v", bs)
+		}
+	}
+}
+
+func TestServeRequeueLast(t *testing.T) {
+	// 事前に `TRUNCATE queues` しないと動きません…
+	err := initWeb()
+	if err != nil {
+		t.Fatal(err)
+	}
+	*startsAtHour = -1
+	*endsAtHour = -1
+
+	_, err = db.Exec(`
+      INSERT IGNORE INTO teams (id, name, password, ip_address, category, azure_resource_group)
+      VALUES (51, 'team51', '', '127.0.0.1', 'general', '')`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// まだ1回も積んでいなければ積み直せない
+	w := requestAsTeam(serveRequeueLast, http.MethodPost, "/api/job/requeue", "51")
+	if w.Code != http.StatusNotFound {
+		t.Errorf("want %d, got %d", http.StatusNotFound, w.Code)
+	}
+
+	err = enqueueDryRunJob(51)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j, err := dequeueJob("host1")
+	if err != nil || j == nil || j.TeamID != 51 {
+		t.Fatalf("something went wrong: %#v, %v", j, err)
+	}
+	err = doneJob(&job.Result{Job: j, Output: &job.Output{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 終わってすぐには積み直せない
+	w = requestAsTeam(serveRequeueLast, http.MethodPost, "/api/job/requeue", "51")
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("want %d, got %d", http.StatusTooManyRequests, w.Code)
+	}
+
+	_, err = db.Exec(`
+      UPDATE queues SET finished_at = NOW() - INTERVAL ? SECOND WHERE id = ?`, int(2*jobCooldownInterval/time.Second), j.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w = requestAsTeam(serveRequeueLast, http.MethodPost, "/api/job/requeue", "51")
+	if w.Code != http.StatusOK {
+		t.Fatalf("want %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	st := getJobStatusAsTeam(t, "51")
+	if st.State != "waiting" {
+		t.Errorf("something went wrong: %#v", st)
+	}
+
+	// 直前のジョブと同じくdry runとして積まれる
+	requeued, err := dequeueJob("host1")
+	if err != nil || requeued == nil || requeued.TeamID != 51 || requeued.ID == j.ID {
+		t.Fatalf("something went wrong: %#v, %v", requeued, err)
+	}
+	err = doneJob(&job.Result{Job: requeued, Output: &job.Output{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, err := getRecentTeamResults(db, 51, 1)
+	if err != nil || len(results) != 1 || results[0].DryRun != 1 {
+		t.Errorf("something went wrong: %#v, %v", results, err)
+	}
+}
+
+func TestNormalizeIPAddr(t *testing.T) {
+	testCases := []struct {
+		addr   string
+		expect string
+		valid  bool
+	}{
+		{"203.0.113.1", "203.0.113.1", true},
+		{" 203.0.113.1\n", "203.0.113.1", true},
+		{"2001:db8::1", "2001:db8::1", true},
+		{"2001:0db8:0000:0000:0000:0000:0000:0001", "2001:db8::1", true},
+		{"", "", false},
+		{"203.0.113", "", false},
+		{"203.0.113.256", "", false},
+		{"example.com", "", false},
+		{"203.0.113.1,203.0.113.2", "", false},
+		{"203.0.113.1 203.0.113.2", "", false},
+	}
+
+	for _, tc := range testCases {
+		got, err := normalizeIPAddr(tc.addr)
+		if tc.valid {
+			if err != nil || got != tc.expect {
+				t.Errorf("%q: want %q, got %q (err=%v)", tc.addr, tc.expect, got, err)
+			}
+		} else if err == nil {
+			t.Errorf("%q: want an error, got %q", tc.addr, got)
+		}
+	}
+}
+
+func TestServeProxyNginxConf(t *testing.T) {
+	err := initWeb()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.Exec(`
+      INSERT IGNORE INTO teams (id, name, password, ip_address, category, azure_resource_group)
+      VALUES (525, 'team525', '', ' 203.0.113.5 ', 'general', ''),
+             (526, 'team526', '', '2001:0db8::0001', 'general', ''),
+             (527, 'team527', '', '203.0.113.7,203.0.113.8', 'general', '')`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	handler(serveProxyNginxConf).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("want %d, got %d", http.StatusOK, w.Code)
+	}
+	conf := w.Body.String()
+	if !strings.Contains(conf, "listen 10525;\n  proxy_pass 203.0.113.5:443;") {
+		t.Errorf("something went wrong: %s", conf)
+	}
+	if !strings.Contains(conf, "listen 10526;\n  proxy_pass [2001:db8::1]:443;") {
+		t.Errorf("something went wrong: %s", conf)
+	}
+	// 不正なアドレスのチームは設定に含めない
+	if strings.Contains(conf, "team527") || strings.Contains(conf, "203.0.113.7") {
+		t.Errorf("something went wrong: %s", conf)
+	}
+}
+
+func TestServeNewJobLongPoll(t *testing.T) {
+	// 事前に `TRUNCATE queues` しないと動きません…
+	err := initWeb()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		req := httptest.NewRequest(http.MethodPost, "/"+pathPrefixInternal+"job/new", strings.NewReader("bench_node=host1"))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		handler(serveNewJob).ServeHTTP(w, req)
+		done <- w
+	}()
+
+	// ノードが待ち始めてからジョブを積む
+	time.Sleep(200 * time.Millisecond)
+	err = enqueueJob(46)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var w *httptest.ResponseRecorder
+	select {
+	case w = <-done:
+	case <-time.After(newJobLongPollTimeout / 2):
+		t.Fatal("the job was not returned while long-polling")
+	}
+	if w.Code != http.StatusOK {
+		t.Fatalf("want %d, got %d", http.StatusOK, w.Code)
+	}
+	var j job.Job
+	err = json.NewDecoder(w.Body).Decode(&j)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if j.TeamID != 46 {
+		t.Errorf("something went wrong: %#v", j)
+	}
+
+	// あとかたづけ
+	err = doneJob(&job.Result{Job: &j, Output: &job.Output{}})
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestServeNewJobProxyURLsError(t *testing.T) {
+	// 事前に `TRUNCATE queues` しないと動きません…
+	err := initWeb()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	getJobURLs = func(teamID int) (string, error) {
+		return "", fmt.Errorf("no proxies for team %d", teamID)
+	}
+	defer func() {
+		getJobURLs = getProxyURLs
+	}()
+
+	err = enqueueJob(47)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/"+pathPrefixInternal+"job/new", strings.NewReader("bench_node=host1"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	handler(serveNewJob).ServeHTTP(w, req)
+
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("want %d, got %d", http.StatusInternalServerError, w.Code)
+	}
+	var e job.Error
+	err = json.NewDecoder(w.Body).Decode(&e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Code != job.ErrorCodeProxyURLs || !strings.Contains(e.Message, "no proxies for team 47") {
+		t.Errorf("something went wrong: %#v", e)
+	}
+
+	// あとかたづけ
+	_, err = db.Exec(`UPDATE queues SET status = 'done' WHERE team_id = ? AND status = 'running'`, 47)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestWaitJobContextDone(t *testing.T) {
+	// 事前に `TRUNCATE queues` しないと動きません…
+	err := initWeb()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	start := time.Now()
+	j, err := waitJob(ctx, "host1", time.Minute)
+	if err != nil || j != nil {
+		t.Errorf("something went wrong: %#v, %v", j, err)
+	}
+	if d := time.Since(start); d > 10*time.Second {
+		t.Errorf("waitJob did not return on cancel: %s", d)
+	}
+}
+
+func TestServeCancelJob(t *testing.T) {
+	// 事前に `TRUNCATE queues` しないと動きません…
+	err := initWeb()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.Exec(`
+      INSERT IGNORE INTO teams (id, name, password, category, azure_resource_group)
+      VALUES (47, 'team47', '', 'official', '')`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 積まれていなければ取り消せない
+	w := requestAsTeam(serveCancelJob, http.MethodPost, "/api/job/cancel", "47")
+	if w.Code != http.StatusNotFound {
+		t.Errorf("want %d, got %d", http.StatusNotFound, w.Code)
+	}
+
+	// 待っているジョブは取り消せる
+	err = enqueueJob(47)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = requestAsTeam(serveCancelJob, http.MethodPost, "/api/job/cancel", "47")
+	if w.Code != http.StatusOK {
+		t.Errorf("want %d, got %d", http.StatusOK, w.Code)
+	}
+	st := getJobStatusAsTeam(t, "47")
+	if st.State != "aborted" {
+		t.Errorf("something went wrong: %#v", st)
+	}
+	j, err := dequeueJob("host1")
+	if err != nil || j != nil {
+		t.Errorf("something went wrong: %#v, %v", j, err)
+	}
+
+	// 実行中のジョブは取り消せない
+	err = enqueueJob(47)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j, err = dequeueJob("host1")
+	if err != nil || j == nil {
+		t.Fatalf("something went wrong: %#v, %v", j, err)
+	}
+	w = requestAsTeam(serveCancelJob, http.MethodPost, "/api/job/cancel", "47")
+	if w.Code != http.StatusConflict {
+		t.Errorf("want %d, got %d", http.StatusConflict, w.Code)
+	}
+	if !strings.Contains(w.Body.String(), "already running") {
+		t.Errorf("something went wrong: %s", w.Body.String())
+	}
+
+	// あとかたづけ
+	err = doneJob(&job.Result{Job: j, Output: &job.Output{}})
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestServeJobHistory(t *testing.T) {
+	// 事前に `TRUNCATE results` しないと動きません…
+	err := initWeb()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.Exec(`
+      INSERT IGNORE INTO teams (id, name, password, category, azure_resource_group)
+      VALUES (48, 'team48', '', 'official', '')`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, r := range []struct {
+		pass     int
+		score    int64
+		messages string
+	}{
+		{1, 100, ""},
+		{0, 0, "a\nb\nc\nd\ne\nf"},
+		{1, 300, "a"},
+	} {
+		_, err = db.Exec(`
+      INSERT INTO results (team_id, queue_id, pass, score, messages)
+      VALUES (48, ?, ?, ?, ?)`, 4800+i, r.pass, r.score, r.messages)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	getHistory := func(path string) []JobHistoryItem {
+		w := requestAsTeam(serveJobHistory, http.MethodGet, path, "48")
+		if w.Code != http.StatusOK {
+			t.Fatalf("want %d, got %d", http.StatusOK, w.Code)
+		}
+		var items []JobHistoryItem
+		err := json.NewDecoder(w.Body).Decode(&items)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return items
+	}
+
+	// 新しい順に返る
+	items := getHistory("/api/job/history")
+	if len(items) != 3 {
+		t.Fatalf("something went wrong: %#v", items)
+	}
+	if items[0].Score != 300 || items[1].Score != 0 || items[2].Score != 100 {
+		t.Errorf("something went wrong: %#v", items)
+	}
+	if items[1].Pass || len(items[1].Messages) != jobHistoryMaxMessages {
+		t.Errorf("something went wrong: %#v", items[1])
+	}
+	if len(items[2].Messages) != 0 {
+		t.Errorf("something went wrong: %#v", items[2])
+	}
+
+	// limitで件数を絞れる
+	items = getHistory("/api/job/history?limit=2")
+	if len(items) != 2 || items[0].Score != 300 || items[1].Score != 0 {
+		t.Errorf("something went wrong: %#v", items)
+	}
+
+	w := requestAsTeam(serveJobHistory, http.MethodGet, "/api/job/history?limit=abc", "48")
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("want %d, got %d", http.StatusBadRequest, w.Code)
+	}
+}
+
+func postResult(res *job.Result) *httptest.ResponseRecorder {
+	b, _ := json.Marshal(res)
+	req := httptest.NewRequest(http.MethodPost, "/"+pathPrefixInternal+"job/result", bytes.NewReader(b))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	handler(servePostResult).ServeHTTP(w, req)
+	return w
+}
+
+func TestServePostResultValidation(t *testing.T) {
+	// 事前に `TRUNCATE queues` しないと動きません…
+	err := initWeb()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = enqueueJob(49)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j, err := dequeueJob("host1")
+	if err != nil || j == nil {
+		t.Fatalf("something went wrong: %#v, %v", j, err)
+	}
+
+	// 知らないジョブ
+	w := postResult(&job.Result{
+		Job:    &job.Job{ID: j.ID + 10000, TeamID: 49, BenchNode: "host1"},
+		Output: &job.Output{Pass: true, Score: 100000},
+	})
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("want %d, got %d", http.StatusBadRequest, w.Code)
+	}
+
+	// 別のノードからの結果
+	w = postResult(&job.Result{
+		Job:    &job.Job{ID: j.ID, TeamID: 49, BenchNode: "host2"},
+		Output: &job.Output{Pass: true, Score: 100000},
+	})
+	if w.Code != http.StatusConflict {
+		t.Errorf("want %d, got %d", http.StatusConflict, w.Code)
+	}
+
+	// 正しい結果
+	w = postResult(&job.Result{
+		Job:    &job.Job{ID: j.ID, TeamID: 49, BenchNode: "host1"},
+		Output: &job.Output{Pass: true, Score: 1000},
+	})
+	if w.Code != http.StatusOK {
+		t.Errorf("want %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	// 終わったジョブにはもう送れない
+	w = postResult(&job.Result{
+		Job:    &job.Job{ID: j.ID, TeamID: 49, BenchNode: "host1"},
+		Output: &job.Output{Pass: true, Score: 1000},
+	})
+	if w.Code != http.StatusConflict {
+		t.Errorf("want %d, got %d", http.StatusConflict, w.Code)
+	}
+}
+
+func TestRequireBenchNodeSecret(t *testing.T) {
+	defer os.Setenv(benchNodeSecretEnv, os.Getenv(benchNodeSecretEnv))
+	*startsAtHour = -1
+	*endsAtHour = -1
+
+	called := false
+	h := requireBenchNodeSecret(func(w http.ResponseWriter, req *http.Request) error {
+		called = true
+		return nil
+	})
+	request := func(secret string) int {
+		called = false
+		req := httptest.NewRequest(http.MethodPost, "/"+pathPrefixInternal+"job/new", nil)
+		if secret != "" {
+			req.Header.Set(benchNodeSecretHeader, secret)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// 設定されていなければ起動できず、リクエストも全て拒否
+	os.Setenv(benchNodeSecretEnv, "")
+	if err := checkBenchNodeSecret(); err == nil {
+		t.Errorf("want an error without %s", benchNodeSecretEnv)
+	}
+	if code := request(""); code != http.StatusUnauthorized || called {
+		t.Errorf("want %d, got %d", http.StatusUnauthorized, code)
+	}
+
+	// -insecure-bench-nodes を付ければ確認しない
+	*insecureBenchNodes = true
+	if err := checkBenchNodeSecret(); err != nil {
+		t.Error(err)
+	}
+	if code := request(""); code != http.StatusOK || !called {
+		t.Errorf("want %d, got %d", http.StatusOK, code)
+	}
+	*insecureBenchNodes = false
+
+	os.Setenv(benchNodeSecretEnv, "s3cret")
+	if err := checkBenchNodeSecret(); err != nil {
+		t.Error(err)
+	}
+	if code := request(""); code != http.StatusUnauthorized || called {
+		t.Errorf("want %d, got %d", http.StatusUnauthorized, code)
+	}
+	if code := request("wrong"); code != http.StatusUnauthorized || called {
+		t.Errorf("want %d, got %d", http.StatusUnauthorized, code)
+	}
+	if code := request("s3cret"); code != http.StatusOK || !called {
+		t.Errorf("want %d, got %d", http.StatusOK, code)
+	}
+}
+
+func TestServeQueueStats(t *testing.T) {
+	// 事前に `TRUNCATE queues` しないと動きません…
+	err := initWeb()
+	if err != nil {
+		t.Fatal(err)
+	}
+	*startsAtHour = -1
+	*endsAtHour = -1
+
+	for _, id := range []int{51, 52, 53} {
+		err = enqueueJob(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/queue", nil)
+	w := httptest.NewRecorder()
+	handler(serveQueueStats).ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("want %d, got %d", http.StatusOK, w.Code)
+	}
+	var st QueueStats
+	err = json.NewDecoder(w.Body).Decode(&st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Length != 3 || st.EstimatedWaitSeconds <= 0 {
+		t.Errorf("something went wrong: %#v", st)
+	}
+
+	// あとかたづけ
+	for i := 0; i < 3; i++ {
+		j, err := dequeueJob("host1")
+		if err != nil || j == nil {
+			t.Fatalf("something went wrong: %#v, %v", j, err)
+		}
+		err = doneJob(&job.Result{Job: j, Output: &job.Output{}})
+		if err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestServeBenchNodes(t *testing.T) {
+	// 事前に `TRUNCATE queues` しないと動きません…
+	err := initWeb()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	getJobURLs = func(teamID int) (string, error) {
+		return "127.0.0.1", nil
+	}
+	defer func() {
+		getJobURLs = getProxyURLs
+	}()
+
+	err = enqueueJob(50)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// node-busyはジョブを取っていき、node-idleはジョブが無いまま待っている
+	req := httptest.NewRequest(http.MethodPost, "/"+pathPrefixInternal+"job/new", strings.NewReader("bench_node=node-busy"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	handler(serveNewJob).ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("want %d, got %d", http.StatusOK, w.Code)
+	}
+	var j job.Job
+	err = json.NewDecoder(w.Body).Decode(&j)
+	if err != nil {
+		t.Fatal(err)
+	}
+	touchBenchNode("node-idle")
+
+	req = httptest.NewRequest(http.MethodGet, "/"+pathPrefixInternal+"api/bench/nodes", nil)
+	w = httptest.NewRecorder()
+	handler(serveBenchNodes).ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("want %d, got %d", http.StatusOK, w.Code)
+	}
+	var nodes []BenchNode
+	err = json.NewDecoder(w.Body).Decode(&nodes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]BenchNode{}
+	for _, n := range nodes {
+		got[n.Name] = n
+	}
+	if n := got["node-busy"]; n.JobID != j.ID || n.TeamID != 50 || n.StartedAt == nil || n.LastSeenAt.IsZero() {
+		t.Errorf("something went wrong: %#v", n)
+	}
+	if n, ok := got["node-idle"]; !ok || n.JobID != 0 || n.StartedAt != nil || n.LastSeenAt.IsZero() {
+		t.Errorf("something went wrong: %#v", n)
+	}
+
+	// migrate.sqlで列を足す前から走っていたジョブはstarted_atがNULLになる
+	_, err = db.Exec(`UPDATE queues SET started_at = NULL WHERE id = ?`, j.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodes, err = getBenchNodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range nodes {
+		if n.Name == "node-busy" && (n.JobID != j.ID || n.StartedAt != nil || n.LastSeenAt.IsZero()) {
+			t.Errorf("something went wrong: %#v", n)
+		}
+	}
+
+	// あとかたづけ
+	err = doneJob(&job.Result{Job: &j, Output: &job.Output{}})
+	if err != nil {
+		t.Error(err)
+	}
+}
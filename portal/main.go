@@ -2,6 +2,7 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"log"
 	"net"
 	"net/http"
@@ -21,6 +22,8 @@ var (
 	addr         = flag.String("listen", "localhost:3333", "`address` to listen to")
 	startsAtHour = flag.Int("starts-at", 10, "`hour` the content starts at (JST), no limits when negative")
 	endsAtHour   = flag.Int("ends-at", 18, "`hour` the contest finishes at (JST), no limits when negative")
+
+	insecureBenchNodes = flag.Bool("insecure-bench-nodes", false, "accept bench nodes without "+benchNodeSecretEnv+" (development only)")
 )
 
 var (
@@ -60,7 +63,7 @@ func (fn handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		log.Printf("method:%s\tpath:%s\tstatus:%d\tremote:%s", req.Method, req.URL.RequestURI(), rw.status, req.RemoteAddr)
 	}()
 
-	if getContestStatus() == contestStatusNotStarted && !strings.HasPrefix(req.URL.Path, "/"+pathPrefixInternal) {
+	if getContestStatus() == contestStatusNotStarted && !strings.HasPrefix(req.URL.Path, "/"+pathPrefixInternal) && !isAllowedBeforeStart(req) {
 		http.Error(w, "Final has not started yet", http.StatusForbidden)
 		return
 	}
@@ -81,6 +84,16 @@ func (fn handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
+// コンテスト開始前でもdry runのジョブを積んで結果を見られるように、ログインからジョブの確認までは通す
+// 通常のジョブはserveQueueJobとserveRequeueLastの中で弾く
+func isAllowedBeforeStart(req *http.Request) bool {
+	switch req.URL.Path {
+	case "/", "/login", "/team", "/queue":
+		return true
+	}
+	return strings.HasPrefix(req.URL.Path, "/static/") || strings.HasPrefix(req.URL.Path, "/api/job/")
+}
+
 type contestStatus int
 
 const (
@@ -89,32 +102,82 @@ const (
 	contestStatusEnded
 )
 
-func getContestStatus() contestStatus {
-	now := time.Now()
-	y, m, d := now.Date()
+const (
+	// 設定されていれば、starts-at/ends-atより優先してコンテストの開始/終了時刻にする(RFC3339)
+	// リハーサルなどで日付や分単位で時間をずらしたいときに使う
+	contestStartsAtEnv = "ISU6F_CONTEST_STARTS_AT"
+	contestEndsAtEnv   = "ISU6F_CONTEST_ENDS_AT"
+)
 
-	if *startsAtHour >= 0 {
-		startsAt := time.Date(y, m, d, *startsAtHour, 0, 0, 0, locJST)
-		if now.Before(startsAt) {
-			return contestStatusNotStarted
+var (
+	contestStartsAt *time.Time
+	contestEndsAt   *time.Time
+
+	// テストで時刻を差し替えられるようにする
+	timeNow = time.Now
+)
+
+// 環境変数からコンテストの開始/終了時刻を読み込む
+func loadContestTimes() error {
+	for _, c := range []struct {
+		env string
+		t   **time.Time
+	}{
+		{contestStartsAtEnv, &contestStartsAt},
+		{contestEndsAtEnv, &contestEndsAt},
+	} {
+		v := os.Getenv(c.env)
+		if v == "" {
+			continue
 		}
-	}
-	if *endsAtHour >= 0 {
-		endsAt := time.Date(y, m, d, *endsAtHour, 0, 0, 0, locJST)
-		if now.After(endsAt) {
-			return contestStatusEnded
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %s", c.env, err)
 		}
+		*c.t = &t
+	}
+	return nil
+}
+
+func getContestStatus() contestStatus {
+	now := timeNow()
+
+	if startsAt, ok := getContestStartsAt(); ok && now.Before(startsAt) {
+		return contestStatusNotStarted
+	}
+	if endsAt, ok := getContestEndsAt(); ok && now.After(endsAt) {
+		return contestStatusEnded
 	}
 
 	return contestStatusStarted
 }
 
-func getRankingFixedAt() time.Time {
-	now := time.Now()
-	y, m, d := now.Date()
+// コンテストの開始時刻。指定されていなければfalseを返す
+func getContestStartsAt() (time.Time, bool) {
+	if contestStartsAt != nil {
+		return *contestStartsAt, true
+	}
+	if *startsAtHour < 0 {
+		return time.Time{}, false
+	}
+	y, m, d := timeNow().Date()
+	return time.Date(y, m, d, *startsAtHour, 0, 0, 0, locJST), true
+}
 
-	if *endsAtHour >= 0 {
-		endsAt := time.Date(y, m, d, *endsAtHour, 0, 0, 0, locJST)
+// コンテストの終了時刻。指定されていなければfalseを返す
+func getContestEndsAt() (time.Time, bool) {
+	if contestEndsAt != nil {
+		return *contestEndsAt, true
+	}
+	if *endsAtHour < 0 {
+		return time.Time{}, false
+	}
+	y, m, d := timeNow().Date()
+	return time.Date(y, m, d, *endsAtHour, 0, 0, 0, locJST), true
+}
+
+func getRankingFixedAt() time.Time {
+	if endsAt, ok := getContestEndsAt(); ok {
 		return endsAt.Add(-time.Hour) // ends-atが指定されていればその1時間前にする
 	}
 	return time.Date(2038, 1, 1, 0, 0, 0, 0, locJST)
@@ -127,12 +190,20 @@ func buildMux() *http.ServeMux {
 	mux.Handle("/login", handler(serveLogin))
 	mux.Handle("/static/", handler(serveStatic))
 	mux.Handle("/queue", handler(serveQueueJob))
+	mux.Handle("/api/job/status", handler(serveJobStatus))
+	mux.Handle("/api/job/cancel", handler(serveCancelJob))
+	mux.Handle("/api/job/requeue", handler(serveRequeueLast))
+	mux.Handle("/api/job/history", handler(serveJobHistory))
+	mux.Handle("/api/job/failures", handler(serveJobFailures))
+	mux.Handle("/api/queue", handler(serveQueueStats))
+	mux.Handle("/api/leaderboard", handler(serveLeaderboard))
 	mux.Handle("/team", handler(serveUpdateTeam))
 
 	mux.Handle("/"+pathPrefixInternal+"proxy/update", handler(serveProxyUpdate))
 	mux.Handle("/"+pathPrefixInternal+"proxy/nginx.conf", handler(serveProxyNginxConf))
-	mux.Handle("/"+pathPrefixInternal+"job/new", handler(serveNewJob))
-	mux.Handle("/"+pathPrefixInternal+"job/result", handler(servePostResult))
+	mux.Handle("/"+pathPrefixInternal+"job/new", requireBenchNodeSecret(serveNewJob))
+	mux.Handle("/"+pathPrefixInternal+"job/result", requireBenchNodeSecret(servePostResult))
+	mux.Handle("/"+pathPrefixInternal+"api/bench/nodes", handler(serveBenchNodes))
 	mux.Handle("/"+pathPrefixInternal+"debug/vars", handler(expvarHandler))
 	mux.Handle("/"+pathPrefixInternal+"debug/queue", handler(serveDebugQueue))
 	mux.Handle("/"+pathPrefixInternal+"debug/leaderboard", handler(serveDebugLeaderboard))
@@ -171,6 +242,18 @@ func main() {
 		log.Fatal(err)
 	}
 
+	err = loadContestTimes()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = checkBenchNodeSecret()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	go sweepExpiredJobs()
+
 	mux := buildMux()
 
 	var l net.Listener
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestGetContestStatus(t *testing.T) {
+	var err error
+	locJST, err = time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		timeNow = time.Now
+		contestStartsAt = nil
+		contestEndsAt = nil
+	}()
+
+	testCases := []struct {
+		now    time.Time
+		expect contestStatus
+	}{
+		{time.Date(2016, 10, 22, 9, 59, 59, 0, locJST), contestStatusNotStarted},
+		{time.Date(2016, 10, 22, 10, 0, 0, 0, locJST), contestStatusStarted},
+		{time.Date(2016, 10, 22, 18, 0, 0, 0, locJST), contestStatusStarted},
+		{time.Date(2016, 10, 22, 18, 0, 1, 0, locJST), contestStatusEnded},
+	}
+
+	// デフォルトは10時から18時
+	*startsAtHour = 10
+	*endsAtHour = 18
+	for _, tc := range testCases {
+		timeNow = func() time.Time { return tc.now }
+		if got := getContestStatus(); got != tc.expect {
+			t.Errorf("%s: want %d, got %d", tc.now, tc.expect, got)
+		}
+	}
+
+	// 環境変数で別の日時にずらせる
+	defer os.Setenv(contestStartsAtEnv, os.Getenv(contestStartsAtEnv))
+	defer os.Setenv(contestEndsAtEnv, os.Getenv(contestEndsAtEnv))
+	os.Setenv(contestStartsAtEnv, "2016-10-23T13:30:00+09:00")
+	os.Setenv(contestEndsAtEnv, "2016-10-23T14:30:00+09:00")
+	err = loadContestTimes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases = []struct {
+		now    time.Time
+		expect contestStatus
+	}{
+		{time.Date(2016, 10, 23, 12, 0, 0, 0, locJST), contestStatusNotStarted},
+		{time.Date(2016, 10, 23, 13, 29, 59, 0, locJST), contestStatusNotStarted},
+		{time.Date(2016, 10, 23, 13, 30, 0, 0, locJST), contestStatusStarted},
+		{time.Date(2016, 10, 23, 14, 30, 0, 0, locJST), contestStatusStarted},
+		{time.Date(2016, 10, 23, 14, 30, 1, 0, locJST), contestStatusEnded},
+		{time.Date(2016, 10, 23, 17, 0, 0, 0, locJST), contestStatusEnded},
+	}
+	for _, tc := range testCases {
+		timeNow = func() time.Time { return tc.now }
+		if got := getContestStatus(); got != tc.expect {
+			t.Errorf("%s: want %d, got %d", tc.now, tc.expect, got)
+		}
+	}
+
+	os.Setenv(contestEndsAtEnv, "14:30")
+	if err := loadContestTimes(); err == nil {
+		t.Errorf("want an error for an invalid time")
+	}
+}
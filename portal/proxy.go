@@ -4,6 +4,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"log"
+	"net"
 	"net/http"
 	"strconv"
 	"strings"
@@ -80,15 +82,22 @@ func serveProxyNginxConf(w http.ResponseWriter, req *http.Request) error {
 		if err != nil {
 			return err
 		}
-		if IPAddr != "" {
-			conf += fmt.Sprintf(`
+		if IPAddr == "" {
+			continue
+		}
+		// 壊れたアドレスが1つでもあるとnginxがリロードできなくなるので、そのチームだけ飛ばす
+		addr, err := normalizeIPAddr(IPAddr)
+		if err != nil {
+			log.Printf("team%d: %v", ID, err)
+			continue
+		}
+		conf += fmt.Sprintf(`
 # team%d
 server {
   listen %d;
-  proxy_pass %s:443;
+  proxy_pass %s;
 }`,
-				ID, teamIDToPortNum(ID), IPAddr)
-		}
+			ID, teamIDToPortNum(ID), net.JoinHostPort(addr, "443"))
 	}
 	w.Write([]byte(conf))
 	return nil
@@ -1,24 +1,85 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"log"
 	"strings"
-
+	"sync"
 	"time"
 
 	"github.com/isucon/isucon6-final/portal/job"
 	"github.com/pkg/errors"
 )
 
+const (
+	// ベンチマーカーのノードがジョブを取り出してから結果を返すまでの期限
+	// これを過ぎても結果が返って来なければノードが死んだとみなしてジョブを積み直す
+	// workerはベンチマーカーを最大125秒で打ち切るので、それより十分長くしておく
+	jobLeaseDuration = 5 * time.Minute
+
+	// 期限切れのジョブを探す間隔
+	jobSweepInterval = 30 * time.Second
+
+	// ジョブが終わってから同じチームが次のジョブを積めるまでの間隔
+	jobCooldownInterval = 1 * time.Minute
+)
+
+var (
+	// ジョブが積まれるたびにcloseして作り直す。待っている側はcloseで起こされる
+	jobEnqueuedCh = make(chan struct{})
+	muJobEnqueued sync.Mutex
+)
+
+// 次にジョブが積まれたときにcloseされるチャンネルを返す
+func jobEnqueued() <-chan struct{} {
+	muJobEnqueued.Lock()
+	defer muJobEnqueued.Unlock()
+	return jobEnqueuedCh
+}
+
+func notifyJobEnqueued() {
+	muJobEnqueued.Lock()
+	close(jobEnqueuedCh)
+	jobEnqueuedCh = make(chan struct{})
+	muJobEnqueued.Unlock()
+}
+
 type errAlreadyQueued int
 
 func (n errAlreadyQueued) Error() string {
 	return fmt.Sprintf("job already queued (teamID=%d)", n)
 }
 
+type errJobRunning int
+
+func (n errJobRunning) Error() string {
+	return fmt.Sprintf("job already running (teamID=%d)", n)
+}
+
+type errJobNotQueued int
+
+func (n errJobNotQueued) Error() string {
+	return fmt.Sprintf("job not queued (teamID=%d)", n)
+}
+
+type errNoPreviousJob int
+
+func (n errNoPreviousJob) Error() string {
+	return fmt.Sprintf("no previous job (teamID=%d)", n)
+}
+
 func enqueueJob(teamID int) error {
+	return insertJob(teamID, false)
+}
+
+// コンテスト開始前のリハーサル用のジョブを積む。結果はランキングに載らない
+func enqueueDryRunJob(teamID int) error {
+	return insertJob(teamID, true)
+}
+
+func insertJob(teamID int, dryRun bool) error {
 	var id int
 	err := db.QueryRow(`
       SELECT id FROM queues
@@ -31,17 +92,83 @@ func enqueueJob(teamID int) error {
 	default:
 		return errAlreadyQueued(teamID)
 	}
-	// XXX: worker nodeが死んだ時のために古くて実行中のジョブがある場合をケアした方が良いかも
-
 	// XXX: ここですり抜けて二重で入る可能性がある
 	_, err = db.Exec(`
-      INSERT INTO queues (team_id) VALUES (?)`, teamID)
+      INSERT INTO queues (team_id, dry_run) VALUES (?, ?)`, teamID, dryRun)
 	if err != nil {
 		return errors.Wrap(err, "enqueue job failed")
 	}
+	notifyJobEnqueued()
 	return nil
 }
 
+// チームが最後に積んだジョブがdry runだったかを返す。1つも積んでいなければerrNoPreviousJob
+func getLastJobDryRun(teamID int) (bool, error) {
+	var dryRun bool
+	err := db.QueryRow(`
+      SELECT dry_run FROM queues
+      WHERE team_id = ?
+      ORDER BY id DESC LIMIT 1`, teamID).Scan(&dryRun)
+	switch {
+	case err == sql.ErrNoRows:
+		return false, errNoPreviousJob(teamID)
+	case err != nil:
+		return false, errors.Wrap(err, "failed to get last job")
+	}
+	return dryRun, nil
+}
+
+// 直前のジョブが終わってから次のジョブを積めるまでの残り時間。0なら積める
+func getJobCooldown(teamID int) (time.Duration, error) {
+	var remaining int
+	err := db.QueryRow(`
+      SELECT TIMESTAMPDIFF(SECOND, NOW(), finished_at + INTERVAL ? SECOND) FROM queues
+      WHERE team_id = ? AND status = 'done' AND finished_at IS NOT NULL
+      ORDER BY id DESC LIMIT 1`, int(jobCooldownInterval/time.Second), teamID).Scan(&remaining)
+	switch {
+	case err == sql.ErrNoRows:
+		return 0, nil
+	case err != nil:
+		return 0, errors.Wrap(err, "failed to get job cooldown")
+	}
+	if remaining <= 0 {
+		return 0, nil
+	}
+	return time.Duration(remaining) * time.Second, nil
+}
+
+// まだ取り出されていないジョブを取り消す
+func cancelJob(teamID int) error {
+	ret, err := db.Exec(`
+      UPDATE queues SET status = 'aborted'
+      WHERE team_id = ? AND status = 'waiting'`, teamID)
+	if err != nil {
+		return errors.Wrap(err, "cancel job failed")
+	}
+	affected, err := ret.RowsAffected()
+	if err != nil {
+		return errors.Wrap(err, "failed to cancel job when checking affected rows")
+	}
+	if affected > 0 {
+		return nil
+	}
+
+	// 取り消せなかったのは、もう実行中かそもそも積まれていないか
+	var id int
+	err = db.QueryRow(`
+      SELECT id FROM queues
+      WHERE team_id = ? AND status = 'running'`, teamID).Scan(&id)
+	switch {
+	case err == sql.ErrNoRows:
+		return errJobNotQueued(teamID)
+	case err != nil:
+		return errors.Wrap(err, "failed to cancel job when selecting table")
+	}
+	return errJobRunning(teamID)
+}
+
+// 複数のベンチノードから同時に呼ばれても、1つのジョブを取り出せるのは1ノードだけ
+// status = 'waiting' を条件にしたUPDATEで取り合うので、負けた方はnilを返す
 func dequeueJob(benchNode string) (*job.Job, error) {
 	var j job.Job
 	err := db.QueryRow(`
@@ -59,8 +186,9 @@ func dequeueJob(benchNode string) (*job.Job, error) {
 		return nil, errors.Wrap(err, "failed to dequeue job when beginning tx")
 	}
 	ret, err := tx.Exec(`
-    UPDATE queues SET status = 'running', bench_node = ?
-      WHERE id = ? AND status = 'waiting'`, benchNode, j.ID)
+    UPDATE queues SET status = 'running', bench_node = ?, started_at = NOW(),
+      lease_expires_at = NOW() + INTERVAL ? SECOND
+      WHERE id = ? AND status = 'waiting'`, benchNode, int(jobLeaseDuration/time.Second), j.ID)
 	if err != nil {
 		tx.Rollback()
 		return nil, errors.Wrap(err, "failed to dequeue job when locking")
@@ -85,6 +213,67 @@ func dequeueJob(benchNode string) (*job.Job, error) {
 	return &j, nil
 }
 
+// 期限までに結果が返って来なかったジョブを待ち状態に戻す
+func requeueExpiredJobs() (int64, error) {
+	ret, err := db.Exec(`
+UPDATE queues
+SET status = 'waiting', bench_node = NULL, started_at = NULL, lease_expires_at = NULL
+WHERE status = 'running'
+AND lease_expires_at < NOW()
+	`)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to requeue expired jobs")
+	}
+	n, err := ret.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if n > 0 {
+		// ロングポーリングで待っているノードにすぐ取らせる
+		notifyJobEnqueued()
+	}
+	return n, nil
+}
+
+func sweepExpiredJobs() {
+	for range time.Tick(jobSweepInterval) {
+		n, err := requeueExpiredJobs()
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+		if n > 0 {
+			log.Printf("requeued %d expired jobs", n)
+		}
+	}
+}
+
+// ジョブを取り出す。無ければ積まれるのをtimeoutまたはctxが終わるまで待つ
+// 待っても取り出せなければnilを返す
+func waitJob(ctx context.Context, benchNode string, timeout time.Duration) (*job.Job, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		// 取り出しに失敗してから待ち始めるまでに積まれても気付けるように、先にチャンネルを取っておく
+		enqueued := jobEnqueued()
+
+		j, err := dequeueJob(benchNode)
+		if err != nil || j != nil {
+			return j, err
+		}
+
+		select {
+		case <-enqueued:
+			// タッチの差で別のノードに取られるかもしれないので、もう一度取り出してみる
+		case <-timer.C:
+			return nil, nil
+		case <-ctx.Done():
+			return nil, nil
+		}
+	}
+}
+
 func doneJob(res *job.Result) error {
 	log.Printf("doneJob: job=%#v output=%#v", res.Job, res.Output)
 
@@ -94,7 +283,7 @@ func doneJob(res *job.Result) error {
 	}
 	ret, err := tx.Exec(`
 UPDATE queues
-SET status = 'done', stderr = ?
+SET status = 'done', stderr = ?, finished_at = NOW()
 WHERE id = ?
 AND team_id = ?
 AND status = 'running'
@@ -121,11 +310,12 @@ AND status = 'running'
 	if res.Output.Pass {
 		pass = 1
 	}
+	// dry runかどうかはキューの方に記録されているのでそれを引き継ぐ
 	_, err = tx.Exec(`
-INSERT INTO results (team_id, queue_id, pass, score, messages)
-VALUES (?, ?, ?, ?, ?)
+INSERT INTO results (team_id, queue_id, pass, score, messages, dry_run)
+SELECT ?, ?, ?, ?, ?, dry_run FROM queues WHERE id = ?
 	`,
-		res.Job.TeamID, res.Job.ID, pass, res.Output.Score, strings.Join(res.Output.Messages, "\n"),
+		res.Job.TeamID, res.Job.ID, pass, res.Output.Score, strings.Join(res.Output.Messages, "\n"), res.Job.ID,
 	)
 	if err != nil {
 		tx.Rollback()
@@ -176,6 +366,91 @@ func getQueuedJobs(db *sql.DB) ([]QueuedJob, error) {
 	return jobs, nil
 }
 
+type JobStatus struct {
+	State           string     `json:"state"`
+	PositionInQueue int        `json:"position_in_queue"`
+	StartedAt       *time.Time `json:"started_at"`
+	FinishedAt      *time.Time `json:"finished_at"`
+}
+
+const jobStateNone = "none"
+
+// チームの最新のジョブの状態を取得。ジョブを積んだことがなければStateはnone
+// PositionInQueueは待っているジョブの中で何番目か(1始まり)で、待っていなければ0
+func getJobStatus(teamID int) (*JobStatus, error) {
+	var (
+		id int
+		st JobStatus
+	)
+	err := db.QueryRow(`
+      SELECT id, status, started_at, finished_at FROM queues
+      WHERE team_id = ? ORDER BY id DESC LIMIT 1`, teamID).Scan(&id, &st.State, &st.StartedAt, &st.FinishedAt)
+	switch {
+	case err == sql.ErrNoRows:
+		return &JobStatus{State: jobStateNone}, nil
+	case err != nil:
+		return nil, errors.Wrap(err, "failed to get job status")
+	}
+
+	if st.State == "waiting" {
+		// dequeueJobと同じくidの順に取り出されるので、自分より前に待っている数を数える
+		err := db.QueryRow(`
+      SELECT COUNT(*) FROM queues
+      WHERE status = 'waiting' AND id <= ?`, id).Scan(&st.PositionInQueue)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to get job status when counting queue")
+		}
+	}
+
+	return &st, nil
+}
+
+const (
+	// 待ち時間の見積もりに使う、直近に終わったジョブの数
+	queueEstimateSampleSize = 20
+	// 終わったジョブが無いときに見積もりに使う、1ジョブあたりの時間
+	defaultJobDuration = 90 * time.Second
+)
+
+type QueueStats struct {
+	Length               int `json:"length"`
+	EstimatedWaitSeconds int `json:"estimated_wait_seconds"`
+}
+
+// 終わっていないジョブの数と、それが全部終わるまでの時間の見積もりを取得
+// 見積もりは直近に終わったジョブにかかった時間の平均から出す
+func getQueueStats(db *sql.DB) (*QueueStats, error) {
+	var st QueueStats
+	err := db.QueryRow(`
+      SELECT COUNT(*) FROM queues
+      WHERE status IN ('waiting', 'running')`).Scan(&st.Length)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get queue length")
+	}
+	if st.Length == 0 {
+		return &st, nil
+	}
+
+	var avg sql.NullFloat64
+	err = db.QueryRow(`
+      SELECT AVG(TIMESTAMPDIFF(SECOND, started_at, finished_at)) FROM (
+        SELECT started_at, finished_at FROM queues
+        WHERE status = 'done' AND started_at IS NOT NULL AND finished_at IS NOT NULL
+        ORDER BY id DESC LIMIT ?
+      ) AS recent`, queueEstimateSampleSize).Scan(&avg)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get average job duration")
+	}
+
+	perJob := defaultJobDuration.Seconds()
+	if avg.Valid && avg.Float64 > 0 {
+		perJob = avg.Float64
+	}
+	st.EstimatedWaitSeconds = int(perJob * float64(st.Length))
+
+	return &st, nil
+}
+
 type QueueItem struct {
 	ID        int
 	TeamID    int
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"fmt"
 	"reflect"
+	"sync"
 	"testing"
 
 	"github.com/isucon/isucon6-final/portal/job"
@@ -120,3 +122,107 @@ func TestEnqueueJob(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestRequeueExpiredJobs(t *testing.T) {
+	// 事前に `TRUNCATE queues` しないと動きません…
+	err := initWeb()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = enqueueJob(31)
+	if err != nil {
+		t.Fatalf("failed to enqueue job: %s", err)
+	}
+	j, err := dequeueJob("host1")
+	if err != nil || j == nil {
+		t.Fatalf("something went wrong: %#v, %v", j, err)
+	}
+
+	// 期限内なら積み直されない
+	n, err := requeueExpiredJobs()
+	if err != nil || n != 0 {
+		t.Errorf("something went wrong: %d, %v", n, err)
+	}
+
+	// ノードが死んで期限が切れた
+	_, err = db.Exec(`UPDATE queues SET lease_expires_at = NOW() - INTERVAL 1 SECOND WHERE id = ?`, j.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enqueued := jobEnqueued()
+	n, err = requeueExpiredJobs()
+	if err != nil || n != 1 {
+		t.Errorf("something went wrong: %d, %v", n, err)
+	}
+
+	// 待っているノードにも知らせる
+	select {
+	case <-enqueued:
+	default:
+		t.Errorf("waiting nodes were not notified")
+	}
+
+	// 同じジョブがまた取り出せる
+	j2, err := dequeueJob("host2")
+	if err != nil {
+		t.Error(err)
+	}
+	if !reflect.DeepEqual(j, j2) {
+		t.Errorf("something went wrong: %#v", j2)
+	}
+
+	// あとかたづけ
+	err = doneJob(&job.Result{Job: j2, Output: &job.Output{}})
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDequeueJobConcurrently(t *testing.T) {
+	// 事前に `TRUNCATE queues` しないと動きません…
+	err := initWeb()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = enqueueJob(41)
+	if err != nil {
+		t.Fatalf("failed to enqueue job: %s", err)
+	}
+
+	const nodes = 20
+	var wg sync.WaitGroup
+	jobs := make(chan *job.Job, nodes)
+	for i := 0; i < nodes; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			j, err := dequeueJob(fmt.Sprintf("host%d", i))
+			if err != nil {
+				t.Errorf("something went wrong: %s", err)
+				return
+			}
+			if j != nil {
+				jobs <- j
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(jobs)
+
+	// 1つのノードだけがジョブを受け取る
+	dequeued := []*job.Job{}
+	for j := range jobs {
+		dequeued = append(dequeued, j)
+	}
+	if len(dequeued) != 1 || dequeued[0].TeamID != 41 {
+		t.Fatalf("something went wrong: %#v", dequeued)
+	}
+
+	// あとかたづけ
+	err = doneJob(&job.Result{Job: dequeued[0], Output: &job.Output{}})
+	if err != nil {
+		t.Error(err)
+	}
+}
@@ -2,7 +2,10 @@ package main
 
 import (
 	"database/sql"
+	"regexp"
 	"sort"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -25,12 +28,13 @@ func (ls LatestScores) Less(i, j int) bool { return ls[i].Score > ls[j].Score }
 func (ls LatestScores) Swap(i, j int)      { ls[i], ls[j] = ls[j], ls[i] }
 
 // 自分のチームであれば問答無用で、そうでなければオフィシャルユーザーでなくランキング固定の時間より前のデータを取得
-// プロットには成功したスコアしか載せない
+// プロットには成功したスコアしか載せない(dry runの結果も載せない)
 func getResults(db *sql.DB, teamID int, topNum int, rankingFixAt time.Time) ([]PlotLine, []LatestScore, error) {
 	rows, err := db.Query(`
 SELECT teams.id, teams.name, results.score, results.created_at
 FROM results JOIN teams ON results.team_id = teams.id
 WHERE results.pass = 1
+AND results.dry_run = 0
 AND (teams.id = ? OR (teams.category <> 'official' AND results.created_at <= ?))
 ORDER BY results.team_id ASC, results.id ASC
 	`, teamID, rankingFixAt)
@@ -92,26 +96,104 @@ ORDER BY results.team_id ASC, results.id ASC
 	return plotLines, latestScores, nil
 }
 
+type BestScore struct {
+	TeamID   int       `json:"team_id"`
+	TeamName string    `json:"team_name"`
+	Score    int64     `json:"score"`
+	At       time.Time `json:"at"`
+}
+
+type BestScores []BestScore
+
+// スコアが高い順、同じなら先に出した順
+func (bs BestScores) Len() int { return len(bs) }
+func (bs BestScores) Less(i, j int) bool {
+	if bs[i].Score != bs[j].Score {
+		return bs[i].Score > bs[j].Score
+	}
+	return bs[i].At.Before(bs[j].At)
+}
+func (bs BestScores) Swap(i, j int) { bs[i], bs[j] = bs[j], bs[i] }
+
+// オフィシャルユーザー以外のチームの、until以前に成功したスコアのうち最高のものを順位順に取得
+func getBestScores(db *sql.DB, until time.Time) ([]BestScore, error) {
+	rows, err := db.Query(`
+SELECT teams.id, teams.name, results.score, results.created_at
+FROM results JOIN teams ON results.team_id = teams.id
+WHERE results.pass = 1
+AND results.dry_run = 0
+AND teams.category <> 'official'
+AND results.created_at <= ?
+ORDER BY results.team_id ASC, results.score DESC, results.id ASC
+	`, until)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	bestScores := []BestScore{}
+	lastTeamID := 0
+
+	for rows.Next() {
+		var bs BestScore
+		err := rows.Scan(&bs.TeamID, &bs.TeamName, &bs.Score, &bs.At)
+		if err != nil {
+			return nil, err
+		}
+
+		// チームごとに最初の行が最高スコア
+		if lastTeamID != bs.TeamID {
+			lastTeamID = bs.TeamID
+			bestScores = append(bestScores, bs)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.Sort(BestScores(bestScores))
+
+	return bestScores, nil
+}
+
 type TeamResult struct {
-	ID    int
-	Score int64
-	Pass  int
-	At    time.Time
-	Msg   string
+	ID     int
+	Score  int64
+	Pass   int
+	DryRun int
+	At     time.Time
+	Msg    string
 }
 
 // 特定のチームのスコアとメッセージ一覧を全部取得
 func getTeamResults(db *sql.DB, teamID int) ([]TeamResult, error) {
 	rows, err := db.Query(`
-SELECT id, score, pass, created_at, messages FROM results
+SELECT id, score, pass, dry_run, created_at, messages FROM results
 WHERE team_id = ?
 ORDER BY id DESC
 	`, teamID)
+	if err != nil {
+		return nil, err
+	}
+	return scanTeamResults(rows)
+}
 
+// 特定のチームのスコアとメッセージ一覧を新しい方からlimit件取得
+func getRecentTeamResults(db *sql.DB, teamID int, limit int) ([]TeamResult, error) {
+	rows, err := db.Query(`
+SELECT id, score, pass, dry_run, created_at, messages FROM results
+WHERE team_id = ?
+ORDER BY id DESC
+LIMIT ?
+	`, teamID, limit)
 	if err != nil {
 		return nil, err
 	}
+	return scanTeamResults(rows)
+}
 
+func scanTeamResults(rows *sql.Rows) ([]TeamResult, error) {
 	teamResults := []TeamResult{}
 
 	defer rows.Close()
@@ -119,7 +201,7 @@ ORDER BY id DESC
 	for rows.Next() {
 		var r TeamResult
 
-		err := rows.Scan(&r.ID, &r.Score, &r.Pass, &r.At, &r.Msg)
+		err := rows.Scan(&r.ID, &r.Score, &r.Pass, &r.DryRun, &r.At, &r.Msg)
 		if err != nil {
 			return nil, err
 		}
@@ -132,3 +214,60 @@ ORDER BY id DESC
 
 	return teamResults, nil
 }
+
+type FailureMessage struct {
+	Message string `json:"message"`
+	Count   int    `json:"count"`
+}
+
+type FailureMessages []FailureMessage
+
+func (fs FailureMessages) Len() int           { return len(fs) }
+func (fs FailureMessages) Less(i, j int) bool { return fs[i].Count > fs[j].Count }
+func (fs FailureMessages) Swap(i, j int)      { fs[i], fs[j] = fs[j], fs[i] }
+
+// ベンチマーカーは同じ失敗を "msg (x回数)" にまとめて送ってくる
+var failureCountSuffix = regexp.MustCompile(`^(.*) \(x(\d+)\)$`)
+
+// メッセージから回数を取り出す。まとめられていなければ1回
+func splitFailureCount(m string) (string, int) {
+	sm := failureCountSuffix.FindStringSubmatch(m)
+	if sm == nil {
+		return m, 1
+	}
+	n, err := strconv.Atoi(sm[2])
+	if err != nil {
+		return m, 1
+	}
+	return sm[1], n
+}
+
+// 特定のチームの一番新しい結果の失敗メッセージを、同じものはまとめて多い順にlimit件取得
+// 回数が同じなら先に出た順にする
+func getLatestFailureMessages(db *sql.DB, teamID int, limit int) ([]FailureMessage, error) {
+	results, err := getRecentTeamResults(db, teamID, 1)
+	if err != nil {
+		return nil, err
+	}
+	if len(results) == 0 || results[0].Msg == "" {
+		return []FailureMessage{}, nil
+	}
+
+	failures := []FailureMessage{}
+	index := map[string]int{}
+	for _, line := range strings.Split(results[0].Msg, "\n") {
+		m, n := splitFailureCount(line)
+		if i, ok := index[m]; ok {
+			failures[i].Count += n
+			continue
+		}
+		index[m] = len(failures)
+		failures = append(failures, FailureMessage{Message: m, Count: n})
+	}
+
+	sort.Stable(FailureMessages(failures))
+	if len(failures) > limit {
+		failures = failures[:limit]
+	}
+	return failures, nil
+}
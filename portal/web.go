@@ -2,6 +2,7 @@ package main
 
 import (
 	"database/sql"
+	"encoding/json"
 	"flag"
 	"html/template"
 	"log"
@@ -66,6 +67,9 @@ func initWeb() error {
 			"contestEnded": func() bool {
 				return getContestStatus() == contestStatusEnded
 			},
+			"contestNotStarted": func() bool {
+				return getContestStatus() == contestStatusNotStarted
+			},
 			"plusOne": func(i int) int {
 				return i + 1
 			},
@@ -125,13 +129,9 @@ func loadTeamFromSession(req *http.Request) (*Team, error) {
 		}
 	}
 
-	sess, err := sessionStore.New(req, sessionName)
+	sess, err := loadSession(req)
 	if err != nil {
-		if cerr, ok := err.(securecookie.Error); ok && cerr.IsDecode() {
-			// 違う session secret でアクセスしにくるとこれなので無視
-		} else {
-			return nil, errors.Wrap(err, "sessionStore.New()")
-		}
+		return nil, err
 	}
 
 	v, ok := sess.Values[sessionKeyTeamID]
@@ -148,10 +148,59 @@ func loadTeamFromSession(req *http.Request) (*Team, error) {
 	return team, errors.Wrapf(err, "loadTeam(id=%#v)", teamID)
 }
 
+func loadSession(req *http.Request) (*sessions.Session, error) {
+	sess, err := sessionStore.New(req, sessionName)
+	if err != nil {
+		if cerr, ok := err.(securecookie.Error); ok && cerr.IsDecode() {
+			// 違う session secret でアクセスしにくるとこれなので無視
+		} else {
+			return nil, errors.Wrap(err, "sessionStore.New()")
+		}
+	}
+	return sess, nil
+}
+
+// 次に表示するページで一度だけ出すメッセージを積む
+func addFlash(w http.ResponseWriter, req *http.Request, message string) error {
+	sess, err := loadSession(req)
+	if err != nil {
+		return err
+	}
+	sess.AddFlash(message)
+	return sess.Save(req, w)
+}
+
+// 積まれているメッセージを取り出して消す
+func popFlashes(w http.ResponseWriter, req *http.Request) ([]string, error) {
+	sess, err := loadSession(req)
+	if err != nil {
+		return nil, err
+	}
+	flashes := sess.Flashes()
+	if len(flashes) == 0 {
+		return nil, nil
+	}
+	err = sess.Save(req, w)
+	if err != nil {
+		return nil, err
+	}
+
+	messages := make([]string, 0, len(flashes))
+	for _, f := range flashes {
+		if m, ok := f.(string); ok {
+			messages = append(messages, m)
+		}
+	}
+	return messages, nil
+}
+
 type viewParamsLayout struct {
 	Team *Team
 }
 
+// トップページに表示する直近の失敗メッセージの数
+const latestFailuresLimit = 10
+
 func serveIndex(w http.ResponseWriter, req *http.Request) error {
 	return serveIndexWithMessage(w, req, "")
 }
@@ -177,12 +226,23 @@ func serveIndexWithMessage(w http.ResponseWriter, req *http.Request, message str
 		return err
 	}
 
+	// 直近のジョブがなぜ失敗したのか運営に聞かなくてもわかるようにする
+	latestFailures, err := getLatestFailureMessages(db, teamID, latestFailuresLimit)
+	if err != nil {
+		return err
+	}
+
 	// キューをゲット
 	jobs, err := getQueuedJobs(db)
 	if err != nil {
 		return err
 	}
 
+	queueStats, err := getQueueStats(db)
+	if err != nil {
+		return err
+	}
+
 	messages, err := getMessages()
 	if err != nil {
 		return err
@@ -191,6 +251,14 @@ func serveIndexWithMessage(w http.ResponseWriter, req *http.Request, message str
 		messages = append(messages, Message{Message: message, Kind: "danger"})
 	}
 
+	flashes, err := popFlashes(w, req)
+	if err != nil {
+		return err
+	}
+	for _, f := range flashes {
+		messages = append(messages, Message{Message: f, Kind: "success"})
+	}
+
 	return templates["index.tmpl"].Execute(
 		w, struct {
 			viewParamsLayout
@@ -198,15 +266,19 @@ func serveIndexWithMessage(w http.ResponseWriter, req *http.Request, message str
 			LatestScores   []LatestScore
 			IsRankingFixed bool
 			TeamResults    []TeamResult
+			LatestFailures []FailureMessage
 			Jobs           []QueuedJob
+			QueueStats     *QueueStats
 			Messages       []Message
 		}{
 			viewParamsLayout{team},
 			plotLines,
 			latestScores,
-			getRankingFixedAt().Before(time.Now()),
+			getRankingFixedAt().Before(timeNow()),
 			teamResults,
+			latestFailures,
 			jobs,
+			queueStats,
 			messages,
 		},
 	)
@@ -250,13 +322,9 @@ func serveLogin(w http.ResponseWriter, req *http.Request) error {
 		}
 	}
 
-	sess, err := sessionStore.New(req, sessionName)
+	sess, err := loadSession(req)
 	if err != nil {
-		if cerr, ok := err.(securecookie.Error); ok && cerr.IsDecode() {
-			// 違う session secret でアクセスしにくるとこれなので無視
-		} else {
-			return errors.Wrap(err, "sessionStore.New()")
-		}
+		return err
 	}
 
 	sess.Values[sessionKeyTeamID] = teamID
@@ -325,8 +393,9 @@ func serveUpdateTeam(w http.ResponseWriter, req *http.Request) error {
 	ipAddress := req.FormValue("ip_address")
 
 	if ipAddress != "" {
-		ip := net.ParseIP(ipAddress)
-		if ip == nil || ip.To4() == nil {
+		// nginxの設定やベンチマーカーにはそのまま渡るので、正規化したものを保存する
+		ipAddress, err = normalizeIPAddr(ipAddress)
+		if err != nil || net.ParseIP(ipAddress).To4() == nil {
 			return errHTTP(http.StatusBadRequest)
 		}
 	}
@@ -350,6 +419,31 @@ func serveUpdateTeam(w http.ResponseWriter, req *http.Request) error {
 	return nil
 }
 
+// serveLeaderboard はチームごとの最高スコアを順位順に返すエンドポイント。
+// コンテスト終了後は終了時刻までの結果で固定される
+func serveLeaderboard(w http.ResponseWriter, req *http.Request) error {
+	if req.Method != http.MethodGet {
+		return errHTTP(http.StatusMethodNotAllowed)
+	}
+
+	bestScores, err := getBestScores(db, getLeaderboardUntil())
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(bestScores)
+}
+
+// トップページと同じく、順位が固定された後(終了後も含む)はその時点までの結果しか見せない
+func getLeaderboardUntil() time.Time {
+	until := timeNow()
+	if fixedAt := getRankingFixedAt(); fixedAt.Before(until) {
+		until = fixedAt
+	}
+	return until
+}
+
 func serveDebugLeaderboard(w http.ResponseWriter, req *http.Request) error {
 	plotLines, latestScores, err := getResults(db, 0, 26, time.Now()) // ここは常に最新のを使う
 	if err != nil {
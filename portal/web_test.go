@@ -0,0 +1,402 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/isucon/isucon6-final/portal/job"
+)
+
+func TestFlashAfterQueueJob(t *testing.T) {
+	// 事前に `TRUNCATE queues` しないと動きません…
+	err := initWeb()
+	if err != nil {
+		t.Fatal(err)
+	}
+	*startsAtHour = -1
+	*endsAtHour = -1
+	*debugMode = true
+
+	_, err = db.Exec(`
+      INSERT IGNORE INTO teams (id, name, password, ip_address, category, azure_resource_group)
+      VALUES (44, 'team44', '', '127.0.0.1', 'official', '')`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := httptest.NewServer(buildMux())
+	defer ts.Close()
+
+	jar, _ := cookiejar.New(nil)
+	u, _ := url.Parse(ts.URL)
+	jar.SetCookies(u, []*http.Cookie{{Name: "debug_team", Value: "44"}})
+	c := &http.Client{Jar: jar}
+
+	getIndex := func() string {
+		res, err := c.Get(ts.URL + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		b, _ := ioutil.ReadAll(res.Body)
+		return string(b)
+	}
+
+	if body := getIndex(); strings.Contains(body, "Job queued") {
+		t.Errorf("flash should not appear before queueing")
+	}
+
+	// リダイレクト先で1回だけ表示される
+	res, err := c.PostForm(ts.URL+"/queue", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if !strings.Contains(string(b), "Job queued") {
+		t.Errorf("flash should appear after queueing")
+	}
+	if body := getIndex(); strings.Contains(body, "Job queued") {
+		t.Errorf("flash should appear only once")
+	}
+
+	// あとかたづけ
+	j, err := dequeueJob("host1")
+	if err != nil || j == nil {
+		t.Fatalf("something went wrong: %#v, %v", j, err)
+	}
+	err = doneJob(&job.Result{Job: j, Output: &job.Output{}})
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDryRunBeforeStart(t *testing.T) {
+	// 事前に `TRUNCATE queues` しないと動きません…
+	err := initWeb()
+	if err != nil {
+		t.Fatal(err)
+	}
+	*startsAtHour = -1
+	*endsAtHour = -1
+
+	// コンテストはまだ始まっていない
+	startsAt := time.Now().Add(time.Hour)
+	contestStartsAt = &startsAt
+	defer func() {
+		contestStartsAt = nil
+	}()
+
+	_, err = db.Exec(`
+      INSERT IGNORE INTO teams (id, name, password, ip_address, category, azure_resource_group)
+      VALUES (53, 'team53', 'pass53', '127.0.0.1', 'general', '')`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := httptest.NewServer(buildMux())
+	defer ts.Close()
+
+	jar, _ := cookiejar.New(nil)
+	c := &http.Client{Jar: jar}
+	request := func(method, path string, form url.Values) (int, string) {
+		var (
+			res *http.Response
+			err error
+		)
+		if method == http.MethodPost {
+			res, err = c.PostForm(ts.URL+path, form)
+		} else {
+			res, err = c.Get(ts.URL + path)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		b, _ := ioutil.ReadAll(res.Body)
+		return res.StatusCode, string(b)
+	}
+
+	// 開始前でもログインしてトップページを見られる
+	code, body := request(http.MethodPost, "/login", url.Values{"team_id": {"53"}, "password": {"pass53"}})
+	if code != http.StatusOK {
+		t.Fatalf("want %d, got %d: %s", http.StatusOK, code, body)
+	}
+	if !strings.Contains(body, `name="dry_run"`) || strings.Contains(body, `value="Enqueue"`) {
+		t.Errorf("only the dry run button should be shown before the start: %s", body)
+	}
+
+	// 普通のジョブは積めないが、dry runは積める
+	code, _ = request(http.MethodPost, "/queue", nil)
+	if code != http.StatusForbidden {
+		t.Errorf("want %d, got %d", http.StatusForbidden, code)
+	}
+	code, body = request(http.MethodPost, "/queue", url.Values{"dry_run": {"1"}})
+	if code != http.StatusOK || !strings.Contains(body, "Dry run job queued") {
+		t.Fatalf("something went wrong: %d %s", code, body)
+	}
+
+	j, err := dequeueJob("host1")
+	if err != nil || j == nil || j.TeamID != 53 {
+		t.Fatalf("something went wrong: %#v, %v", j, err)
+	}
+	err = doneJob(&job.Result{Job: j, Output: &job.Output{Pass: true, Score: 1000}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 結果はトップページと履歴で見られる
+	code, body = request(http.MethodGet, "/", nil)
+	if code != http.StatusOK || !strings.Contains(body, "dry run</span>") {
+		t.Errorf("something went wrong: %d %s", code, body)
+	}
+	code, body = request(http.MethodGet, "/api/job/history", nil)
+	var items []JobHistoryItem
+	err = json.Unmarshal([]byte(body), &items)
+	if code != http.StatusOK || err != nil || len(items) == 0 || !items[0].DryRun || items[0].Score != 1000 {
+		t.Errorf("something went wrong: %d %s", code, body)
+	}
+
+	// リーダーボードはまだ見られない
+	code, _ = request(http.MethodGet, "/api/leaderboard", nil)
+	if code != http.StatusForbidden {
+		t.Errorf("want %d, got %d", http.StatusForbidden, code)
+	}
+}
+
+func TestServeLeaderboard(t *testing.T) {
+	// 事前に `TRUNCATE results` しないと動きません…
+	err := initWeb()
+	if err != nil {
+		t.Fatal(err)
+	}
+	*startsAtHour = -1
+	*endsAtHour = -1
+
+	for _, id := range []int{521, 522, 523} {
+		_, err = db.Exec(`
+      INSERT IGNORE INTO teams (id, name, password, category, azure_resource_group)
+      VALUES (?, ?, '', 'general', '')`, id, fmt.Sprintf("team%d", id))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, r := range []struct {
+		teamID     int
+		pass       int
+		score      int64
+		minutesAgo int
+	}{
+		{521, 1, 100, 50},
+		{521, 1, 300, 10},
+		{522, 1, 300, 30},
+		{522, 0, 999, 20},
+		{523, 1, 50, 40},
+	} {
+		_, err = db.Exec(`
+      INSERT INTO results (team_id, queue_id, pass, score, messages, created_at)
+      VALUES (?, 0, ?, ?, '', NOW() - INTERVAL ? MINUTE)`, r.teamID, r.pass, r.score, r.minutesAgo)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/leaderboard", nil)
+	w := httptest.NewRecorder()
+	handler(serveLeaderboard).ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("want %d, got %d", http.StatusOK, w.Code)
+	}
+	var bestScores []BestScore
+	err = json.NewDecoder(w.Body).Decode(&bestScores)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 同点なら先に出したチームが上、失敗したスコアは数えない
+	got := []BestScore{}
+	for _, bs := range bestScores {
+		if bs.TeamID >= 521 && bs.TeamID <= 523 {
+			got = append(got, bs)
+		}
+	}
+	expect := []struct {
+		teamID int
+		score  int64
+	}{
+		{522, 300},
+		{521, 300},
+		{523, 50},
+	}
+	if len(got) != len(expect) {
+		t.Fatalf("something went wrong: %#v", got)
+	}
+	for i, e := range expect {
+		if got[i].TeamID != e.teamID || got[i].Score != e.score {
+			t.Errorf("%d: want team %d with %d, got %#v", i, e.teamID, e.score, got[i])
+		}
+	}
+}
+
+func TestServeLeaderboardFrozen(t *testing.T) {
+	// 事前に `TRUNCATE results` しないと動きません…
+	err := initWeb()
+	if err != nil {
+		t.Fatal(err)
+	}
+	*startsAtHour = -1
+	*endsAtHour = -1
+
+	// 終了まで30分なので、30分前に順位が固定されている
+	endsAt := time.Now().Add(30 * time.Minute)
+	contestEndsAt = &endsAt
+	defer func() {
+		contestEndsAt = nil
+	}()
+
+	_, err = db.Exec(`
+      INSERT IGNORE INTO teams (id, name, password, category, azure_resource_group)
+      VALUES (524, 'team524', '', 'general', '')`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range []struct {
+		score      int64
+		minutesAgo int
+	}{
+		{100, 50},
+		{500, 10}, // 固定された後に出したスコア
+	} {
+		_, err = db.Exec(`
+      INSERT INTO results (team_id, queue_id, pass, score, messages, created_at)
+      VALUES (524, 0, 1, ?, '', NOW() - INTERVAL ? MINUTE)`, r.score, r.minutesAgo)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/leaderboard", nil)
+	w := httptest.NewRecorder()
+	handler(serveLeaderboard).ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("want %d, got %d", http.StatusOK, w.Code)
+	}
+	var bestScores []BestScore
+	err = json.NewDecoder(w.Body).Decode(&bestScores)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, bs := range bestScores {
+		if bs.TeamID == 524 {
+			found = true
+			if bs.Score != 100 {
+				t.Errorf("want %d, got %d", 100, bs.Score)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("something went wrong: %#v", bestScores)
+	}
+}
+
+func TestIndexShowsLatestFailures(t *testing.T) {
+	// 事前に `TRUNCATE queues` しないと動きません…
+	err := initWeb()
+	if err != nil {
+		t.Fatal(err)
+	}
+	*startsAtHour = -1
+	*endsAtHour = -1
+
+	_, err = db.Exec(`
+      INSERT IGNORE INTO teams (id, name, password, ip_address, category, azure_resource_group)
+      VALUES (49, 'team49', '', '127.0.0.1', 'general', '')`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 失敗した結果を積んでおく
+	err = enqueueJob(49)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j, err := dequeueJob("host1")
+	if err != nil || j == nil || j.TeamID != 49 {
+		t.Fatalf("something went wrong: %#v, %v", j, err)
+	}
+	err = doneJob(&job.Result{Job: j, Output: &job.Output{
+		Pass: false,
+		// ベンチマーカーは同じ失敗を回数つきでまとめ、ソートして送ってくる
+		Messages: []string{
+			"[GET /] リクエストがタイムアウトしました (x3)",
+			"[POST /api/strokes/rooms/1] ステータスが200ではありません: 500",
+			"[POST /api/strokes/rooms/1] レスポンスが正しくありません (x5)",
+		},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := requestAsTeam(serveIndex, http.MethodGet, "/", "49")
+	if w.Code != http.StatusOK {
+		t.Fatalf("want %d, got %d", http.StatusOK, w.Code)
+	}
+	body := w.Body.String()
+	for _, want := range []string{
+		"[GET /] リクエストがタイムアウトしました (x3)",
+		"[POST /api/strokes/rooms/1] ステータスが200ではありません: 500",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("index should contain %q", want)
+		}
+	}
+
+	// 多い順に返る
+	w = requestAsTeam(serveJobFailures, http.MethodGet, "/api/job/failures", "49")
+	if w.Code != http.StatusOK {
+		t.Fatalf("want %d, got %d", http.StatusOK, w.Code)
+	}
+	var failures []FailureMessage
+	err = json.NewDecoder(w.Body).Decode(&failures)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []FailureMessage{
+		{"[POST /api/strokes/rooms/1] レスポンスが正しくありません", 5},
+		{"[GET /] リクエストがタイムアウトしました", 3},
+		{"[POST /api/strokes/rooms/1] ステータスが200ではありません: 500", 1},
+	}
+	if !reflect.DeepEqual(failures, expect) {
+		t.Errorf("something went wrong: %#v", failures)
+	}
+}
+
+func TestSplitFailureCount(t *testing.T) {
+	testCases := []struct {
+		msg    string
+		expect string
+		count  int
+	}{
+		{"[GET /] リクエストがタイムアウトしました", "[GET /] リクエストがタイムアウトしました", 1},
+		{"[GET /] リクエストがタイムアウトしました (x3)", "[GET /] リクエストがタイムアウトしました", 3},
+		{"トップページの内容が正しくありません (critical) (x2)", "トップページの内容が正しくありません (critical)", 2},
+		{"(x2)", "(x2)", 1},
+	}
+
+	for _, tc := range testCases {
+		got, n := splitFailureCount(tc.msg)
+		if got != tc.expect || n != tc.count {
+			t.Errorf("%q: want %q %d, got %q %d", tc.msg, tc.expect, tc.count, got, n)
+		}
+	}
+}